@@ -0,0 +1,220 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
+)
+
+const (
+	// IPCFormatText sends IPC messages as a keyword followed by KEY=value
+	// pairs, as described in the Pluggable Transport specification, for
+	// example LOG SEVERITY=info MESSAGE="obfs4 - registered listener".
+	IPCFormatText = "text"
+
+	// IPCFormatJSON sends each IPC message as a JSON object on its own line,
+	// with the keyword in its "type" field.
+	IPCFormatJSON = "json"
+
+	ipcTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+)
+
+var ipcFormat = IPCFormatText
+var ipcTransports = make(map[string]bool)
+var ipcLock sync.Mutex
+
+// SetIPCFormat sets the format of the LOG and STATUS messages sent to the
+// parent process, either IPCFormatText or IPCFormatJSON.
+func SetIPCFormat(format string) error {
+	switch format {
+	case IPCFormatText, IPCFormatJSON:
+		ipcFormat = format
+		return nil
+	default:
+		return fmt.Errorf("invalid IPC log format '%s'", format)
+	}
+}
+
+// SetIPCTransports sets the names of the transports, so that LOG messages
+// about a transport can be tagged with its name.
+func SetIPCTransports(names []string) {
+	ipcLock.Lock()
+	defer ipcLock.Unlock()
+
+	ipcTransports = make(map[string]bool)
+	for _, name := range names {
+		ipcTransports[name] = true
+	}
+}
+
+// IPCEnabled reports whether messages at the given level are sent to the
+// parent process.
+func IPCEnabled(level int) bool {
+	return ipcLogLevel != LevelNone && ipcLogLevel >= level
+}
+
+// Status sends a STATUS message about the named transport to the parent
+// process, with the given KEY and value pairs, if IPC messages at the given
+// level are enabled.
+func Status(level int, transport string, keyvals ...string) {
+	if !IPCEnabled(level) {
+		return
+	}
+
+	fields := []ipcField{
+		{"TRANSPORT", transport},
+		{"TIMESTAMP", time.Now().UTC().Format(ipcTimeFormat)},
+	}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fields = append(fields, ipcField{keyvals[i], keyvals[i+1]})
+	}
+
+	writeIPC("STATUS", fields)
+}
+
+func ipcLogMessage(logLevel int, transport string, message string) {
+	var severity string
+	switch logLevel {
+	case LevelError:
+		severity = "error"
+	case LevelWarn:
+		severity = "warning"
+	case LevelInfo:
+		severity = "info"
+	case LevelDebug:
+		severity = "debug"
+	default:
+		return
+	}
+
+	fields := []ipcField{{"SEVERITY", severity}}
+	if transport != "" {
+		fields = append(fields, ipcField{"TRANSPORT", transport})
+	}
+	fields = append(fields,
+		ipcField{"TIMESTAMP", time.Now().UTC().Format(ipcTimeFormat)},
+		ipcField{"MESSAGE", message})
+
+	writeIPC("LOG", fields)
+}
+
+// messageTransport returns the transport that a log message is about, from
+// the "name - " or "name(address) - " prefix of the message.
+func messageTransport(message string) string {
+	end := strings.Index(message, " - ")
+	if end == -1 {
+		return ""
+	}
+
+	name := message[:end]
+	if paren := strings.IndexByte(name, '('); paren != -1 {
+		name = name[:paren]
+	}
+
+	ipcLock.Lock()
+	defer ipcLock.Unlock()
+	if !ipcTransports[name] {
+		return ""
+	}
+
+	return name
+}
+
+type ipcField struct {
+	key   string
+	value string
+}
+
+// writeIPC sends a message to the parent process on the Pluggable Transport
+// stdout channel, as a single write so that it is not interleaved with other
+// messages.
+func writeIPC(keyword string, fields []ipcField) {
+	var line string
+	if ipcFormat == IPCFormatJSON {
+		object := map[string]string{"type": keyword}
+		for _, field := range fields {
+			object[strings.ToLower(field.key)] = field.value
+		}
+		encoded, err := json.Marshal(object)
+		if err != nil {
+			return
+		}
+		line = string(encoded)
+	} else {
+		var builder strings.Builder
+		builder.WriteString(keyword)
+		for _, field := range fields {
+			builder.WriteString(" " + field.key + "=" + quoteIPCValue(field.value))
+		}
+		line = builder.String()
+	}
+
+	ipcLock.Lock()
+	defer ipcLock.Unlock()
+	_, _ = pt.Stdout.Write([]byte(line + "\n"))
+}
+
+// quoteIPCValue returns a value unchanged if it can be sent as it is, and
+// otherwise in double quotes with C escapes for quotes, backslashes and
+// bytes that are not printable ASCII.
+func quoteIPCValue(value string) string {
+	needsQuotes := value == ""
+	for i := 0; i < len(value) && !needsQuotes; i++ {
+		b := value[i]
+		needsQuotes = b <= ' ' || b >= 0x7f || b == '"' || b == '\\' || b == '='
+	}
+	if !needsQuotes {
+		return value
+	}
+
+	var builder strings.Builder
+	builder.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		switch b := value[i]; {
+		case b == '"' || b == '\\':
+			builder.WriteByte('\\')
+			builder.WriteByte(b)
+		case b == '\n':
+			builder.WriteString(`\n`)
+		case b == '\r':
+			builder.WriteString(`\r`)
+		case b == '\t':
+			builder.WriteString(`\t`)
+		case b < ' ' || b >= 0x7f:
+			fmt.Fprintf(&builder, `\%03o`, b)
+		default:
+			builder.WriteByte(b)
+		}
+	}
+	builder.WriteByte('"')
+
+	return builder.String()
+}
@@ -0,0 +1,91 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"testing"
+
+	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
+)
+
+// captureIPC returns what is sent to the parent process while run is called,
+// with IPC logging enabled at the INFO level.
+func captureIPC(run func()) string {
+	var output bytes.Buffer
+	stdout := pt.Stdout
+	pt.Stdout = &output
+	ipcLogLevel = LevelInfo
+	defer func() {
+		pt.Stdout = stdout
+		ipcLogLevel = LevelNone
+	}()
+
+	run()
+
+	return output.String()
+}
+
+// TestQuoteIPCValue tests that values are only quoted when they need to be,
+// and that quotes, backslashes and unprintable bytes are escaped.
+func TestQuoteIPCValue(t *testing.T) {
+	for value, expected := range map[string]string{
+		"obfs4":          `obfs4`,
+		"":               `""`,
+		"two words":      `"two words"`,
+		`say "hi"`:       `"say \"hi\""`,
+		`C:\dir`:         `"C:\\dir"`,
+		"a=b":            `"a=b"`,
+		"line\nbreak":    `"line\nbreak"`,
+		"nul\x00, \xe9t": `"nul\000, \351t"`,
+	} {
+		if quoted := quoteIPCValue(value); quoted != expected {
+			t.Errorf("quoteIPCValue(%q) = %s, expected %s", value, quoted, expected)
+		}
+	}
+}
+
+// TestIPCLogMessage tests that log messages are sent as LOG lines, tagged
+// with the transport they are about.
+func TestIPCLogMessage(t *testing.T) {
+	SetIPCTransports([]string{"obfs4"})
+	defer SetIPCTransports(nil)
+
+	output := captureIPC(func() {
+		Infof("obfs4(%s) - new connection", "[scrubbed]:443")
+		Warnf("no transport here")
+		Debugf("not sent at the INFO level")
+	})
+
+	expected := regexp.MustCompile(`^LOG SEVERITY=info TRANSPORT=obfs4 TIMESTAMP=\S+ MESSAGE="obfs4\(\[scrubbed\]:443\) - new connection"\n` +
+		`LOG SEVERITY=warning TIMESTAMP=\S+ MESSAGE="no transport here"\n$`)
+	if !expected.MatchString(output) {
+		t.Errorf("unexpected output %q", output)
+	}
+}
+
+// TestIPCStatusJSON tests that STATUS messages are sent as JSON objects in
+// the JSON format.
+func TestIPCStatusJSON(t *testing.T) {
+	if err := SetIPCFormat(IPCFormatJSON); err != nil {
+		t.Fatal("SetIPCFormat failed:", err)
+	}
+	defer SetIPCFormat(IPCFormatText)
+
+	output := captureIPC(func() {
+		Status(LevelInfo, "obfs4", "CONNECT", "Success")
+		Status(LevelDebug, "obfs4", "NOT", "Sent")
+	})
+
+	var message map[string]string
+	if err := json.Unmarshal([]byte(output), &message); err != nil {
+		t.Fatalf("could not parse %q: %s", output, err)
+	}
+	if message["type"] != "STATUS" || message["transport"] != "obfs4" || message["connect"] != "Success" || message["timestamp"] == "" {
+		t.Errorf("unexpected message %v", message)
+	}
+
+	if err := SetIPCFormat("xml"); err == nil {
+		t.Error("SetIPCFormat accepted an unknown format")
+	}
+}
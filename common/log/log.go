@@ -36,6 +36,7 @@ import (
 	"net"
 	"os"
 	"strings"
+	"time"
 )
 
 const (
@@ -57,12 +58,17 @@ const (
 	LevelNone
 )
 
+// LevelNotice is the level of NOTICE messages, which are logged by every
+// sink regardless of its level.
+const LevelNotice = LevelError - 1
+
 var logLevel = LevelInfo
 var ipcLogLevel = LevelNone
-var enableLogging bool
 var unsafeLogging bool
 
-// Init initializes logging with the given path, and log safety options.
+// Init initializes logging with the given path, and log safety options.  If
+// enable is true, messages at the level set by SetLogLevel are logged to the
+// file at logFilePath, in addition to the sinks added with AddSink.
 func Init(enable bool, logFilePath string, ipcLog int) error {
 	if enable {
 		f, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
@@ -70,106 +76,132 @@ func Init(enable bool, logFilePath string, ipcLog int) error {
 			return err
 		}
 		log.SetOutput(f)
+		AddSink(NewTextSink(f), logLevel)
 	} else {
 		log.SetOutput(ioutil.Discard)
 	}
-	enableLogging = enable
 	ipcLogLevel = ipcLog
 	return nil
 }
 
-// SetLogLevel sets the log level to the value indicated by the given string
+// ParseLevel returns the log level indicated by the given string
 // (case-insensitive).
-func SetLogLevel(logLevelStr string) error {
+func ParseLevel(logLevelStr string) (int, error) {
 	switch strings.ToUpper(logLevelStr) {
 	case "ERROR":
-		logLevel = LevelError
+		return LevelError, nil
 	case "WARN":
-		logLevel = LevelWarn
+		return LevelWarn, nil
 	case "INFO":
-		logLevel = LevelInfo
+		return LevelInfo, nil
 	case "DEBUG":
-		logLevel = LevelDebug
+		return LevelDebug, nil
 	default:
-		return fmt.Errorf("invalid log level '%s'", logLevelStr)
+		return LevelNone, fmt.Errorf("invalid log level '%s'", logLevelStr)
 	}
-	return nil
 }
 
-func ipcLogMessage(logLevel int, message string) {
-	var logLevelStr string
-	switch logLevel {
-	case LevelNone:
-		logLevelStr = "NONE"
-	case LevelError:
-		logLevelStr = "ERROR"
-	case LevelWarn:
-		logLevelStr = "WARN"
-	case LevelInfo:
-		logLevelStr = "INFO"
-	case LevelDebug:
-		logLevelStr = "DEBUG"
-	default:
-		return
+// SetLogLevel sets the log level to the value indicated by the given string
+// (case-insensitive).
+func SetLogLevel(logLevelStr string) error {
+	level, err := ParseLevel(logLevelStr)
+	if err != nil {
+		return err
 	}
-	println("LOG "+logLevelStr+" "+message)
+	logLevel = level
+	return nil
 }
 
 // Noticef logs the given format string/arguments at the NOTICE log level.
 // Unless logging is disabled, Noticef logs are always emitted.
 func Noticef(format string, a ...interface{}) {
-	if enableLogging {
-		msg := fmt.Sprintf(format, a...)
-		log.Print("[NOTICE]: " + msg)
-	}
+	logf(LevelNotice, Fields{}, format, a)
 }
 
 // Errorf logs the given format string/arguments at the ERROR log level.
 func Errorf(format string, a ...interface{}) {
-	if enableLogging && logLevel >= LevelError {
-		msg := fmt.Sprintf(format, a...)
-		log.Print("[ERROR]: " + msg)
-	}
-	if ipcLogLevel != LevelNone && ipcLogLevel >= LevelError {
-		msg := fmt.Sprintf(format, a...)
-		ipcLogMessage(LevelError, msg)
-	}
+	logf(LevelError, Fields{}, format, a)
 }
 
 // Warnf logs the given format string/arguments at the WARN log level.
 func Warnf(format string, a ...interface{}) {
-	if enableLogging && logLevel >= LevelWarn {
-		msg := fmt.Sprintf(format, a...)
-		log.Print("[WARN]: " + msg)
-	}
-	if ipcLogLevel != LevelNone && ipcLogLevel >= LevelWarn {
-		msg := fmt.Sprintf(format, a...)
-		ipcLogMessage(LevelWarn, msg)
-	}
+	logf(LevelWarn, Fields{}, format, a)
 }
 
 // Infof logs the given format string/arguments at the INFO log level.
 func Infof(format string, a ...interface{}) {
-	if enableLogging && logLevel >= LevelInfo {
-		msg := fmt.Sprintf(format, a...)
-		log.Print("[INFO]: " + msg)
-	}
-	if ipcLogLevel != LevelNone && ipcLogLevel >= LevelInfo {
-		msg := fmt.Sprintf(format, a...)
-		ipcLogMessage(LevelInfo, msg)
-	}
+	logf(LevelInfo, Fields{}, format, a)
 }
 
 // Debugf logs the given format string/arguments at the DEBUG log level.
 func Debugf(format string, a ...interface{}) {
-	if enableLogging && logLevel >= LevelDebug {
-		msg := fmt.Sprintf(format, a...)
-		log.Print("[DEBUG]: " + msg)
+	logf(LevelDebug, Fields{}, format, a)
+}
+
+// Logger logs messages with a set of structured fields.
+type Logger struct {
+	fields Fields
+	prefix string
+}
+
+// With returns a logger that records fields with each message.  The address
+// in fields must already be scrubbed with ElideAddr.  The messages are
+// prefixed with the transport, address and session, as in
+// "obfs4([scrubbed]:443)[5f3a09c2e1b4] - ", so that they read the same in
+// text logs as other messages.
+func With(fields Fields) *Logger {
+	logger := &Logger{fields: fields}
+	if fields.Transport != "" {
+		logger.prefix = fields.Transport
+		if fields.Addr != "" {
+			logger.prefix += "(" + fields.Addr + ")"
+		}
+		if fields.Session != "" {
+			logger.prefix += "[" + fields.Session + "]"
+		}
+		logger.prefix += " - "
 	}
-	if ipcLogLevel != LevelNone && ipcLogLevel >= LevelDebug {
-		msg := fmt.Sprintf(format, a...)
-		ipcLogMessage(LevelDebug, msg)
+
+	return logger
+}
+
+// Errorf logs the given format string/arguments at the ERROR log level.
+func (logger *Logger) Errorf(format string, a ...interface{}) {
+	logf(LevelError, logger.fields, logger.prefix+format, a)
+}
+
+// Warnf logs the given format string/arguments at the WARN log level.
+func (logger *Logger) Warnf(format string, a ...interface{}) {
+	logf(LevelWarn, logger.fields, logger.prefix+format, a)
+}
+
+// Infof logs the given format string/arguments at the INFO log level.
+func (logger *Logger) Infof(format string, a ...interface{}) {
+	logf(LevelInfo, logger.fields, logger.prefix+format, a)
+}
+
+// Debugf logs the given format string/arguments at the DEBUG log level.
+func (logger *Logger) Debugf(format string, a ...interface{}) {
+	logf(LevelDebug, logger.fields, logger.prefix+format, a)
+}
+
+// logf sends a message to the parent process and to each of the sinks that
+// log its level.
+func logf(level int, fields Fields, format string, a []interface{}) {
+	toIPC := level != LevelNotice && IPCEnabled(level)
+	if !toIPC && !sinksEnabled(level) {
+		return
+	}
+
+	msg := fmt.Sprintf(format, a...)
+	if fields.Transport == "" {
+		fields.Transport = messageTransport(msg)
 	}
+	if toIPC {
+		ipcLogMessage(level, fields.Transport, msg)
+	}
+
+	logToSinks(Entry{Time: time.Now(), Level: level, Message: msg, Fields: fields})
 }
 
 // ElideError transforms the string representation of the provided error
@@ -211,8 +243,8 @@ func ElideError(err error) string {
 }
 
 // ElideAddr transforms the string representation of the provided address based
-// on the unsafeLogging setting.  Callers that wish to log IP addresses should
-// use ElideAddr to sanitize the contents first.
+// on the unsafeLogging setting and the scrub mode.  Callers that wish to log IP
+// addresses should use ElideAddr to sanitize the contents first.
 func ElideAddr(addrStr string) string {
 	if unsafeLogging {
 		return addrStr
@@ -220,8 +252,8 @@ func ElideAddr(addrStr string) string {
 
 	// Only scrub off the address so that it's easier to track connections
 	// in logs by looking at the port.
-	if _, port, err := net.SplitHostPort(addrStr); err == nil {
-		return elidedAddr + ":" + port
+	if host, port, err := net.SplitHostPort(addrStr); err == nil {
+		return scrubHost(host) + ":" + port
 	}
-	return elidedAddr
+	return scrubHost(addrStr)
 }
@@ -0,0 +1,211 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package log
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ScrubFull replaces each address with "[scrubbed]".
+	ScrubFull = "full"
+
+	// ScrubHash replaces each address with a hash of it, salted with a
+	// random value chosen for each run, so that the connections of one
+	// client can be told apart from others without logging its address.
+	ScrubHash = "hash"
+
+	// ScrubSubnet keeps the /24 network of IPv4 addresses and the /48
+	// network of IPv6 addresses.
+	ScrubSubnet = "subnet"
+
+	// ScrubASN replaces each address with the number of the autonomous
+	// system that announces it.
+	ScrubASN = "asn"
+)
+
+// hashSize is the number of bytes of the salted hash that are logged.
+const hashSize = 6
+
+var scrubMode = ScrubFull
+var scrubSalt []byte
+var asnTable *ASNTable
+
+// SetUnsafeLogging disables the scrubbing of addresses and errors, so that
+// they are logged as they are.  It is meant for debugging only, since the
+// logs then contain the addresses of users.
+func SetUnsafeLogging(enable bool) {
+	unsafeLogging = enable
+}
+
+// SetScrubMode sets how ElideAddr scrubs addresses, to one of ScrubFull,
+// ScrubHash, ScrubSubnet or ScrubASN.  ScrubASN requires a table to look up
+// the autonomous systems in, loaded with LoadASNTable.  It must be called
+// before any messages are logged.
+func SetScrubMode(mode string, table *ASNTable) error {
+	switch mode {
+	case ScrubFull, ScrubSubnet:
+	case ScrubHash:
+		salt := make([]byte, sha256.Size)
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+		scrubSalt = salt
+	case ScrubASN:
+		if table == nil {
+			return fmt.Errorf("scrub mode %s requires an ASN table", mode)
+		}
+	default:
+		return fmt.Errorf("invalid scrub mode %q", mode)
+	}
+
+	scrubMode = mode
+	asnTable = table
+	return nil
+}
+
+// scrubHost returns what is logged in place of a host, which is a name or an
+// IP address, according to the scrub mode.
+func scrubHost(host string) string {
+	switch scrubMode {
+	case ScrubHash:
+		mac := hmac.New(sha256.New, scrubSalt)
+		_, _ = mac.Write([]byte(host))
+		return "[hash:" + hex.EncodeToString(mac.Sum(nil)[:hashSize]) + "]"
+	case ScrubSubnet:
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return elidedAddr
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return "[" + ip4.Mask(net.CIDRMask(24, 32)).String() + "/24]"
+		}
+		return "[" + ip.Mask(net.CIDRMask(48, 128)).String() + "/48]"
+	case ScrubASN:
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return elidedAddr
+		}
+		if asn, ok := asnTable.Lookup(ip); ok {
+			return "[AS" + strconv.FormatUint(uint64(asn), 10) + "]"
+		}
+		return "[AS?]"
+	default:
+		return elidedAddr
+	}
+}
+
+// ASNTable maps IP networks to the autonomous systems that announce them.
+type ASNTable struct {
+	// prefixes maps the length of each prefix in the table to the
+	// networks of that length, keyed by their 16 byte address.
+	prefixes map[int]map[string]uint32
+
+	// lengths are the prefix lengths in the table, longest first.
+	lengths []int
+}
+
+// LoadASNTable reads a table of networks and autonomous system numbers from
+// the file at path.  Each line holds a network in CIDR notation and an AS
+// number, separated by white space, as in the data files of pyasn.  Empty
+// lines and lines starting with ';' or '#' are skipped.
+func LoadASNTable(path string) (*ASNTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	table := &ASNTable{prefixes: make(map[int]map[string]uint32)}
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a network and an AS number", path, lineNumber)
+		}
+		_, network, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, lineNumber, err)
+		}
+		asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(fields[1]), "AS"), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid AS number %q", path, lineNumber, fields[1])
+		}
+		table.add(network, uint32(asn))
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return table, nil
+}
+
+func (table *ASNTable) add(network *net.IPNet, asn uint32) {
+	ones, bits := network.Mask.Size()
+	// IPv4 networks are stored as IPv4-mapped IPv6 networks.
+	length := ones + 128 - bits
+
+	networks, ok := table.prefixes[length]
+	if !ok {
+		networks = make(map[string]uint32)
+		table.prefixes[length] = networks
+		table.lengths = append(table.lengths, length)
+		sort.Sort(sort.Reverse(sort.IntSlice(table.lengths)))
+	}
+	networks[string(network.IP.To16())] = asn
+}
+
+// Lookup returns the AS number of the longest network in the table that
+// contains ip.
+func (table *ASNTable) Lookup(ip net.IP) (uint32, bool) {
+	ip = ip.To16()
+	if table == nil || ip == nil {
+		return 0, false
+	}
+
+	for _, length := range table.lengths {
+		key := string(ip.Mask(net.CIDRMask(length, 128)))
+		if asn, ok := table.prefixes[length][key]; ok {
+			return asn, true
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,95 @@
+package log
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// TestScrubModes tests how addresses are logged in each scrub mode.
+func TestScrubModes(t *testing.T) {
+	defer func() { _ = SetScrubMode(ScrubFull, nil) }()
+
+	if err := SetScrubMode(ScrubSubnet, nil); err != nil {
+		t.Fatal("SetScrubMode failed:", err)
+	}
+	for addr, expected := range map[string]string{
+		"203.0.113.77:443":      "[203.0.113.0/24]:443",
+		"[2001:db8:1:2::5]:443": "[2001:db8:1::/48]:443",
+		"example.com:443":       "[scrubbed]:443",
+	} {
+		if scrubbed := ElideAddr(addr); scrubbed != expected {
+			t.Errorf("ElideAddr(%s) = %s in subnet mode, expected %s", addr, scrubbed, expected)
+		}
+	}
+
+	if err := SetScrubMode(ScrubHash, nil); err != nil {
+		t.Fatal("SetScrubMode failed:", err)
+	}
+	first := ElideAddr("203.0.113.77:443")
+	if !strings.HasPrefix(first, "[hash:") || strings.Contains(first, "203.0.113") {
+		t.Errorf("unexpected hashed address %s", first)
+	}
+	if ElideAddr("203.0.113.77:80") != strings.TrimSuffix(first, "443")+"80" {
+		t.Error("the same host was hashed differently")
+	}
+	if ElideAddr("203.0.113.78:443") == first {
+		t.Error("different hosts were hashed the same")
+	}
+
+	if err := SetScrubMode(ScrubASN, nil); err == nil {
+		t.Error("asn mode was set without a table")
+	}
+	if err := SetScrubMode("none", nil); err == nil {
+		t.Error("an invalid mode was set")
+	}
+}
+
+// TestASNTable tests that the longest matching network is found.
+func TestASNTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "asntest")
+	if err != nil {
+		t.Fatal("could not create a directory:", err)
+	}
+	defer os.RemoveAll(dir)
+	tablePath := path.Join(dir, "ipasn.dat")
+
+	data := "; IP-ASN32-DAT file\n203.0.112.0/20\t64500\n203.0.113.0/24\t64501\n2001:db8::/32\tAS64502\n"
+	if err = ioutil.WriteFile(tablePath, []byte(data), 0600); err != nil {
+		t.Fatal("could not write the table:", err)
+	}
+	table, err := LoadASNTable(tablePath)
+	if err != nil {
+		t.Fatal("LoadASNTable failed:", err)
+	}
+
+	for addr, expected := range map[string]uint32{"203.0.113.1": 64501, "203.0.114.1": 64500, "2001:db8::1": 64502, "198.51.100.1": 0} {
+		if asn, _ := table.Lookup(net.ParseIP(addr)); asn != expected {
+			t.Errorf("Lookup(%s) = %d, expected %d", addr, asn, expected)
+		}
+	}
+
+	if err = SetScrubMode(ScrubASN, table); err != nil {
+		t.Fatal("SetScrubMode failed:", err)
+	}
+	defer func() { _ = SetScrubMode(ScrubFull, nil) }()
+	if scrubbed := ElideAddr("203.0.113.1:443"); scrubbed != "[AS64501]:443" {
+		t.Errorf("unexpected scrubbed address %s", scrubbed)
+	}
+	if scrubbed := ElideAddr("198.51.100.1:443"); scrubbed != "[AS?]:443" {
+		t.Errorf("unexpected scrubbed address %s", scrubbed)
+	}
+}
+
+// TestUnsafeLogging tests that addresses are not scrubbed with unsafe logging.
+func TestUnsafeLogging(t *testing.T) {
+	SetUnsafeLogging(true)
+	defer SetUnsafeLogging(false)
+
+	if addr := ElideAddr("203.0.113.77:443"); addr != "203.0.113.77:443" {
+		t.Errorf("the address was logged as %s", addr)
+	}
+}
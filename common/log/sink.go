@@ -0,0 +1,292 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fields are the structured fields of a log entry.  Sinks that keep
+// structure, such as the JSON file sink, log them separately from the
+// message.
+type Fields struct {
+	// Transport is the name of the transport that the message is about.
+	Transport string
+
+	// Mode is the proxy mode of the dispatcher.
+	Mode string
+
+	// Session identifies the connection that the message is about.
+	Session string
+
+	// Addr is the address of the client, scrubbed with ElideAddr.
+	Addr string
+}
+
+// Entry is a log message with its level and fields.
+type Entry struct {
+	Time    time.Time
+	Level   int
+	Message string
+	Fields
+}
+
+// Sink is a destination for log entries.  Log may be called from several
+// goroutines at once.
+type Sink interface {
+	Log(entry Entry)
+}
+
+type levelSink struct {
+	sink  Sink
+	level int
+}
+
+var sinks []levelSink
+var sinksLevel = LevelNotice
+var sinksLock sync.RWMutex
+var logMode string
+
+// AddSink adds a sink for the messages at the given level and above, in
+// addition to the sinks that were already added.
+func AddSink(sink Sink, level int) {
+	sinksLock.Lock()
+	defer sinksLock.Unlock()
+
+	sinks = append(sinks, levelSink{sink, level})
+	if level > sinksLevel {
+		sinksLevel = level
+	}
+}
+
+// SetMode sets the proxy mode that is recorded with each log entry.
+func SetMode(mode string) {
+	logMode = mode
+}
+
+func sinksEnabled(level int) bool {
+	sinksLock.RLock()
+	defer sinksLock.RUnlock()
+
+	return len(sinks) > 0 && level <= sinksLevel
+}
+
+func logToSinks(entry Entry) {
+	if entry.Mode == "" {
+		entry.Mode = logMode
+	}
+
+	sinksLock.RLock()
+	defer sinksLock.RUnlock()
+
+	for _, s := range sinks {
+		if entry.Level <= s.level {
+			s.sink.Log(entry)
+		}
+	}
+}
+
+// levelName returns the name of a level as it appears in text logs.
+func levelName(level int) string {
+	switch level {
+	case LevelNotice:
+		return "NOTICE"
+	case LevelError:
+		return "ERROR"
+	case LevelWarn:
+		return "WARN"
+	case LevelInfo:
+		return "INFO"
+	default:
+		return "DEBUG"
+	}
+}
+
+// textSink writes entries as timestamped "[LEVEL]: message" lines.
+type textSink struct {
+	logger *log.Logger
+}
+
+// NewTextSink returns a sink that writes entries to w as timestamped
+// "[LEVEL]: message" lines.
+func NewTextSink(w io.Writer) Sink {
+	return &textSink{logger: log.New(w, "", log.LstdFlags)}
+}
+
+func (sink *textSink) Log(entry Entry) {
+	sink.logger.Print("[" + levelName(entry.Level) + "]: " + entry.Message)
+}
+
+// jsonEntry is the form of an entry in a JSON log file.
+type jsonEntry struct {
+	Time      string `json:"time"`
+	Level     string `json:"level"`
+	Message   string `json:"msg"`
+	Transport string `json:"transport,omitempty"`
+	Mode      string `json:"mode,omitempty"`
+	Session   string `json:"session,omitempty"`
+	Addr      string `json:"addr,omitempty"`
+}
+
+// jsonFileSink writes entries to a file as JSON objects, one per line, and
+// rotates the file when it grows too large.
+type jsonFileSink struct {
+	lock       sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewJSONFileSink returns a sink that appends entries to the file at path as
+// JSON objects, one per line.  When the file would grow beyond maxSize bytes
+// it is renamed to path.1, the previous path.1 to path.2 and so on, keeping
+// at most maxBackups old files.  A maxSize of zero disables rotation.
+func NewJSONFileSink(path string, maxSize int64, maxBackups int) (Sink, error) {
+	sink := &jsonFileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+
+	return sink, nil
+}
+
+func (sink *jsonFileSink) open() error {
+	file, err := os.OpenFile(sink.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	sink.file = file
+	sink.size = info.Size()
+	return nil
+}
+
+func (sink *jsonFileSink) rotate() error {
+	_ = sink.file.Close()
+
+	for i := sink.maxBackups - 1; i > 0; i-- {
+		_ = os.Rename(sink.path+"."+strconv.Itoa(i), sink.path+"."+strconv.Itoa(i+1))
+	}
+	if sink.maxBackups > 0 {
+		_ = os.Rename(sink.path, sink.path+".1")
+	} else {
+		_ = os.Remove(sink.path)
+	}
+
+	return sink.open()
+}
+
+func (sink *jsonFileSink) Log(entry Entry) {
+	line, err := json.Marshal(jsonEntry{
+		Time:      entry.Time.UTC().Format(time.RFC3339Nano),
+		Level:     strings.ToLower(levelName(entry.Level)),
+		Message:   entry.Message,
+		Transport: entry.Transport,
+		Mode:      entry.Mode,
+		Session:   entry.Session,
+		Addr:      entry.Addr,
+	})
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+
+	if sink.file == nil {
+		return
+	}
+	if sink.maxSize > 0 && sink.size > 0 && sink.size+int64(len(line)) > sink.maxSize {
+		if err = sink.rotate(); err != nil {
+			// Stop logging to the file rather than failing on every entry.
+			sink.file = nil
+			return
+		}
+	}
+
+	n, _ := sink.file.Write(line)
+	sink.size += int64(n)
+}
+
+// AddSinks adds the sinks in a comma separated list of specifications, each
+// of the form kind:LEVEL[:path].  The kinds are "stderr", "syslog", which
+// logs to the local syslog or journald socket, and "json", which logs to the
+// JSON file at path, rotated as described for NewJSONFileSink.
+func AddSinks(spec string, maxSize int64, maxBackups int) error {
+	for _, sinkSpec := range strings.Split(spec, ",") {
+		sinkSpec = strings.TrimSpace(sinkSpec)
+		if sinkSpec == "" {
+			continue
+		}
+
+		parts := strings.SplitN(sinkSpec, ":", 3)
+		if len(parts) < 2 {
+			return fmt.Errorf("log sink %q has no level", sinkSpec)
+		}
+		level, err := ParseLevel(parts[1])
+		if err != nil {
+			return fmt.Errorf("log sink %q: %s", sinkSpec, err)
+		}
+
+		var sink Sink
+		switch parts[0] {
+		case "stderr":
+			sink = NewTextSink(os.Stderr)
+		case "syslog":
+			if sink, err = NewSyslogSink(); err != nil {
+				return fmt.Errorf("log sink %q: %s", sinkSpec, err)
+			}
+		case "json":
+			if len(parts) < 3 || parts[2] == "" {
+				return fmt.Errorf("log sink %q has no path", sinkSpec)
+			}
+			if sink, err = NewJSONFileSink(parts[2], maxSize, maxBackups); err != nil {
+				return fmt.Errorf("log sink %q: %s", sinkSpec, err)
+			}
+		default:
+			return fmt.Errorf("unknown log sink %q", parts[0])
+		}
+
+		AddSink(sink, level)
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package log
+
+import (
+	"log/syslog"
+)
+
+// syslogSink writes entries to the local syslog or journald socket.
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+// NewSyslogSink returns a sink that writes entries to the local syslog or
+// journald socket, with the priority of their level.
+func NewSyslogSink() (Sink, error) {
+	writer, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "shapeshifter-dispatcher")
+	if err != nil {
+		return nil, err
+	}
+
+	return &syslogSink{writer: writer}, nil
+}
+
+func (sink *syslogSink) Log(entry Entry) {
+	switch entry.Level {
+	case LevelNotice:
+		_ = sink.writer.Notice(entry.Message)
+	case LevelError:
+		_ = sink.writer.Err(entry.Message)
+	case LevelWarn:
+		_ = sink.writer.Warning(entry.Message)
+	case LevelInfo:
+		_ = sink.writer.Info(entry.Message)
+	default:
+		_ = sink.writer.Debug(entry.Message)
+	}
+}
@@ -0,0 +1,105 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// resetSinks removes the sinks added by a test.
+func resetSinks() {
+	sinksLock.Lock()
+	defer sinksLock.Unlock()
+
+	sinks = nil
+	sinksLevel = LevelNotice
+}
+
+// TestSinkLevels tests that each sink only logs messages at its own level
+// and above, and that notices are always logged.
+func TestSinkLevels(t *testing.T) {
+	defer resetSinks()
+
+	var warnings, everything bytes.Buffer
+	AddSink(NewTextSink(&warnings), LevelWarn)
+	AddSink(NewTextSink(&everything), LevelDebug)
+
+	Noticef("starting")
+	Warnf("warning")
+	Debugf("details")
+
+	if text := warnings.String(); !strings.Contains(text, "[NOTICE]: starting") || !strings.Contains(text, "[WARN]: warning") || strings.Contains(text, "details") {
+		t.Errorf("the WARN sink logged %q", text)
+	}
+	if text := everything.String(); !strings.Contains(text, "[DEBUG]: details") {
+		t.Errorf("the DEBUG sink logged %q", text)
+	}
+}
+
+// TestJSONFileSink tests that entries are logged with their fields, and that
+// the file is rotated when it grows too large.
+func TestJSONFileSink(t *testing.T) {
+	defer resetSinks()
+	SetIPCTransports([]string{"obfs4"})
+	defer SetIPCTransports(nil)
+	SetMode("socks5")
+	defer SetMode("")
+
+	dir, err := ioutil.TempDir("", "log")
+	if err != nil {
+		t.Fatal("could not create a directory:", err)
+	}
+	defer os.RemoveAll(dir)
+	logPath := path.Join(dir, "dispatcher.json")
+
+	if err = AddSinks("json:INFO:"+logPath, 300, 1); err != nil {
+		t.Fatal("AddSinks failed:", err)
+	}
+
+	With(Fields{Transport: "obfs4", Addr: "[scrubbed]:443", Session: "abc"}).Infof("new connection")
+	Infof("obfs4 - registered listener")
+
+	var entries []jsonEntry
+	for _, name := range []string{logPath + ".1", logPath} {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatalf("could not read %s: %s", name, err)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			var entry jsonEntry
+			if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				t.Fatalf("could not parse %q: %s", scanner.Text(), err)
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, expected one in each file", len(entries))
+	}
+	first := entries[0]
+	if first.Message != "obfs4([scrubbed]:443)[abc] - new connection" || first.Level != "info" || first.Transport != "obfs4" ||
+		first.Session != "abc" || first.Addr != "[scrubbed]:443" || first.Mode != "socks5" {
+		t.Errorf("unexpected first entry %+v", first)
+	}
+	if entries[1].Transport != "obfs4" {
+		t.Errorf("the transport was not found in %+v", entries[1])
+	}
+}
+
+// TestAddSinksInvalid tests that invalid sink specifications are rejected.
+func TestAddSinksInvalid(t *testing.T) {
+	defer resetSinks()
+
+	for _, spec := range []string{"stderr", "stderr:LOUD", "json:INFO", "file:INFO:/tmp/x"} {
+		if err := AddSinks(spec, 0, 0); err == nil {
+			t.Errorf("AddSinks accepted %q", spec)
+		}
+	}
+}
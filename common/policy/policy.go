@@ -0,0 +1,224 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+// Package policy implements the allow/deny rules that decide which
+// destinations chosen by clients a dispatcher server will connect to.
+//
+// A policy is a comma separated list of rules, which are checked in order.
+// The first rule that matches a destination decides whether it is allowed,
+// and destinations that match no rule are denied.  Each rule has the form
+// "allow=<host>" or "deny=<host>", where the host can be:
+//
+//	allow=*              any destination
+//	deny=10.0.0.0/8      an IPv4 or IPv6 network in CIDR notation
+//	deny=192.0.2.1       a single IP address
+//	allow=example.com    a domain name
+//	allow=*.example.com  any subdomain of a domain name
+//
+// The host may be followed by ":<port>" or ":<first>-<last>" to only match
+// some ports.  IPv6 addresses and networks must be written in brackets when a
+// port is given, as in "deny=[fc00::/7]:22".
+package policy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DefaultRules is the policy used when no other policy is configured.  It
+// allows every destination except loopback, private and link-local addresses.
+const DefaultRules = "deny=0.0.0.0/8,deny=127.0.0.0/8,deny=10.0.0.0/8," +
+	"deny=172.16.0.0/12,deny=192.168.0.0/16,deny=169.254.0.0/16," +
+	"deny=100.64.0.0/10,deny=::/128,deny=::1/128,deny=fc00::/7," +
+	"deny=fe80::/10,allow=*"
+
+// Policy is an ordered list of allow and deny rules.
+type Policy struct {
+	rules []rule
+}
+
+type rule struct {
+	allow     bool
+	network   *net.IPNet
+	domain    string
+	wildcard  bool
+	firstPort int
+	lastPort  int
+}
+
+// Parse parses a policy in the format described in the package
+// documentation.
+func Parse(rules string) (*Policy, error) {
+	var policy Policy
+	for _, text := range strings.Split(rules, ",") {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		r, err := parseRule(text)
+		if err != nil {
+			return nil, err
+		}
+		policy.rules = append(policy.rules, r)
+	}
+
+	return &policy, nil
+}
+
+// Default returns the policy described by DefaultRules.
+func Default() *Policy {
+	policy, err := Parse(DefaultRules)
+	if err != nil {
+		panic(err)
+	}
+
+	return policy
+}
+
+func parseRule(text string) (rule, error) {
+	r := rule{firstPort: 0, lastPort: 65535}
+
+	equals := strings.IndexByte(text, '=')
+	if equals == -1 {
+		return r, fmt.Errorf("invalid policy rule %q: expected allow=<host> or deny=<host>", text)
+	}
+	switch strings.ToLower(text[:equals]) {
+	case "allow":
+		r.allow = true
+	case "deny":
+		r.allow = false
+	default:
+		return r, fmt.Errorf("invalid policy rule %q: unknown action %q", text, text[:equals])
+	}
+
+	host, ports, err := splitHostPorts(text[equals+1:])
+	if err != nil {
+		return r, fmt.Errorf("invalid policy rule %q: %s", text, err)
+	}
+
+	if ports != "" && ports != "*" {
+		if r.firstPort, r.lastPort, err = parsePorts(ports); err != nil {
+			return r, fmt.Errorf("invalid policy rule %q: %s", text, err)
+		}
+	}
+
+	switch {
+	case host == "*":
+		r.wildcard = true
+	case strings.Contains(host, "/"):
+		if _, r.network, err = net.ParseCIDR(host); err != nil {
+			return r, fmt.Errorf("invalid policy rule %q: %s", text, err)
+		}
+	case net.ParseIP(host) != nil:
+		ip := net.ParseIP(host)
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		r.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	case host != "":
+		r.domain = strings.ToLower(strings.TrimSuffix(host, "."))
+	default:
+		return r, fmt.Errorf("invalid policy rule %q: missing host", text)
+	}
+
+	return r, nil
+}
+
+func splitHostPorts(text string) (host string, ports string, err error) {
+	if strings.HasPrefix(text, "[") {
+		end := strings.IndexByte(text, ']')
+		if end == -1 {
+			return "", "", fmt.Errorf("missing ']'")
+		}
+		host, rest := text[1:end], text[end+1:]
+		if rest == "" {
+			return host, "", nil
+		}
+		if !strings.HasPrefix(rest, ":") {
+			return "", "", fmt.Errorf("unexpected %q after ']'", rest)
+		}
+		return host, rest[1:], nil
+	}
+
+	// More than one colon is an IPv6 address without a port.
+	if strings.Count(text, ":") == 1 {
+		colon := strings.IndexByte(text, ':')
+		return text[:colon], text[colon+1:], nil
+	}
+
+	return text, "", nil
+}
+
+func parsePorts(ports string) (first int, last int, err error) {
+	firstStr, lastStr := ports, ports
+	if dash := strings.IndexByte(ports, '-'); dash != -1 {
+		firstStr, lastStr = ports[:dash], ports[dash+1:]
+	}
+
+	if first, err = strconv.Atoi(firstStr); err != nil || first < 0 || first > 65535 {
+		return 0, 0, fmt.Errorf("invalid port %q", firstStr)
+	}
+	if last, err = strconv.Atoi(lastStr); err != nil || last < first || last > 65535 {
+		return 0, 0, fmt.Errorf("invalid port %q", lastStr)
+	}
+
+	return first, last, nil
+}
+
+// Allowed reports whether a connection to ip:port is allowed.  domain is the
+// name that the destination was given as, or an empty string if it was given
+// as an IP address.  Callers should check every address a domain name
+// resolves to, and connect to the address that was checked.
+func (policy *Policy) Allowed(domain string, ip net.IP, port int) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, r := range policy.rules {
+		if r.matches(domain, ip, port) {
+			return r.allow
+		}
+	}
+
+	return false
+}
+
+func (r rule) matches(domain string, ip net.IP, port int) bool {
+	if port < r.firstPort || port > r.lastPort {
+		return false
+	}
+
+	switch {
+	case r.wildcard:
+		return true
+	case r.network != nil:
+		return ip != nil && r.network.Contains(ip)
+	case strings.HasPrefix(r.domain, "*."):
+		return strings.HasSuffix(domain, r.domain[1:])
+	default:
+		return domain != "" && domain == r.domain
+	}
+}
@@ -0,0 +1,63 @@
+package policy
+
+import (
+	"net"
+	"testing"
+)
+
+// TestAllowed tests that rules are matched in order by network, domain and
+// port.
+func TestAllowed(t *testing.T) {
+	policy, err := Parse("deny=10.1.0.0/16, allow=10.0.0.0/8, allow=*.example.com:443, allow=example.org:8000-8080, deny=[2001:db8::/32]:22, allow=2001:db8::/32")
+	if err != nil {
+		t.Fatal("Parse failed:", err)
+	}
+
+	tests := []struct {
+		domain  string
+		ip      string
+		port    int
+		allowed bool
+	}{
+		{"", "10.2.3.4", 80, true},
+		{"", "10.1.3.4", 80, false},
+		{"", "192.0.2.1", 80, false},
+		{"www.example.com", "192.0.2.1", 443, true},
+		{"WWW.Example.COM.", "192.0.2.1", 443, true},
+		{"www.example.com", "192.0.2.1", 80, false},
+		{"example.com", "192.0.2.1", 443, false},
+		{"example.org", "192.0.2.1", 8080, true},
+		{"example.org", "192.0.2.1", 8081, false},
+		{"", "2001:db8::1", 22, false},
+		{"", "2001:db8::1", 80, true},
+	}
+
+	for _, test := range tests {
+		if allowed := policy.Allowed(test.domain, net.ParseIP(test.ip), test.port); allowed != test.allowed {
+			t.Errorf("Allowed(%q, %s, %d) = %v, expected %v", test.domain, test.ip, test.port, allowed, test.allowed)
+		}
+	}
+}
+
+// TestDefault tests that the default policy denies local addresses.
+func TestDefault(t *testing.T) {
+	policy := Default()
+	if policy.Allowed("", net.ParseIP("127.0.0.1"), 80) {
+		t.Error("default policy allows loopback")
+	}
+	if policy.Allowed("", net.ParseIP("192.168.1.1"), 80) {
+		t.Error("default policy allows private addresses")
+	}
+	if !policy.Allowed("", net.ParseIP("192.0.2.1"), 80) {
+		t.Error("default policy denies public addresses")
+	}
+}
+
+// TestParseInvalid tests that malformed rules are rejected.
+func TestParseInvalid(t *testing.T) {
+	for _, rules := range []string{"10.0.0.0/8", "permit=*", "allow=", "allow=10.0.0.0/33", "allow=*:70000", "allow=*:90-80", "allow=[::1"} {
+		if _, err := Parse(rules); err == nil {
+			t.Errorf("Parse(%q) succeeded", rules)
+		}
+	}
+}
@@ -25,8 +25,15 @@ SOFTWARE.
 package pt_extras
 
 import (
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+
 	options2 "github.com/OperatorFoundation/shapeshifter-dispatcher/common"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/transports"
@@ -41,6 +48,33 @@ import (
 	"github.com/OperatorFoundation/shapeshifter-transports/transports/obfs4/v2"
 )
 
+// MergeOptions combines the global transport options with the per-connection
+// arguments received during the SOCKS handshake.  Per-connection arguments
+// override global options with the same key.
+func MergeOptions(options string, args map[string]interface{}) (string, error) {
+	if len(args) == 0 {
+		return options, nil
+	}
+
+	merged := make(map[string]interface{})
+	if options != "" {
+		if err := json.Unmarshal([]byte(options), &merged); err != nil {
+			return "", errors.New("could not parse transport options")
+		}
+	}
+
+	for key, value := range args {
+		merged[key] = value
+	}
+
+	mergedBytes, err := json.Marshal(merged)
+	if err != nil {
+		return "", errors.New("could not encode transport options")
+	}
+
+	return string(mergedBytes), nil
+}
+
 // target is the server address string
 func ArgsToDialer(target string, name string, args string, dialer proxy.Dialer) (Optimizer.Transport, error) {
 	switch name {
@@ -58,7 +92,7 @@ func ArgsToDialer(target string, name string, args string, dialer proxy.Dialer)
 		}
 	case "shadow":
 
-		transport, err := transports.ParseArgsShadow(args, target)
+		transport, err := transports.ParseArgsShadow(args, target, dialer)
 		if err != nil {
 			log.Errorf("Could not parse options %s", err.Error())
 			return nil, err
@@ -202,3 +236,45 @@ func ArgsToListener(name string, stateDir string, options string) (func(address
 
 	return listen, nil
 }
+
+// ListenerArgs returns the arguments that clients need to connect to the
+// named server transport, which are sent in the ARGS of its SMETHOD line.  It
+// must be called after ArgsToListener has created the transport's state in
+// stateDir.  Transports that clients can connect to without arguments return
+// nil.
+func ListenerArgs(name string, stateDir string) (map[string]interface{}, error) {
+	switch name {
+	case "obfs4":
+		// The obfs4 server keeps its identity in its state file, and the
+		// cert is the node ID followed by the public key.
+		stateBytes, err := ioutil.ReadFile(path.Join(stateDir, "obfs4_state.json"))
+		if err != nil {
+			return nil, err
+		}
+
+		var state struct {
+			NodeID    string `json:"node-id"`
+			PublicKey string `json:"public-key"`
+			IATMode   int    `json:"iat-mode"`
+		}
+		if err = json.Unmarshal(stateBytes, &state); err != nil {
+			return nil, errors.New("could not parse obfs4 state")
+		}
+		nodeID, err := hex.DecodeString(state.NodeID)
+		if err != nil {
+			return nil, errors.New("could not parse obfs4 node ID")
+		}
+		publicKey, err := hex.DecodeString(state.PublicKey)
+		if err != nil {
+			return nil, errors.New("could not parse obfs4 public key")
+		}
+
+		cert := base64.StdEncoding.EncodeToString(append(nodeID, publicKey...))
+		return map[string]interface{}{
+			"cert":     strings.TrimSuffix(cert, "=="),
+			"iat-mode": strconv.Itoa(state.IATMode),
+		}, nil
+	default:
+		return nil, nil
+	}
+}
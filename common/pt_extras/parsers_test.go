@@ -0,0 +1,93 @@
+package pt_extras
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// TestMergeOptionsNoArgs tests that the global options are used unchanged
+// when the SOCKS handshake did not carry any arguments.
+func TestMergeOptionsNoArgs(t *testing.T) {
+	options := `{"cert": "abc", "iat-mode": "0"}`
+	merged, err := MergeOptions(options, nil)
+	if err != nil {
+		t.Error("MergeOptions(NoArgs) failed:", err)
+	}
+	if merged != options {
+		t.Error("MergeOptions(NoArgs) changed the options:", merged)
+	}
+}
+
+// TestMergeOptionsNoGlobal tests that the SOCKS arguments are used on their own
+// when no global options are set.
+func TestMergeOptionsNoGlobal(t *testing.T) {
+	args := map[string]interface{}{"cert": "abc", "iat-mode": "1"}
+	merged, err := MergeOptions("", args)
+	if err != nil {
+		t.Error("MergeOptions(NoGlobal) failed:", err)
+	}
+
+	var result map[string]interface{}
+	if err = json.Unmarshal([]byte(merged), &result); err != nil {
+		t.Error("MergeOptions(NoGlobal) produced invalid JSON:", merged)
+	}
+	if result["cert"] != "abc" || result["iat-mode"] != "1" {
+		t.Error("MergeOptions(NoGlobal) unexpected result:", merged)
+	}
+}
+
+// TestMergeOptionsOverride tests that the SOCKS arguments override global
+// options with the same key and keep the others.
+func TestMergeOptionsOverride(t *testing.T) {
+	args := map[string]interface{}{"iat-mode": "1"}
+	merged, err := MergeOptions(`{"cert": "abc", "iat-mode": "0"}`, args)
+	if err != nil {
+		t.Error("MergeOptions(Override) failed:", err)
+	}
+
+	var result map[string]interface{}
+	if err = json.Unmarshal([]byte(merged), &result); err != nil {
+		t.Error("MergeOptions(Override) produced invalid JSON:", merged)
+	}
+	if result["cert"] != "abc" || result["iat-mode"] != "1" {
+		t.Error("MergeOptions(Override) unexpected result:", merged)
+	}
+}
+
+// TestMergeOptionsInvalid tests that invalid global options are rejected.
+func TestMergeOptionsInvalid(t *testing.T) {
+	args := map[string]interface{}{"cert": "abc"}
+	if _, err := MergeOptions("not json", args); err == nil {
+		t.Error("MergeOptions(Invalid) succeeded")
+	}
+}
+
+// TestListenerArgs tests that the obfs4 server reports the cert and IAT mode
+// that clients need, and that obfs2 needs no arguments.
+func TestListenerArgs(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "obfs4")
+	if err != nil {
+		t.Fatal("could not create the state directory:", err)
+	}
+	defer os.RemoveAll(stateDir)
+
+	if _, err = ArgsToListener("obfs4", stateDir, ""); err != nil {
+		t.Fatal("ArgsToListener(obfs4) failed:", err)
+	}
+	args, err := ListenerArgs("obfs4", stateDir)
+	if err != nil {
+		t.Fatal("ListenerArgs(obfs4) failed:", err)
+	}
+	if cert, ok := args["cert"].(string); !ok || len(cert) != 70 {
+		t.Errorf("ListenerArgs(obfs4) returned an invalid cert: %v", args["cert"])
+	}
+	if args["iat-mode"] != "0" {
+		t.Errorf("ListenerArgs(obfs4) returned iat-mode %v, expected 0", args["iat-mode"])
+	}
+
+	if args, err = ListenerArgs("obfs2", stateDir); args != nil || err != nil {
+		t.Errorf("ListenerArgs(obfs2) returned %v, %v", args, err)
+	}
+}
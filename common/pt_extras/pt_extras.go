@@ -34,6 +34,7 @@ import (
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/OperatorFoundation/shapeshifter-ipc/v2"
 )
@@ -58,6 +59,25 @@ func PtProxyDone() {
 	_, _ = pt.Stdout.Write(line)
 }
 
+// PtVersion chooses the first version in a comma separated list of offered
+// Pluggable Transport versions that the dispatcher speaks, and announces it
+// with a VERSION line, or a VERSION-ERROR line if there is none.
+func PtVersion(offered string) (string, error) {
+	for _, version := range strings.Split(offered, ",") {
+		version = strings.TrimSpace(version)
+		switch version {
+		case "1", "2", "2.0", "2.1":
+			line := []byte(fmt.Sprintf("VERSION %s\n", version))
+			_, _ = pt.Stdout.Write(line)
+			return version, nil
+		}
+	}
+
+	line := []byte("VERSION-ERROR no-version\n")
+	_, _ = pt.Stdout.Write(line)
+	return "", errors.New("no supported version offered")
+}
+
 func PtIsClient() (bool, error) {
 	clientEnv := os.Getenv("TOR_PT_CLIENT_TRANSPORTS")
 	serverEnv := os.Getenv("TOR_PT_SERVER_TRANSPORTS")
@@ -0,0 +1,28 @@
+package pt_extras
+
+import (
+	"bytes"
+	"testing"
+
+	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
+)
+
+// TestPtVersion tests that the first supported version offered is announced,
+// and that a VERSION-ERROR is sent when none is supported.
+func TestPtVersion(t *testing.T) {
+	var output bytes.Buffer
+	stdout := pt.Stdout
+	pt.Stdout = &output
+	defer func() { pt.Stdout = stdout }()
+
+	if version, err := PtVersion("3, 2.1,1"); err != nil || version != "2.1" {
+		t.Errorf("PtVersion chose %q, %v, expected 2.1", version, err)
+	}
+	if _, err := PtVersion("3"); err == nil {
+		t.Error("PtVersion accepted an unsupported version")
+	}
+
+	if output.String() != "VERSION 2.1\nVERSION-ERROR no-version\n" {
+		t.Errorf("unexpected output %q", output.String())
+	}
+}
@@ -29,6 +29,8 @@ package socks5
 
 import (
 	"fmt"
+	"strings"
+
 	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
 )
 
@@ -90,19 +92,87 @@ func (req *Request) authRFC1929() (err error) {
 
 	// Pluggable transports use the username/password field to pass
 	// per-connection arguments.  The fields contain ASCII strings that
-	// are combined and then parsed into key/value pairs.
-	argStr := string(uname)
-	if !(plen == 1 && passwd[0] == 0x00) {
-		// tor will set the password to 'NUL', if the field doesn't contain any
-		// actual argument data.
-		argStr += string(passwd)
-	}
-	if req.Args, err = pt.ParsePT2ClientParameters(argStr); err != nil {
-		sendErrResp()
-		return
+	// are combined and then parsed into key/value pairs.  A username that
+	// does not hold arguments identifies the client instead, for example
+	// for rate limiting.
+	if !hasClientArgs(string(uname)) {
+		req.Username = string(uname)
+	} else {
+		argStr := string(uname)
+		if !(plen == 1 && passwd[0] == 0x00) {
+			// tor will set the password to 'NUL', if the field doesn't contain any
+			// actual argument data.
+			argStr += string(passwd)
+		}
+		if req.Args, err = parseClientArgs(argStr); err != nil {
+			sendErrResp()
+			return
+		}
 	}
 
 	resp := []byte{authRFC1929Ver, authRFC1929Success}
 	_, err = req.rw.Write(resp[:])
 	return
 }
+
+// hasClientArgs reports whether a username holds transport arguments, either
+// as a JSON object or as the semicolon separated key=value pairs that tor
+// sends.
+func hasClientArgs(uname string) bool {
+	return strings.HasPrefix(uname, "{") || strings.ContainsRune(uname, '=')
+}
+
+// parseClientArgs parses transport arguments from a username and password.
+// Values in key=value pairs may escape an equals sign, a semicolon or a
+// backslash with a backslash.
+func parseClientArgs(s string) (map[string]interface{}, error) {
+	if strings.HasPrefix(s, "{") {
+		return pt.ParsePT2ClientParameters(s)
+	}
+
+	args := make(map[string]interface{})
+	for len(s) > 0 {
+		key, rest, err := readUnescaped(s, "=;")
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) == 0 || rest[0] != '=' {
+			return nil, fmt.Errorf("no equals sign in %q", key)
+		}
+		if len(key) == 0 {
+			return nil, fmt.Errorf("empty key in %q", s)
+		}
+
+		value, rest, err := readUnescaped(rest[1:], ";")
+		if err != nil {
+			return nil, err
+		}
+		args[key] = value
+
+		s = strings.TrimPrefix(rest, ";")
+	}
+
+	return args, nil
+}
+
+// readUnescaped reads s up to the first byte in stop that is not escaped
+// with a backslash, and returns what it read, unescaped, and the rest of s.
+func readUnescaped(s string, stop string) (string, string, error) {
+	var unescaped []byte
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		if strings.IndexByte(stop, b) != -1 {
+			return string(unescaped), s[i:], nil
+		}
+		if b == '\\' {
+			i++
+			if i >= len(s) {
+				return "", "", fmt.Errorf("nothing following final escape in %q", s)
+			}
+			b = s[i]
+		}
+		unescaped = append(unescaped, b)
+	}
+
+	return string(unescaped), "", nil
+}
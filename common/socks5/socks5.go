@@ -46,6 +46,8 @@ import (
 	"net"
 	"syscall"
 	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
 )
 
 const (
@@ -59,6 +61,7 @@ const (
 	atypIPv6       = 0x04
 
 	authNoneRequired        = 0x00
+	authUsernamePassword    = 0x02
 	AuthJsonParameterBlock  = 0x09
 	authNoAcceptableMethods = 0xff
 
@@ -119,7 +122,11 @@ func ErrorToReplyCode(err error) ReplyCode {
 type Request struct {
 	Target string
 	Args   map[string]interface{}
-	rw     *bufio.ReadWriter
+
+	// Username is the username that the client authenticated with, if any.
+	Username string
+
+	rw *bufio.ReadWriter
 }
 
 // Handshake attempts to handle a incoming client handshake over the provided
@@ -212,14 +219,20 @@ func (req *Request) NegotiateAuth(needOptions bool) (byte, error) {
 
 	// Pick the best authentication method, prioritizing authenticating
 	// over not if both options are present and SOCKS header options are needed.
+	// A username is preferred over no authentication, since it identifies
+	// the client.
 	if needOptions {
 		if bytes.IndexByte(methods, AuthJsonParameterBlock) != -1 {
 			method = AuthJsonParameterBlock
+		} else if bytes.IndexByte(methods, authUsernamePassword) != -1 {
+			method = authUsernamePassword
 		} else if bytes.IndexByte(methods, authNoneRequired) != -1 {
 			method = authNoneRequired
 		}
 	} else {
-		if bytes.IndexByte(methods, authNoneRequired) != -1 {
+		if bytes.IndexByte(methods, authUsernamePassword) != -1 {
+			method = authUsernamePassword
+		} else if bytes.IndexByte(methods, authNoneRequired) != -1 {
 			method = authNoneRequired
 		} else if bytes.IndexByte(methods, AuthJsonParameterBlock) != -1 {
 			method = AuthJsonParameterBlock
@@ -233,7 +246,7 @@ func (req *Request) NegotiateAuth(needOptions bool) (byte, error) {
 	if _, err = req.rw.Write(msg); err != nil {
 		return 0, err
 	}
-	println("this is the authentication method the socks server is sending: ", version, method)
+	log.Debugf("socks5 - selected authentication method %d", method)
 
 	return method, req.flushBuffers()
 }
@@ -242,6 +255,10 @@ func (req *Request) authenticate(method byte) error {
 	switch method {
 	case authNoneRequired:
 		// No authentication required.
+	case authUsernamePassword:
+		if err := req.authRFC1929(); err != nil {
+			return err
+		}
 	case AuthJsonParameterBlock:
 		if err := req.authPT2(); err != nil {
 			return err
@@ -28,8 +28,10 @@
 package socks5
 
 import (
+	"encoding/hex"
 	"io"
 	"net"
+	"reflect"
 	"testing"
 )
 
@@ -243,6 +245,51 @@ func TestPT2Fail(t *testing.T) {
 		t.Error("authenticate(Success) failed:", err)
 	}
 }
+
+// TestAuthUsernamePassword tests that auth negotiation prefers username and
+// password over no authentication.
+func TestAuthUsernamePassword(t *testing.T) {
+	c := new(TestReadWriter)
+	req := c.ToRequest()
+	var err error
+	var method byte
+
+	// VER = 05, NMETHODS = 02, METHODS = [00, 02]
+	_, hexErr := c.WriteHex("05020002")
+	if hexErr != nil {
+		t.Error("NegotiateAuth(UsernamePassword) could not be decoded")
+	}
+	if method, err = req.NegotiateAuth(false); err != nil {
+		t.Error("NegotiateAuth(UsernamePassword) failed:", err)
+	}
+	if method != authUsernamePassword {
+		t.Error("NegotiateAuth(UsernamePassword) unexpected method:", method)
+	}
+	if msg := c.ReadHex(); msg != "0502" {
+		t.Error("NegotiateAuth(UsernamePassword) invalid response:", msg)
+	}
+}
+
+// TestRFC1929Success tests RFC1929 auth with a username and password.
+func TestRFC1929Success(t *testing.T) {
+	c := new(TestReadWriter)
+	req := c.ToRequest()
+
+	// VER = 01, ULEN = 5, UNAME = "alice", PLEN = 1, PASSWD = "x"
+	_, hexErr := c.WriteHex("0105616c6963650178")
+	if hexErr != nil {
+		t.Error("authenticate(RFC1929) could not be decoded")
+	}
+	if err := req.authenticate(authUsernamePassword); err != nil {
+		t.Error("authenticate(RFC1929) failed:", err)
+	}
+	if msg := c.ReadHex(); msg != "0100" {
+		t.Error("authenticate(RFC1929) invalid response:", msg)
+	}
+	if req.Username != "alice" {
+		t.Errorf("authenticate(RFC1929) got username %q", req.Username)
+	}
+}
 // TestRequestInvalidHdr tests SOCKS5 requests with invalid VER/CMD/RSV/ATYPE
 func TestRequestInvalidHdr(t *testing.T) {
 	c := new(TestReadWriter)
@@ -377,3 +424,41 @@ func TestResponseNil(t *testing.T) {
 }
 
 var _ io.ReadWriter = (*TestReadWriter)(nil)
+
+// TestRFC1929Args tests that transport arguments sent as the username and
+// password are parsed, and are not taken for a username.
+func TestRFC1929Args(t *testing.T) {
+	for _, test := range []struct {
+		uname  string
+		passwd string
+		args   map[string]interface{}
+	}{
+		{"cert=AAAA;iat-mode=", "0", map[string]interface{}{"cert": "AAAA", "iat-mode": "0"}},
+		{`cert=a\;b;x=1`, "\x00", map[string]interface{}{"cert": "a;b", "x": "1"}},
+		{`{"cert": "AAAA",`, ` "iat-mode": "0"}`, map[string]interface{}{"cert": "AAAA", "iat-mode": "0"}},
+	} {
+		c := new(TestReadWriter)
+		req := c.ToRequest()
+
+		message := []byte{authRFC1929Ver, byte(len(test.uname))}
+		message = append(message, test.uname...)
+		message = append(message, byte(len(test.passwd)))
+		message = append(message, test.passwd...)
+		if _, err := c.WriteHex(hex.EncodeToString(message)); err != nil {
+			t.Fatal("authenticate(RFC1929) could not be encoded:", err)
+		}
+		if err := req.authenticate(authUsernamePassword); err != nil {
+			t.Errorf("authenticate(RFC1929) of %q failed: %s", test.uname, err)
+			continue
+		}
+		if msg := c.ReadHex(); msg != "0100" {
+			t.Error("authenticate(RFC1929) invalid response:", msg)
+		}
+		if req.Username != "" {
+			t.Errorf("arguments were taken for the username %q", req.Username)
+		}
+		if !reflect.DeepEqual(req.Args, test.args) {
+			t.Errorf("authenticate(RFC1929) of %q got arguments %v", test.uname, req.Args)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+// Package testutil holds the servers that the dispatcher's tests relay
+// connections to.
+package testutil
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/OperatorFoundation/shapeshifter-transports/transports/obfs2/v2"
+)
+
+// NetworkListener is implemented by transport listeners that wrap a plain
+// network listener.  The obfs2 listener does not report its real address.
+type NetworkListener interface {
+	NetworkListener() net.Listener
+}
+
+// StartTCPEcho starts a TCP server on loopback that echoes back all data, and
+// closes it when the test ends.
+func StartTCPEcho(t testing.TB) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("could not start the echo server:", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go Echo(ln)
+
+	return ln
+}
+
+// StartObfs2Echo starts an obfs2 transport server on loopback that echoes
+// back all data, and closes it when the test ends.  It returns the listener
+// and the address that clients should dial.
+func StartObfs2Echo(t testing.TB) (net.Listener, string) {
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("could not find a free port:", err)
+	}
+	addr := probe.Addr().String()
+	_ = probe.Close()
+
+	ln := obfs2.NewObfs2Transport().Listen(addr)
+	if ln == nil {
+		t.Fatal("could not start obfs2 server")
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go Echo(ln)
+
+	return ln, ln.(NetworkListener).NetworkListener().Addr().String()
+}
+
+// Echo accepts connections from ln until it is closed, and echoes back all
+// data sent over each of them.
+func Echo(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, _ = io.Copy(conn, conn)
+			_ = conn.Close()
+		}()
+	}
+}
@@ -34,29 +34,36 @@ import (
 	"flag"
 	"fmt"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/policy"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/transports"
 	"github.com/OperatorFoundation/shapeshifter-ipc/v2"
 	"io"
 	"io/ioutil"
 	golog "log"
+	"net"
 	"net/url"
 	"os"
 	"path"
 	"strings"
+	"time"
 
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/http_connect"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/linux_transparent_tcp"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/linux_transparent_udp"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/pt_socks5"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/reverse"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/stun_udp"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/transparent_tcp"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/transparent_udp"
-
-	_ "github.com/OperatorFoundation/obfs4/proxy_dialers/proxy_http"
-	_ "github.com/OperatorFoundation/obfs4/proxy_dialers/proxy_socks4"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/replay"
 )
 
 const (
 	dispatcherVersion = "0.0.7-dev"
 	dispatcherLogFile = "dispatcher.log"
+	captureDir        = "captures"
 )
 
 var stateDir string
@@ -70,10 +77,31 @@ const (
 	transparentTCP
 	transparentUDP
 	stunUDP
+	httpConnect
+	linuxTransparentTCP
+	linuxTransparentUDP
+	reverseTunnel
 )
 
+// modeNames are the names of the modes, as given to -mode.
+var modeNames = map[int]string{
+	socks5:              "socks5",
+	transparentTCP:      "transparent-TCP",
+	transparentUDP:      "transparent-UDP",
+	stunUDP:             "STUN",
+	httpConnect:         "http-connect",
+	linuxTransparentTCP: "linux-transparent-TCP",
+	linuxTransparentUDP: "linux-transparent-UDP",
+	reverseTunnel:       "reverse",
+}
+
 func main() {
 
+	// The replay subcommand has flags of its own.
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(replay.Main(os.Args[2:]))
+	}
+
 	// Handle the command line arguments.
 	_, execName := path.Split(os.Args[0])
 
@@ -81,6 +109,7 @@ func main() {
 		_, _ = fmt.Fprintf(os.Stderr, "shapeshifter-dispatcher is a PT v2.0 proxy supporting multiple transports and proxy modes\n\n")
 		_, _ = fmt.Fprintf(os.Stderr, "Usage:\n\t%s -client -state [statedir] -ptversion 2 -transports [transport1,transport2,...]\n\n", os.Args[0])
 		_, _ = fmt.Fprintf(os.Stderr, "Example:\n\t%s -client -state state -ptversion 2 -transports obfs2\n\n", os.Args[0])
+		_, _ = fmt.Fprintf(os.Stderr, "Replaying traces:\n\t%s replay -transport obfs2 trace.dcap...\n\n", os.Args[0])
 		_, _ = fmt.Fprintf(os.Stderr, "Flags:\n\n")
 		flag.PrintDefaults()
 	}
@@ -104,16 +133,38 @@ func main() {
 	targetPort := flag.String("targetport", "", "Specify transport server destination address host")
 	proxyListenHost := flag.String("proxylistenhost", "", "Specify the bind address for the local SOCKS server host provided by the client")
 	proxyListenPort := flag.String("proxylistenport", "", "Specify the bind address for the local SOCKS server port provided by the client")
-	modeName := flag.String("mode", "", "Specify which mode is being used: transparent-TCP, transparent-UDP, socks5, or STUN")
+	modeName := flag.String("mode", "", "Specify which mode is being used: transparent-TCP, transparent-UDP, socks5, STUN, http-connect, linux-transparent-TCP, linux-transparent-UDP, or reverse")
+	httpForward := flag.Bool("httpForward", false, "Also accept plain HTTP forward requests in http-connect mode")
+	exit := flag.Bool("exit", false, "Enable server exit mode, where the server connects to the destination sent by the client instead of the ORPort")
+	exitPolicy := flag.String("exitPolicy", "", "Specify the allow/deny rules for destinations in server exit mode, for example deny=10.0.0.0/8,allow=*:443")
+	destination := flag.String("destination", "", "Specify the host:port that a server in exit mode should connect to (client only)")
+	retries := flag.Int("retries", modes.DefaultRetryPolicy.Rounds, "Specify how many times each -target is tried before a client connection fails")
+	retryBackoff := flag.Duration("retryBackoff", modes.DefaultRetryPolicy.InitialBackoff, "Specify the delay before retrying after every -target has failed, which doubles for each retry up to -maxRetryBackoff")
+	maxRetryBackoff := flag.Duration("maxRetryBackoff", 0, "Specify the longest delay before retrying (default the larger of 5s and twice -retryBackoff)")
+	blacklistTime := flag.Duration("blacklistTime", modes.DefaultRetryPolicy.BlacklistTime, "Specify how long a -target that failed is skipped while other targets are available, which doubles for each consecutive failure up to -maxBlacklistTime")
+	maxBlacklistTime := flag.Duration("maxBlacklistTime", 0, "Specify the longest time a -target that failed is skipped (default the larger of 5m and twice -blacklistTime)")
+	poolSize := flag.Int("poolSize", 0, "Specify the number of pre-dialed transport connections to keep for each transport server (client only, 0 disables pooling)")
+	poolMaxIdle := flag.Duration("poolMaxIdle", 20*time.Second, "Specify how long a pre-dialed transport connection is kept before it is replaced, which should be shorter than the server's handshake timeout (30s by default)")
+	poolCheckInterval := flag.Duration("poolCheckInterval", 10*time.Second, "Specify how often expired pre-dialed transport connections are replaced")
+	dialTimeout := flag.Duration("dialTimeout", modes.DefaultTimeouts.Dial, "Specify how long to wait for a network connection to be made (0 disables the timeout)")
+	handshakeTimeout := flag.Duration("handshakeTimeout", modes.DefaultTimeouts.Handshake, "Specify how long to wait for the transport handshake, or on the server for the client's first data (0 disables the timeout)")
+	idleTimeout := flag.Duration("idleTimeout", modes.DefaultTimeouts.Idle, "Specify how long a connection may go without traffic before it is closed (0 disables the timeout)")
+	rateLimit := flag.String("rateLimit", "", "Specify the limit in bytes per second for all relayed traffic, with an optional K, M or G suffix")
+	transportRateLimit := flag.String("transportRateLimit", "", "Specify the limit in bytes per second for the traffic of each transport")
+	listenerRateLimit := flag.String("listenerRateLimit", "", "Specify the limit in bytes per second for the traffic of each listener")
+	clientRateLimit := flag.String("clientRateLimit", "", "Specify the limit in bytes per second for the traffic of each client, identified by its address or SOCKS username")
+	maxSessions := flag.Int("maxSessions", 0, "Specify the maximum number of connections handled at the same time (0 is unlimited)")
+	maxSessionsPerIP := flag.Int("maxSessionsPerIP", 0, "Specify the maximum number of connections handled at the same time from each source address (0 is unlimited)")
+	listenerRetries := flag.Int("listenerRetries", modes.DefaultSupervisorPolicy.MaxFailures, "Specify how many times in a row a server listener may fail before it is given up on (0 retries forever)")
+	listenerBackoff := flag.Duration("listenerBackoff", modes.DefaultSupervisorPolicy.InitialBackoff, "Specify the delay before restarting a server listener that failed, which doubles for each retry")
+	exitOnListenerFailure := flag.Bool("exitOnListenerFailure", false, "Exit when a server listener is given up on, instead of serving on the remaining listeners")
+	reverseServices := flag.String("reverse", "", "Specify the services for reverse mode as name=host:port,... (the local service address on the client, the public listen address on the server)")
 
 	// PT 2.1 specification, 3.3.1.2. Pluggable PT Client Configuration Parameters
 	proxy := flag.String("proxy", "", "Specify an HTTP or SOCKS4a proxy that the PT needs to use to reach the Internet")
 
 	// PT 2.1 specification, 3.3.1.3. Pluggable PT Server Environment Variables
 	options := flag.String("options", "", "Specify the transport options for the server")
-	if *options != "" {
-		println("--> -options flag found: ", *options)
-	}
 
 	bindAddr := flag.String("bindaddr", "", "Specify the bind address for transparent server")
 	orport := flag.String("orport", "", "Specify the address the server should forward traffic to in host:port format")
@@ -128,14 +179,25 @@ func main() {
 	showVer := flag.Bool("showVersion", false, "Print version and exit")
 	logLevelStr := flag.String("logLevel", "ERROR", "Log level (ERROR/WARN/INFO/DEBUG)")
 	ipcLogLevelStr := flag.String("ipcLogLevel", "NONE", "IPC Log level (ERROR/WARN/INFO/DEBUG/NONE)")
+	ipcLogFormat := flag.String("ipcLogFormat", log.IPCFormatText, "Format of the IPC log and status messages (text/json)")
+	statusInterval := flag.Duration("statusInterval", time.Minute, "Specify how often a STATUS summary of each transport is sent when -ipcLogLevel is INFO or DEBUG (0 disables the summaries)")
 	enableLogging := flag.Bool("enableLogging", false, "Log to TOR_PT_STATE_LOCATION/"+dispatcherLogFile)
+	logSinks := flag.String("logSinks", "", "Specify additional log destinations, as a comma separated list of kind:LEVEL[:path], where kind is stderr, syslog or json (for example stderr:WARN,json:DEBUG:/var/log/dispatcher.json)")
+	logMaxSize := flag.Int64("logMaxSize", 10, "Specify the size in megabytes at which JSON log files are rotated (0 disables rotation)")
+	logMaxBackups := flag.Int("logMaxBackups", 3, "Specify how many rotated JSON log files are kept")
+	unsafeLogging := flag.Bool("unsafeLogging", false, "Log addresses and network errors without scrubbing them (for debugging only, the logs will contain the addresses of users)")
+	logScrub := flag.String("logScrub", log.ScrubFull, "Specify how addresses are scrubbed in logs: full, hash (with a salt chosen for each run), subnet (keeping the /24 or /48 network) or asn")
+	logScrubASNFile := flag.String("logScrubASNFile", "", "Specify the file of networks and AS numbers used by -logScrub asn, with a CIDR network and AS number on each line")
+	capture := flag.Bool("capture", false, "Record the application and transport traffic of each session to files in TOR_PT_STATE_LOCATION/"+captureDir+" (for debugging only, the files contain the plaintext of every session)")
+	captureMaxSize := flag.Int64("captureMaxSize", 10, "Specify the size in megabytes at which each capture file stops recording (0 is unlimited)")
+	captureMaxTotal := flag.Int64("captureMaxTotal", 1000, "Specify the total size in megabytes of the capture files written by a run (0 is unlimited)")
 
 	// Additional command line flags added to shapeshifter-dispatcher
 	clientMode := flag.Bool("client", false, "Enable client mode")
 	serverMode := flag.Bool("server", false, "Enable server mode")
 	transparent := flag.Bool("transparent", false, "Enable transparent proxy mode. The default is protocol-aware proxy mode (socks5 for TCP, STUN for UDP)")
 	udp := flag.Bool("udp", false, "Enable UDP proxy mode. The default is TCP proxy mode.")
-	target := flag.String("target", "", "Specify transport server destination address")
+	target := flag.String("target", "", "Specify transport server destination address, or a comma separated list of addresses, each with an optional /weight, to fail over between")
 	flag.Parse() // Flag variables are set to actual values here.
 
 	// Start validation of command line arguments
@@ -146,16 +208,30 @@ func main() {
 	}
 
 	if err := log.SetLogLevel(*logLevelStr); err != nil {
-		fmt.Println("failed to set log level")
 		golog.Fatalf("[ERROR]: %s - failed to set log level: %s", execName, err)
 	}
+	var asnTable *log.ASNTable
+	if *logScrubASNFile != "" {
+		var err error
+		if asnTable, err = log.LoadASNTable(*logScrubASNFile); err != nil {
+			golog.Fatalf("[ERROR]: %s - failed to load ASN table: %s", execName, err)
+		}
+	}
+	if err := log.SetScrubMode(*logScrub, asnTable); err != nil {
+		golog.Fatalf("[ERROR]: %s - failed to set scrub mode: %s", execName, err)
+	}
+	log.SetUnsafeLogging(*unsafeLogging)
 
 	ipcLogLevel, ipcLogLevelError := validateIPCLogLevel(*ipcLogLevelStr)
 	if ipcLogLevelError != nil {
-		println(ipcLogLevel)
 		log.Errorf("could not validate IPC log level %s", ipcLogLevelError)
 		return
 	}
+	if err := log.SetIPCFormat(*ipcLogFormat); err != nil {
+		log.Errorf("could not set IPC log format: %s", err)
+		return
+	}
+	log.SetIPCTransports(append(transports.Transports(), "meekserver"))
 
 	// Determine if this is a client or server, initialize the common state.
 	launched := false
@@ -172,12 +248,19 @@ func main() {
 		golog.Fatal("cannot specify -options and -optionsFile at the same time")
 	}
 	if err = log.Init(*enableLogging, path.Join(stateDir, dispatcherLogFile), ipcLogLevel); err != nil {
-		println("stateDir:", stateDir)
-		println("--> Error: ", err.Error())
-		golog.Fatalf("--> [ERROR]: %s - failed to initialize logging", execName)
+		golog.Fatalf("[ERROR]: %s - failed to initialize logging in %s: %s", execName, stateDir, err)
+	}
+	if err = log.AddSinks(*logSinks, *logMaxSize<<20, *logMaxBackups); err != nil {
+		golog.Fatalf("[ERROR]: %s - failed to add log sinks: %s", execName, err)
+	}
+	if *capture {
+		policy := modes.CapturePolicy{Dir: path.Join(stateDir, captureDir), MaxFileSize: *captureMaxSize << 20, MaxTotalSize: *captureMaxTotal << 20}
+		if err = modes.EnableCapture(policy); err != nil {
+			golog.Fatalf("[ERROR]: %s - failed to enable traffic capture: %s", execName, err)
+		}
 	}
 	if *optionsFile != "" {
-		fmt.Println("checking for optionsFile")
+		log.Debugf("reading options from %s", *optionsFile)
 		_, err := os.Stat(*optionsFile)
 		if err != nil {
 			log.Errorf("optionsFile does not exist with error %s %s", *optionsFile, err.Error())
@@ -212,6 +295,7 @@ func main() {
 		log.Errorf("invalid mode name %s", *modeName)
 		return
 	}
+	log.SetMode(modeNames[mode])
 
 	if isClient {
 		proxyListenValidationError := validateProxyListenAddr(proxyListenHost, proxyListenPort, socksAddr)
@@ -232,7 +316,23 @@ func main() {
 			*socksAddr = "127.0.0.1:0"
 		}
 
-		if mode == socks5 {
+		if mode == httpConnect && *httpForward {
+			// Forward requests are relayed through the bridge given with
+			// -target, since unlike CONNECT requests they do not name it.
+			targetValidationError := validatetarget(targetHost, targetPort, target)
+			if targetValidationError != nil {
+				log.Errorf("could not validate: %s",targetValidationError)
+				return
+			}
+			if *targetHost != "" && *targetPort != "" && *target == "" {
+				newTarget := *targetHost+":"+*targetPort
+				target = &newTarget
+			}
+			if _, targetsErr := modes.ParseTargets(*target); targetsErr != nil {
+				log.Errorf("could not validate: %s", targetsErr)
+				return
+			}
+		} else if mode == socks5 || mode == httpConnect {
 			targetValidationError := validatetargetSocks5(targetHost, targetPort, target)
 			if targetValidationError != nil {
 				log.Errorf("could not validate: %s",targetValidationError)
@@ -247,7 +347,11 @@ func main() {
 			}
 			if *targetHost != "" && *targetPort != "" && *target == "" {
 				newTarget := *targetHost+":"+*targetPort
-				bindAddr = &newTarget
+				target = &newTarget
+			}
+			if _, targetsErr := modes.ParseTargets(*target); targetsErr != nil {
+				log.Errorf("could not validate: %s", targetsErr)
+				return
 			}
 		}
 
@@ -281,11 +385,26 @@ func main() {
 				log.Errorf("%s - transparent mode requires a bindaddr", execName)
 				return
 			}
+		case httpConnect:
+			if *bindAddr == "" {
+				log.Errorf("%s - http-connect mode requires a bindaddr", execName)
+				return
+			}
 		case transparentUDP:
 			if *bindAddr == "" {
 				log.Errorf("%s - transparent mode requires a bindaddr", execName)
 				return
 			}
+		case linuxTransparentTCP, linuxTransparentUDP:
+			if *bindAddr == "" {
+				log.Errorf("%s - linux transparent mode requires a bindaddr", execName)
+				return
+			}
+		case reverseTunnel:
+			if *bindAddr == "" {
+				log.Errorf("%s - reverse mode requires a bindaddr", execName)
+				return
+			}
 		case stunUDP:
 			if *bindAddr == "" {
 				log.Errorf("%s - STUN mode requires a bindaddr", execName)
@@ -297,12 +416,126 @@ func main() {
 		}
 	}
 
+	if *destination != "" {
+		if !isClient {
+			log.Errorf("-destination option can only be used in client mode")
+			return
+		}
+		if _, _, destinationErr := net.SplitHostPort(*destination); destinationErr != nil {
+			log.Errorf("invalid destination %s: %s", *destination, destinationErr)
+			return
+		}
+	}
+
+	if *retries < 1 {
+		log.Errorf("-retries must be at least 1")
+		return
+	}
+	if *maxRetryBackoff != 0 && *maxRetryBackoff < *retryBackoff {
+		log.Errorf("-maxRetryBackoff cannot be shorter than -retryBackoff")
+		return
+	}
+	if *maxBlacklistTime != 0 && *maxBlacklistTime < *blacklistTime {
+		log.Errorf("-maxBlacklistTime cannot be shorter than -blacklistTime")
+		return
+	}
+
+	if *poolSize < 0 {
+		log.Errorf("-poolSize cannot be negative")
+		return
+	}
+	if *poolSize > 0 && *poolMaxIdle >= modes.DefaultTimeouts.Handshake {
+		log.Warnf("-poolMaxIdle is not shorter than the default server handshake timeout of %s, so servers may close pre-dialed connections before they are used", modes.DefaultTimeouts.Handshake)
+	}
+
+	if *dialTimeout < 0 || *handshakeTimeout < 0 || *idleTimeout < 0 {
+		log.Errorf("timeouts cannot be negative")
+		return
+	}
+
+	if *maxSessions < 0 || *maxSessionsPerIP < 0 {
+		log.Errorf("session limits cannot be negative")
+		return
+	}
+
+	if *listenerRetries < 0 || *listenerBackoff < 0 {
+		log.Errorf("-listenerRetries and -listenerBackoff cannot be negative")
+		return
+	}
+
+	var rateLimits modes.RateLimits
+	for _, rate := range []struct {
+		flag  string
+		value string
+		limit *int64
+	}{
+		{"-rateLimit", *rateLimit, &rateLimits.Global},
+		{"-transportRateLimit", *transportRateLimit, &rateLimits.Transport},
+		{"-listenerRateLimit", *listenerRateLimit, &rateLimits.Listener},
+		{"-clientRateLimit", *clientRateLimit, &rateLimits.Client},
+	} {
+		if rate.value == "" {
+			continue
+		}
+		var rateErr error
+		if *rate.limit, rateErr = modes.ParseRate(rate.value); rateErr != nil {
+			log.Errorf("%s: %s", rate.flag, rateErr)
+			return
+		}
+	}
+
+	var services map[string]string
+	if mode == reverseTunnel {
+		var servicesErr error
+		services, servicesErr = reverse.ParseServices(*reverseServices)
+		if servicesErr != nil {
+			log.Errorf("could not parse -reverse services: %s", servicesErr)
+			return
+		}
+	}
+
+	var exitRules *policy.Policy
+	if *exitPolicy != "" {
+		var policyErr error
+		exitRules, policyErr = policy.Parse(*exitPolicy)
+		if policyErr != nil {
+			log.Errorf("could not parse exit policy: %s", policyErr)
+			return
+		}
+	}
+
+	// Tell the parent process which version of the protocol is spoken on
+	// stdout, before any of the listeners are announced.
+	if _, versionErr := pt_extras.PtVersion(*ptversion); versionErr != nil {
+		log.Errorf("-ptversion: %s", versionErr)
+		return
+	}
+
 	// Finished validation of command line arguments
 
 	log.Noticef("%s - launched", getVersion())
 
+	modes.SetTimeouts(modes.Timeouts{Dial: *dialTimeout, Handshake: *handshakeTimeout, Idle: *idleTimeout})
+	modes.SetRateLimits(rateLimits)
+	modes.SetSessionLimits(modes.SessionLimits{Max: *maxSessions, MaxPerIP: *maxSessionsPerIP})
+	supervisorPolicy := modes.DefaultSupervisorPolicy
+	supervisorPolicy.MaxFailures = *listenerRetries
+	supervisorPolicy.InitialBackoff = *listenerBackoff
+	supervisorPolicy.ExitOnFailure = *exitOnListenerFailure
+	modes.SetSupervisorPolicy(supervisorPolicy)
+	modes.StartStatusReports(*statusInterval)
+
 	if isClient {
 		log.Infof("%s - initializing client transport listeners", execName)
+		modes.SetClientDestination(*destination)
+		modes.SetPoolConfig(modes.PoolConfig{Size: *poolSize, MaxIdle: *poolMaxIdle, CheckInterval: *poolCheckInterval})
+		retryPolicy := modes.DefaultRetryPolicy
+		retryPolicy.Rounds = *retries
+		retryPolicy.InitialBackoff = *retryBackoff
+		retryPolicy.MaxBackoff = *maxRetryBackoff
+		retryPolicy.BlacklistTime = *blacklistTime
+		retryPolicy.MaxBlacklistTime = *maxBlacklistTime
+		modes.SetRetryPolicy(retryPolicy)
 
 		switch mode {
 		case socks5:
@@ -334,11 +567,40 @@ func main() {
 				return
 			}
 			launched = stun_udp.ClientSetup(*socksAddr, *target, ptClientProxy, names, *options)
+		case httpConnect:
+			ptClientProxy, names, nameErr := getClientNames(ptversion, transportsList, proxy)
+			if nameErr != nil {
+				log.Errorf("must specify -version and -transports")
+				return
+			}
+			launched = http_connect.ClientSetup(*socksAddr, *target, ptClientProxy, names, *options, *httpForward)
+		case linuxTransparentTCP:
+			ptClientProxy, names, nameErr := getClientNames(ptversion, transportsList, proxy)
+			if nameErr != nil {
+				log.Errorf("must specify -version and -transports")
+				return
+			}
+			launched = linux_transparent_tcp.ClientSetup(*socksAddr, *target, ptClientProxy, names, *options)
+		case linuxTransparentUDP:
+			ptClientProxy, names, nameErr := getClientNames(ptversion, transportsList, proxy)
+			if nameErr != nil {
+				log.Errorf("must specify -version and -transports")
+				return
+			}
+			launched = linux_transparent_udp.ClientSetup(*socksAddr, *target, ptClientProxy, names, *options)
+		case reverseTunnel:
+			ptClientProxy, names, nameErr := getClientNames(ptversion, transportsList, proxy)
+			if nameErr != nil {
+				log.Errorf("must specify -version and -transports")
+				return
+			}
+			launched = reverse.ClientSetup(*target, ptClientProxy, names, *options, services)
 		default:
 			log.Errorf("unsupported mode %d", mode)
 		}
 	} else {
 		log.Infof("initializing server transport listeners")
+		modes.SetExit(*exit, exitRules)
 
 		switch mode {
 		case socks5:
@@ -357,6 +619,18 @@ func main() {
 		case stunUDP:
 			ptServerInfo := getServerInfo(bindAddr, options, transportsList, orport, extorport, authcookie)
 			launched = stun_udp.ServerSetup(ptServerInfo, stateDir, *options)
+		case httpConnect:
+			ptServerInfo := getServerInfo(bindAddr, options, transportsList, orport, extorport, authcookie)
+			launched = http_connect.ServerSetup(ptServerInfo, stateDir, *options)
+		case linuxTransparentTCP:
+			ptServerInfo := getServerInfo(bindAddr, options, transportsList, orport, extorport, authcookie)
+			launched = linux_transparent_tcp.ServerSetup(ptServerInfo, stateDir, *options)
+		case linuxTransparentUDP:
+			ptServerInfo := getServerInfo(bindAddr, options, transportsList, orport, extorport, authcookie)
+			launched = linux_transparent_udp.ServerSetup(ptServerInfo, stateDir, *options)
+		case reverseTunnel:
+			ptServerInfo := getServerInfo(bindAddr, options, transportsList, orport, extorport, authcookie)
+			launched = reverse.ServerSetup(ptServerInfo, stateDir, *options, services)
 		default:
 			log.Errorf("unsupported mode %d", mode)
 		}
@@ -372,6 +646,7 @@ func main() {
 
 	if *exitOnStdinClose || ptShouldExitOnStdinClose() {
 		_, _ = io.Copy(ioutil.Discard, os.Stdin)
+		modes.ClosePools()
 		os.Exit(-1)
 	} else {
 		select {}
@@ -389,6 +664,14 @@ func determineMode(mode string, isTransparent bool, isUDP bool) (int, error) {
 			return transparentUDP, nil
 		case "STUN":
 			return stunUDP, nil
+		case "http-connect":
+			return httpConnect, nil
+		case "linux-transparent-TCP":
+			return linuxTransparentTCP, nil
+		case "linux-transparent-UDP":
+			return linuxTransparentUDP, nil
+		case "reverse":
+			return reverseTunnel, nil
 		default:
 			return -1, errors.New("invalid mode")
 		}
@@ -0,0 +1,150 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+)
+
+const (
+	// minAcceptBackoff and maxAcceptBackoff bound the delay before accepting
+	// again after a temporary error, such as running out of file
+	// descriptors.
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// SessionLimits bounds the number of connections that are handled at the
+// same time.  A zero value disables the limit.
+type SessionLimits struct {
+	// Max limits the sessions of all listeners together.
+	Max int
+
+	// MaxPerIP limits the sessions from each source address.
+	MaxPerIP int
+}
+
+var sessionLimits SessionLimits
+var sessionCount int
+var sessionsPerIP = make(map[string]int)
+var sessionsLock sync.Mutex
+
+// SetSessionLimits configures the session limits.  It must be called before
+// any listeners are started.
+func SetSessionLimits(limits SessionLimits) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	sessionLimits = limits
+}
+
+// acquireSession counts a new session from addr, and returns a function that
+// ends it, unless the session limits have been reached.
+func acquireSession(addr net.Addr) (func(), bool) {
+	identity := ClientIdentity(addr)
+
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	if sessionLimits.Max > 0 && sessionCount >= sessionLimits.Max {
+		return nil, false
+	}
+	if sessionLimits.MaxPerIP > 0 && sessionsPerIP[identity] >= sessionLimits.MaxPerIP {
+		return nil, false
+	}
+
+	sessionCount++
+	sessionsPerIP[identity]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			sessionsLock.Lock()
+			defer sessionsLock.Unlock()
+
+			sessionCount--
+			if sessionsPerIP[identity]--; sessionsPerIP[identity] == 0 {
+				delete(sessionsPerIP, identity)
+			}
+		})
+	}, true
+}
+
+// AcceptSessions accepts connections on ln and runs handle for each of them
+// in a new goroutine, until the listener fails.  Temporary accept errors are
+// retried after a growing delay.  Connections beyond the session limits are
+// passed to reject instead, which must not block, or reset if reject is nil.
+func AcceptSessions(name string, ln net.Listener, handle func(conn net.Conn), reject func(conn net.Conn)) error {
+	if reject == nil {
+		reject = ResetConn
+	}
+
+	var backoff time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				if backoff == 0 {
+					backoff = minAcceptBackoff
+				} else if backoff *= 2; backoff > maxAcceptBackoff {
+					backoff = maxAcceptBackoff
+				}
+				log.Warnf("%s - failed to accept connection, retrying in %s: %s", name, backoff, err)
+				time.Sleep(backoff)
+				continue
+			}
+
+			return err
+		}
+		backoff = 0
+
+		release, ok := acquireSession(conn.RemoteAddr())
+		if !ok {
+			log.Warnf("%s - rejected connection from %s: too many sessions", name, log.ElideAddr(conn.RemoteAddr().String()))
+			reject(conn)
+			continue
+		}
+
+		go func() {
+			defer release()
+			handle(conn)
+		}()
+	}
+}
+
+// ResetConn closes a TCP connection with a reset instead of a normal close,
+// so that a rejected client does not wait on it.  Other connections are
+// closed normally.
+func ResetConn(conn net.Conn) {
+	if lingerer, ok := conn.(interface{ SetLinger(sec int) error }); ok {
+		_ = lingerer.SetLinger(0)
+	}
+
+	_ = conn.Close()
+}
@@ -0,0 +1,104 @@
+package modes
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// temporaryError is a net.Error that reports itself as temporary.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// failingListener fails to accept with the errors it is given, in order.
+type failingListener struct {
+	net.Listener
+	errs []error
+}
+
+func (ln *failingListener) Accept() (net.Conn, error) {
+	err := ln.errs[0]
+	ln.errs = ln.errs[1:]
+	return nil, err
+}
+
+// TestAcceptBackoff tests that temporary accept errors are retried after a
+// delay, and that other errors end the loop.
+func TestAcceptBackoff(t *testing.T) {
+	permanent := errors.New("closed")
+	ln := &failingListener{errs: []error{temporaryError{}, temporaryError{}, permanent}}
+
+	start := time.Now()
+	err := AcceptSessions("test", ln, func(net.Conn) {}, nil)
+	if err != permanent {
+		t.Errorf("got %v, expected the permanent error", err)
+	}
+	if elapsed := time.Since(start); elapsed < 3*minAcceptBackoff {
+		t.Errorf("retried after %s, expected a backoff", elapsed)
+	}
+}
+
+// TestSessionLimitPerIP tests that connections over the limit for a source
+// address are reset, and accepted again once a session ends.
+func TestSessionLimitPerIP(t *testing.T) {
+	SetSessionLimits(SessionLimits{MaxPerIP: 1})
+	defer SetSessionLimits(SessionLimits{})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen failed:", err)
+	}
+	defer ln.Close()
+
+	sessions := make(chan net.Conn)
+	go func() {
+		_ = AcceptSessions("test", ln, func(conn net.Conn) {
+			sessions <- conn
+			buf := make([]byte, 1)
+			_, _ = conn.Read(buf)
+			_ = conn.Close()
+		}, nil)
+	}()
+
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("dial failed:", err)
+	}
+	defer first.Close()
+	<-sessions
+
+	second, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("dial failed:", err)
+	}
+	defer second.Close()
+	_ = second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = second.Read(make([]byte, 1)); err == nil {
+		t.Error("a connection over the limit was not closed")
+	}
+
+	// End the first session, then the limit allows a new one.
+	_ = first.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		third, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal("dial failed:", err)
+		}
+		select {
+		case conn := <-sessions:
+			_ = conn.Close()
+			_ = third.Close()
+			return
+		case <-time.After(50 * time.Millisecond):
+			_ = third.Close()
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no session was accepted after the first one ended")
+		}
+	}
+}
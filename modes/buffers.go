@@ -0,0 +1,95 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+const relayBufferSize = 32 * 1024
+
+// PacketBufferSize is the size of the buffers returned by GetPacketBuffer,
+// which hold the largest UDP packet along with a small header.
+const PacketBufferSize = 65535 + 32
+
+var relayBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, relayBufferSize)
+		return &buf
+	},
+}
+
+var packetBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, PacketBufferSize)
+		return &buf
+	},
+}
+
+// GetPacketBuffer returns a buffer of PacketBufferSize bytes from a shared
+// pool.  It should be returned with PutPacketBuffer when it is no longer
+// used.
+func GetPacketBuffer() []byte {
+	return *packetBuffers.Get().(*[]byte)
+}
+
+// PutPacketBuffer returns a buffer from GetPacketBuffer to the pool.
+func PutPacketBuffer(buf []byte) {
+	if cap(buf) < PacketBufferSize {
+		return
+	}
+
+	buf = buf[:PacketBufferSize]
+	packetBuffers.Put(&buf)
+}
+
+// copyBuffered copies from src to dst until EOF or an error.  Two raw TCP
+// connections are spliced, so that the data never enters user space, and
+// everything else goes through a pooled buffer instead of a new one for each
+// copy.  Transport connections obfuscate their data in user space, and
+// connections relayed with an idle timeout are wrapped to record their
+// activity, so those are always copied through a buffer.
+func copyBuffered(dst net.Conn, src net.Conn) (int64, error) {
+	if n, handled, err := spliceCopy(dst, src); handled {
+		return n, err
+	}
+
+	buf := relayBuffers.Get().(*[]byte)
+	defer relayBuffers.Put(buf)
+
+	// Hide ReadFrom and WriteTo, which would make io.CopyBuffer ignore the
+	// buffer and allocate its own.
+	return io.CopyBuffer(writerOnly{dst}, readerOnly{src}, *buf)
+}
+
+type writerOnly struct {
+	io.Writer
+}
+
+type readerOnly struct {
+	io.Reader
+}
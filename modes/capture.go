@@ -0,0 +1,520 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"golang.org/x/net/proxy"
+)
+
+// Capture files record the data sent and received over one side of a
+// session.  A file starts with the six bytes "dcap1\n", followed by a record
+// for each chunk of data:
+//
+//	uint8  direction (CaptureSent or CaptureReceived)
+//	int64  time of the chunk, in nanoseconds since the Unix epoch
+//	uint32 length of the data
+//	[]byte data
+//
+// All integers are big endian.
+const captureMagic = "dcap1\n"
+
+// captureRecordHeaderSize is the size of a record without its data.
+const captureRecordHeaderSize = 1 + 8 + 4
+
+const (
+	// CaptureSent marks data written to the peer of the connection.
+	CaptureSent = 0
+
+	// CaptureReceived marks data read from the peer of the connection.
+	CaptureReceived = 1
+)
+
+const (
+	// CaptureApplication is the side of a session that carries the plain
+	// application data.
+	CaptureApplication = "application"
+
+	// CaptureTransport is the side of a session that carries the data
+	// obfuscated by the transport.
+	CaptureTransport = "transport"
+)
+
+// CapturePolicy configures the recording of session traffic.
+type CapturePolicy struct {
+	// Dir is the directory that capture files are written to.
+	Dir string
+
+	// MaxFileSize bounds the size of each capture file.  Data beyond it is
+	// not recorded.  Zero is unlimited.
+	MaxFileSize int64
+
+	// MaxTotalSize bounds the size of all capture files written by this
+	// run.  Zero is unlimited.
+	MaxTotalSize int64
+}
+
+var capturePolicy CapturePolicy
+var captureEnabled bool
+var captureTotal int64
+
+// EnableCapture starts recording the traffic of new sessions to files in
+// policy.Dir, named after the session and side, as in
+// "5f3a09c2e1b4-transport.dcap".  It must be called before any listeners
+// are opened.
+func EnableCapture(policy CapturePolicy) error {
+	if err := os.MkdirAll(policy.Dir, 0700); err != nil {
+		return err
+	}
+
+	capturePolicy = policy
+	captureEnabled = true
+	log.Warnf("capturing session traffic to %s, the capture files contain the plaintext of every session", policy.Dir)
+	return nil
+}
+
+// CaptureConn returns a connection that records the data sent and received
+// over conn in the capture file for a side of the session.  If capturing is
+// disabled or the file cannot be created, conn is returned unchanged.
+func CaptureConn(conn net.Conn, session string, side string) net.Conn {
+	if !captureEnabled || conn == nil {
+		return conn
+	}
+
+	name := path.Join(capturePolicy.Dir, session+"-"+side+".dcap")
+	file, err := newCaptureFile(name)
+	if err != nil {
+		log.Warnf("failed to create capture file %s: %s", name, err)
+		return conn
+	}
+
+	return &captureConn{Conn: conn, file: file}
+}
+
+// CaptureDialer returns a dialer that records the data of the connections
+// it makes in the transport side capture files of the session.  If
+// capturing is disabled, dialer is returned unchanged.  It is also returned
+// unchanged when the options enable multiplexing or pooling is enabled,
+// since those transport connections are shared between sessions and dialed
+// with the dialer of whichever session came first.
+func CaptureDialer(dialer proxy.Dialer, session string, options string) proxy.Dialer {
+	if !captureEnabled || sharedTransportConns(options) {
+		return dialer
+	}
+
+	return &captureDialer{dialer, session}
+}
+
+// sharedTransportConns reports whether the transport connections made with
+// the options may carry more than one session.
+func sharedTransportConns(options string) bool {
+	if poolConfig.Size > 0 {
+		return true
+	}
+	_, muxEnabled, _ := ParseMuxOptions(options)
+
+	return muxEnabled
+}
+
+type captureDialer struct {
+	proxy.Dialer
+	session string
+}
+
+func (dialer *captureDialer) Dial(network string, addr string) (net.Conn, error) {
+	conn, err := dialer.Dialer.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return CaptureConn(conn, dialer.session, CaptureTransport), nil
+}
+
+// Transport servers decode connections inside their own listener, which the
+// dispatcher cannot wrap.  To record the transport side of server sessions,
+// a capture front end listens on the bind address instead, records each
+// connection and relays it to the transport listener on loopback.  The
+// front end starts the session, and passes its ID and the client's address
+// on to the connection accepted by the transport listener.
+
+// captureRouteTimeout bounds how long the transport listener waits for the
+// front end to report which client a relayed connection came from.
+const captureRouteTimeout = time.Second
+
+type captureRoute struct {
+	client  net.Addr
+	session string
+}
+
+// captureRoutes are keyed by the loopback address of each relayed
+// connection, and captureSessions by the address of its client.
+var captureRoutes = make(map[string]chan captureRoute)
+var captureSessions = make(map[string]string)
+var captureRoutesLock sync.Mutex
+
+func captureRouteFor(key string) chan captureRoute {
+	captureRoutesLock.Lock()
+	defer captureRoutesLock.Unlock()
+
+	route, ok := captureRoutes[key]
+	if !ok {
+		route = make(chan captureRoute, 1)
+		captureRoutes[key] = route
+	}
+
+	return route
+}
+
+// takeCaptureSession returns the session that the capture front end started
+// for a connection from addr, if any.
+func takeCaptureSession(addr net.Addr) (string, bool) {
+	if !captureEnabled || addr == nil {
+		return "", false
+	}
+
+	captureRoutesLock.Lock()
+	defer captureRoutesLock.Unlock()
+
+	session, ok := captureSessions[addr.String()]
+	delete(captureSessions, addr.String())
+	return session, ok
+}
+
+// CaptureListen wraps the listen function of a transport server so that the
+// transport side of its sessions is recorded, through a capture front end.
+// If capturing is disabled, listen is returned unchanged.
+func CaptureListen(listen func(address string) net.Listener) func(address string) net.Listener {
+	if !captureEnabled {
+		return listen
+	}
+
+	return func(address string) net.Listener {
+		front, err := net.Listen("tcp", address)
+		if err != nil {
+			log.Warnf("failed to open capture listener on %s: %s", log.ElideAddr(address), log.ElideError(err))
+			return nil
+		}
+
+		probe, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			_ = front.Close()
+			return nil
+		}
+		backAddr := probe.Addr().String()
+		_ = probe.Close()
+
+		back := listen(backAddr)
+		if back == nil {
+			_ = front.Close()
+			return nil
+		}
+
+		ln := &captureListener{Listener: back, front: front}
+		go ln.relay(backAddr)
+		return ln
+	}
+}
+
+// captureListener is a transport listener behind a capture front end.
+type captureListener struct {
+	net.Listener
+	front net.Listener
+}
+
+// NetworkListener returns the front end, which is the listener that clients
+// connect to.
+func (ln *captureListener) NetworkListener() net.Listener {
+	return ln.front
+}
+
+func (ln *captureListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	key := conn.RemoteAddr().String()
+	select {
+	case route := <-captureRouteFor(key):
+		captureRoutesLock.Lock()
+		delete(captureRoutes, key)
+		captureSessions[route.client.String()] = route.session
+		captureRoutesLock.Unlock()
+
+		return &frontedConn{Conn: conn, client: route.client}, nil
+	case <-time.After(captureRouteTimeout):
+		log.Warnf("capture front end did not report the client of a connection")
+		return conn, nil
+	}
+}
+
+func (ln *captureListener) Close() error {
+	_ = ln.front.Close()
+	return ln.Listener.Close()
+}
+
+// relay accepts the connections of clients, and relays each of them to the
+// transport listener at backAddr while recording it.
+func (ln *captureListener) relay(backAddr string) {
+	for {
+		conn, err := ln.front.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			session := NewSessionID()
+			back, err := net.Dial("tcp", backAddr)
+			if err != nil {
+				log.Warnf("failed to relay captured connection: %s", log.ElideError(err))
+				_ = conn.Close()
+				return
+			}
+
+			key := back.LocalAddr().String()
+			captureRouteFor(key) <- captureRoute{client: conn.RemoteAddr(), session: session}
+			Relay(CaptureConn(conn, session, CaptureTransport), back)
+
+			captureRoutesLock.Lock()
+			delete(captureRoutes, key)
+			delete(captureSessions, conn.RemoteAddr().String())
+			captureRoutesLock.Unlock()
+		}()
+	}
+}
+
+// frontedConn is a connection relayed by the capture front end, which
+// reports the address of the client rather than that of the front end.
+type frontedConn struct {
+	net.Conn
+	client net.Addr
+}
+
+func (conn *frontedConn) RemoteAddr() net.Addr {
+	return conn.client
+}
+
+// captureFile writes the records of one capture file, until it reaches the
+// size limits.
+type captureFile struct {
+	lock   sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	size   int64
+	full   bool
+}
+
+// newCaptureFile opens a capture file for appending.  A session may open the
+// same file more than once, as when a dial is retried, so the header is only
+// written to a new file.
+func newCaptureFile(name string) (*captureFile, error) {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	capture := &captureFile{file: file, writer: bufio.NewWriter(file), size: info.Size()}
+	if capture.size == 0 {
+		if _, err = capture.writer.WriteString(captureMagic); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+		capture.size = int64(len(captureMagic))
+		atomic.AddInt64(&captureTotal, capture.size)
+	}
+
+	return capture, nil
+}
+
+func (capture *captureFile) record(direction byte, data []byte) {
+	capture.lock.Lock()
+	defer capture.lock.Unlock()
+
+	if capture.full || capture.writer == nil {
+		return
+	}
+
+	recordSize := int64(captureRecordHeaderSize + len(data))
+	if capturePolicy.MaxFileSize > 0 && capture.size+recordSize > capturePolicy.MaxFileSize {
+		capture.full = true
+		return
+	}
+	if capturePolicy.MaxTotalSize > 0 && atomic.LoadInt64(&captureTotal)+recordSize > capturePolicy.MaxTotalSize {
+		capture.full = true
+		return
+	}
+	atomic.AddInt64(&captureTotal, recordSize)
+
+	var header [captureRecordHeaderSize]byte
+	header[0] = direction
+	binary.BigEndian.PutUint64(header[1:], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(header[9:], uint32(len(data)))
+	_, _ = capture.writer.Write(header[:])
+	_, _ = capture.writer.Write(data)
+	// Each record is flushed, so that the file is complete up to the last
+	// record if the dispatcher exits.
+	_ = capture.writer.Flush()
+	capture.size += recordSize
+}
+
+func (capture *captureFile) close() {
+	capture.lock.Lock()
+	defer capture.lock.Unlock()
+
+	if capture.writer == nil {
+		return
+	}
+	_ = capture.writer.Flush()
+	_ = capture.file.Close()
+	capture.writer = nil
+}
+
+// captureConn records the data sent and received over a connection.
+type captureConn struct {
+	net.Conn
+	file *captureFile
+}
+
+func (conn *captureConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	if n > 0 {
+		conn.file.record(CaptureReceived, b[:n])
+	}
+
+	return n, err
+}
+
+func (conn *captureConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	if n > 0 {
+		conn.file.record(CaptureSent, b[:n])
+	}
+
+	return n, err
+}
+
+func (conn *captureConn) CloseWrite() error {
+	return CloseWrite(conn.Conn)
+}
+
+// IdleTimeout returns the idle timeout of the wrapped connection, so that
+// CopyLoop still applies it.
+func (conn *captureConn) IdleTimeout() time.Duration {
+	return idleTimeoutOf(conn.Conn)
+}
+
+func (conn *captureConn) Close() error {
+	conn.file.close()
+	return conn.Conn.Close()
+}
+
+// CaptureRecord is a chunk of data read from a capture file.
+type CaptureRecord struct {
+	Direction byte
+	Time      time.Time
+	Data      []byte
+}
+
+// WriteCapture writes records in the capture file format, so that traces for
+// replay can be made by other tools.
+func WriteCapture(w io.Writer, records []CaptureRecord) error {
+	writer := bufio.NewWriter(w)
+	if _, err := writer.WriteString(captureMagic); err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		var header [captureRecordHeaderSize]byte
+		header[0] = record.Direction
+		binary.BigEndian.PutUint64(header[1:], uint64(record.Time.UnixNano()))
+		binary.BigEndian.PutUint32(header[9:], uint32(len(record.Data)))
+		if _, err := writer.Write(header[:]); err != nil {
+			return err
+		}
+		if _, err := writer.Write(record.Data); err != nil {
+			return err
+		}
+	}
+
+	return writer.Flush()
+}
+
+// ErrNotCapture is returned by ReadCapture for files that do not start with
+// the capture file header.
+var ErrNotCapture = errors.New("not a capture file")
+
+// ReadCapture reads the records of a capture file.  A record that was cut
+// short, as when the dispatcher exited while writing it, is ignored.
+func ReadCapture(r io.Reader) ([]CaptureRecord, error) {
+	reader := bufio.NewReader(r)
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != captureMagic {
+		return nil, ErrNotCapture
+	}
+
+	var records []CaptureRecord
+	for {
+		var header [captureRecordHeaderSize]byte
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return records, nil
+			}
+			return records, err
+		}
+		if header[0] != CaptureSent && header[0] != CaptureReceived {
+			return records, errors.New("invalid capture record direction")
+		}
+
+		data := make([]byte, binary.BigEndian.Uint32(header[9:]))
+		if _, err := io.ReadFull(reader, data); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return records, nil
+			}
+			return records, err
+		}
+
+		records = append(records, CaptureRecord{
+			Direction: header[0],
+			Time:      time.Unix(0, int64(binary.BigEndian.Uint64(header[1:]))),
+			Data:      data,
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package modes
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+// enableTestCapture enables capturing to a temporary directory, and returns
+// the directory and a function that disables capturing again.
+func enableTestCapture(t *testing.T, policy CapturePolicy) (string, func()) {
+	dir, err := ioutil.TempDir("", "capturetest")
+	if err != nil {
+		t.Fatal("could not create a directory:", err)
+	}
+	policy.Dir = dir
+	if err = EnableCapture(policy); err != nil {
+		t.Fatal("EnableCapture failed:", err)
+	}
+
+	return dir, func() {
+		captureEnabled = false
+		capturePolicy = CapturePolicy{}
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// readTestCapture reads the capture file of a side of a session.
+func readTestCapture(t *testing.T, dir string, session string, side string) []CaptureRecord {
+	f, err := os.Open(path.Join(dir, session+"-"+side+".dcap"))
+	if err != nil {
+		t.Fatal("could not open the capture file:", err)
+	}
+	defer f.Close()
+
+	records, err := ReadCapture(f)
+	if err != nil {
+		t.Fatal("ReadCapture failed:", err)
+	}
+
+	return records
+}
+
+// TestCaptureConn tests that the data sent and received over a connection
+// is recorded in order, with its direction.
+func TestCaptureConn(t *testing.T) {
+	dir, disable := enableTestCapture(t, CapturePolicy{})
+	defer disable()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := CaptureConn(server, "abc", CaptureApplication)
+
+	go func() {
+		_, _ = client.Write([]byte("request"))
+		buf := make([]byte, 8)
+		_, _ = io.ReadFull(client, buf)
+	}()
+	buf := make([]byte, 7)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal("read failed:", err)
+	}
+	if _, err := conn.Write([]byte("response")); err != nil {
+		t.Fatal("write failed:", err)
+	}
+	_ = conn.Close()
+
+	records := readTestCapture(t, dir, "abc", CaptureApplication)
+	if len(records) != 2 {
+		t.Fatalf("got %d records, expected 2", len(records))
+	}
+	if records[0].Direction != CaptureReceived || string(records[0].Data) != "request" {
+		t.Errorf("unexpected first record %+v", records[0])
+	}
+	if records[1].Direction != CaptureSent || string(records[1].Data) != "response" {
+		t.Errorf("unexpected second record %+v", records[1])
+	}
+	if records[1].Time.Before(records[0].Time) {
+		t.Error("the records are not in time order")
+	}
+}
+
+// TestCaptureMaxFileSize tests that a capture file stops recording when it
+// reaches its size limit.
+func TestCaptureMaxFileSize(t *testing.T) {
+	limit := int64(len(captureMagic) + 2*(captureRecordHeaderSize+4))
+	dir, disable := enableTestCapture(t, CapturePolicy{MaxFileSize: limit})
+	defer disable()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() { _, _ = io.Copy(ioutil.Discard, client) }()
+
+	conn := CaptureConn(server, "abc", CaptureTransport)
+	for _, chunk := range []string{"one!", "two!", "three", "four"} {
+		if _, err := conn.Write([]byte(chunk)); err != nil {
+			t.Fatal("write failed:", err)
+		}
+	}
+	_ = conn.Close()
+
+	records := readTestCapture(t, dir, "abc", CaptureTransport)
+	if len(records) != 2 || string(records[1].Data) != "two!" {
+		t.Errorf("got %d records, expected the first two", len(records))
+	}
+}
+
+// TestCaptureDisabled tests that connections are not wrapped unless
+// capturing is enabled.
+func TestCaptureDisabled(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	if conn := CaptureConn(server, "abc", CaptureApplication); conn != server {
+		t.Error("the connection was wrapped with capturing disabled")
+	}
+}
+
+// TestCaptureReopen tests that a file opened again for the same session
+// gets no second header.
+func TestCaptureReopen(t *testing.T) {
+	dir, disable := enableTestCapture(t, CapturePolicy{})
+	defer disable()
+
+	for _, chunk := range []string{"first", "second"} {
+		client, server := net.Pipe()
+		go func() { _, _ = io.Copy(ioutil.Discard, client) }()
+
+		conn := CaptureConn(server, "abc", CaptureTransport)
+		if _, err := conn.Write([]byte(chunk)); err != nil {
+			t.Fatal("write failed:", err)
+		}
+		_ = conn.Close()
+		_ = client.Close()
+	}
+
+	records := readTestCapture(t, dir, "abc", CaptureTransport)
+	if len(records) != 2 || string(records[0].Data) != "first" || string(records[1].Data) != "second" {
+		t.Errorf("got %+v, expected both chunks", records)
+	}
+}
+
+// TestCaptureSharedTransport tests that transport connections that may be
+// shared between sessions are not recorded.
+func TestCaptureSharedTransport(t *testing.T) {
+	_, disable := enableTestCapture(t, CapturePolicy{})
+	defer disable()
+
+	dialer := proxy.Direct
+	if CaptureDialer(dialer, "abc", "") == dialer {
+		t.Error("the dialer was not wrapped")
+	}
+	if CaptureDialer(dialer, "abc", `{"mux": true}`) != dialer {
+		t.Error("the dialer was wrapped with multiplexing enabled")
+	}
+}
+
+// TestCaptureListen tests that the capture front end records the transport
+// side of a server session, and passes on its session and client address.
+func TestCaptureListen(t *testing.T) {
+	dir, disable := enableTestCapture(t, CapturePolicy{})
+	defer disable()
+
+	listen := CaptureListen(func(address string) net.Listener {
+		ln, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil
+		}
+		return ln
+	})
+	ln := listen("127.0.0.1:0")
+	if ln == nil {
+		t.Fatal("could not listen")
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.(*captureListener).NetworkListener().Addr().String())
+	if err != nil {
+		t.Fatal("dial failed:", err)
+	}
+	defer client.Close()
+	if _, err = client.Write([]byte("hello")); err != nil {
+		t.Fatal("write failed:", err)
+	}
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal("accept failed:", err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != client.LocalAddr().String() {
+		t.Errorf("got remote address %s, expected %s", conn.RemoteAddr(), client.LocalAddr())
+	}
+	session, ok := takeCaptureSession(conn.RemoteAddr())
+	if !ok {
+		t.Fatal("the front end did not start a session")
+	}
+
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		t.Fatal("read failed:", err)
+	}
+	records := readTestCapture(t, dir, session, CaptureTransport)
+	if len(records) != 1 || records[0].Direction != CaptureReceived || string(records[0].Data) != "hello" {
+		t.Errorf("got %+v, expected the client's data", records)
+	}
+}
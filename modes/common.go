@@ -33,6 +33,10 @@ import (
 	"golang.org/x/net/proxy"
 	"net"
 	"net/url"
+	"sync"
+
+	_ "github.com/OperatorFoundation/obfs4/proxy_dialers/proxy_http"
+	_ "github.com/OperatorFoundation/obfs4/proxy_dialers/proxy_socks4"
 )
 
 type ConnState struct {
@@ -40,7 +44,14 @@ type ConnState struct {
 	Waiting bool
 }
 
-type ConnTracker map[string]ConnState
+// ConnTracker tracks the transport connections of a UDP listener by the
+// address of the application that sends the packets.  It is safe for
+// concurrent use, since the connections are opened and closed by other
+// goroutines than the one reading the packets.
+type ConnTracker struct {
+	lock  sync.Mutex
+	conns map[string]ConnState
+}
 
 type ClientHandlerTCP func(target string, name string, options string, conn net.Conn, proxyURI *url.URL)
 
@@ -51,67 +62,212 @@ func NewConnState() ConnState {
 	return ConnState{nil, true}
 }
 
-func OpenConnection(tracker *ConnTracker, addr string, target string, name string, options string, proxyURI *url.URL) {
-	newConn := NewConnState()
-	(*tracker)[addr] = newConn
+func NewConnTracker() *ConnTracker {
+	return &ConnTracker{conns: make(map[string]ConnState)}
+}
+
+// Get returns the state of the connection for packets from addr, if there is
+// one.
+func (tracker *ConnTracker) Get(addr string) (ConnState, bool) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
 
-	go dialConn(tracker, addr, target, name, options, proxyURI)
+	state, ok := tracker.conns[addr]
+	return state, ok
 }
 
-func dialConn(tracker *ConnTracker, addr string, target string, name string, options string, proxyURI *url.URL) {
-	// Obtain the proxy dialer if any, and create the outgoing TCP connection.
-	var dialer proxy.Dialer
-	dialer = proxy.Direct
-	if proxyURI != nil {
-		var err error
-		dialer, err = proxy.FromURL(proxyURI, proxy.Direct)
-		if err != nil {
-			// This should basically never happen, since config protocol
-			// verifies this.
-			fmt.Println("failed to obtain dialer", proxyURI, proxy.Direct)
-			log.Errorf("(%s) - failed to obtain proxy dialer: %s", target)
-			return
-		}
+func (tracker *ConnTracker) set(addr string, state ConnState) {
+	tracker.lock.Lock()
+	tracker.conns[addr] = state
+	tracker.lock.Unlock()
+}
+
+// Remove forgets the connection for packets from addr, if it is still conn,
+// so that the next packet opens a new one.  A nil conn removes a connection
+// attempt that is in progress.
+func (tracker *ConnTracker) Remove(addr string, conn net.Conn) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
 
+	if state, ok := tracker.conns[addr]; ok && state.Conn == conn {
+		delete(tracker.conns, addr)
 	}
+}
 
-	fmt.Println("Dialing....")
+// OpenConnection starts connecting to the transport server for packets from
+// addr, received on listener.  The connection drops packets that exceed the
+// rate limits.  Once the connection is open, replies is run with it to relay
+// the packets that the server sends back.  When replies returns, the
+// connection is closed and removed from the tracker.
+func OpenConnection(tracker *ConnTracker, addr string, listener string, target string, name string, options string, proxyURI *url.URL, replies func(remote net.Conn)) {
+	tracker.set(addr, NewConnState())
 
-	// Deal with arguments.
-	transport, argsToDialerErr := pt_extras.ArgsToDialer(target, name, options, dialer)
-	if argsToDialerErr != nil {
-		log.Errorf("Error creating a transport with the provided options: %s", options)
-		log.Errorf("Error: %s", argsToDialerErr)
-		return
+	go dialConn(tracker, addr, listener, target, name, options, proxyURI, replies)
+}
+
+// ProxyDialer returns the dialer that transports should use to reach the
+// transport server.  If an upstream proxy (-proxy or TOR_PT_PROXY) is
+// configured, connections are made through it, otherwise they are made
+// directly.  The dial timeout is taken from the client transport options.
+func ProxyDialer(proxyURI *url.URL, options string) (proxy.Dialer, error) {
+	timeouts, err := ClientTimeouts(options)
+	if err != nil {
+		return nil, err
+	}
+	direct := &net.Dialer{Timeout: timeouts.Dial}
+
+	if proxyURI == nil {
+		return direct, nil
 	}
-	fmt.Println("Dialing ", target)
-	remote, dialError := transport.Dial()
+
+	return proxy.FromURL(proxyURI, direct)
+}
+
+func dialConn(tracker *ConnTracker, addr string, listener string, target string, name string, options string, proxyURI *url.URL, replies func(remote net.Conn)) {
+	// Create the outgoing connection, failing over between the targets.
+	session := NewSessionID()
+	remote, target, dialError := DialTarget(name, session, target, options, proxyURI)
+	logger := SessionLogger(name, session, target)
 	if dialError != nil {
-		fmt.Println("outgoing connection failed", dialError)
-		log.Errorf("(%s) - outgoing connection failed: %s", target)
-		fmt.Println("Failed")
-		delete(*tracker, addr)
+		logger.Errorf("outgoing connection failed: %s", log.ElideError(dialError))
+		tracker.Remove(addr, nil)
 		return
 	}
+	logger.Infof("new connection")
+	if err := WriteClientDestination(remote); err != nil {
+		logger.Errorf("failed to send destination: %s", log.ElideError(err))
+		_ = remote.Close()
+		tracker.Remove(addr, nil)
+		return
+	}
+
+	// The options were checked when the listener was set up.
+	limits, _ := ClientRateLimits(options)
+	identity, _, _ := net.SplitHostPort(addr)
+	limiter := NewRateLimiter(name, listener, identity, limits)
+	defer limiter.Close()
+
+	conn := RateLimitPacketConn(remote, limiter)
+	tracker.set(addr, ConnState{conn, false})
 
-	fmt.Println("Success")
+	replies(conn)
 
-	(*tracker)[addr] = ConnState{remote, false}
+	_ = conn.Close()
+	tracker.Remove(addr, conn)
+	logger.Infof("closed connection")
 }
 
-func ServerAcceptLoop(name string, ln net.Listener, info *pt.ServerInfo, serverHandler ServerHandler) {
-	for {
-		conn, err := ln.Accept()
-		fmt.Println("accepted")
-		if err != nil {
-			if e, ok := err.(net.Error); ok && !e.Temporary() {
-				log.Errorf("ServerAcceptLoop failed")
-				_ = ln.Close()
-				return
-			}
+// WrapServerHandler applies the multiplexing, rate limit and timeout options
+// of the named server transport to a handler for connections accepted on
+// listener, and counts the connections for STATUS reports.  Stream is true
+// for TCP modes and false for UDP modes.
+func WrapServerHandler(name string, listener string, options string, stream bool, serverHandler ServerHandler) (ServerHandler, error) {
+	_, muxEnabled, err := ParseServerMuxOptions(name, options)
+	if err != nil {
+		return nil, err
+	}
+	timeouts, err := ServerTimeouts(name, options)
+	if err != nil {
+		return nil, err
+	}
+	limits, err := ServerRateLimits(name, options)
+	if err != nil {
+		return nil, err
+	}
+
+	// The status handler is innermost, so that the connection passed to
+	// serverHandler carries its session ID.
+	handler := statusServerHandler(serverHandler)
+	handler = timeoutServerHandler(name, timeouts, stream, handler)
+	handler = rateLimitServerHandler(listener, limits, handler)
+	if muxEnabled {
+		// Run the handler for each multiplexed stream.
+		handler = muxServerHandler(handler)
+	}
+
+	return handler, nil
+}
+
+// serverSetup opens a listener for each of the server transports and
+// announces it to the parent process with an SMETHOD line, or an
+// SMETHOD-ERROR line if it could not be opened.  The listeners are then
+// supervised, so that they are opened again if they fail.
+func serverSetup(ptServerInfo pt.ServerInfo, stateDir string, options string, stream bool, serverHandler ServerHandler) (launched bool) {
+	// Launch each of the server listeners.
+	for _, bindaddr := range ptServerInfo.Bindaddrs {
+		name := bindaddr.MethodName
+		address := bindaddr.Addr.String()
+
+		// Deal with arguments.
+		listen, parseError := pt_extras.ArgsToListener(name, stateDir, options)
+		if parseError != nil {
+			log.Errorf("%s - %s", name, parseError)
+			_ = pt.SmethodError(name, parseError.Error())
 			continue
 		}
+		listen = CaptureListen(listen)
 
-		go serverHandler(name, conn, info)
+		handler, handlerErr := WrapServerHandler(name, address, options, stream, serverHandler)
+		if handlerErr != nil {
+			log.Errorf("%s - %s", name, handlerErr)
+			_ = pt.SmethodError(name, handlerErr.Error())
+			continue
+		}
+
+		// The first listener is opened here, so that its address can be
+		// announced before SMETHODS DONE.
+		ln := listen(address)
+		if ln == nil {
+			log.Errorf("%s - failed to listen on %s", name, log.ElideAddr(address))
+			_ = pt.SmethodError(name, fmt.Sprintf("failed to listen on %s", address))
+			continue
+		}
+
+		args, argsErr := pt_extras.ListenerArgs(name, stateDir)
+		if argsErr != nil {
+			log.Warnf("%s - could not read the client arguments: %s", name, argsErr)
+		}
+		if len(args) > 0 {
+			pt.SmethodArgs(name, listenerAddr(ln, bindaddr.Addr), args)
+		} else {
+			pt.Smethod(name, listenerAddr(ln, bindaddr.Addr))
+		}
+
+		go SuperviseListener(name, address, func(address string) net.Listener {
+			if ln != nil {
+				first := ln
+				ln = nil
+				return first
+			}
+
+			return listen(address)
+		}, func(ln net.Listener) {
+			ServerAcceptLoop(name, ln, &ptServerInfo, handler)
+		})
+
+		launched = true
+	}
+	pt.SmethodsDone()
+
+	return
+}
+
+// listenerAddr returns the address that a transport listener is bound to.
+// Transport listeners report the address of a network interface rather than
+// their own, so the address of the underlying network listener is used when
+// it is available, and the configured address otherwise.
+func listenerAddr(ln net.Listener, bindaddr net.Addr) net.Addr {
+	if networkListener, ok := ln.(interface{ NetworkListener() net.Listener }); ok {
+		return networkListener.NetworkListener().Addr()
 	}
+
+	return bindaddr
+}
+
+func ServerAcceptLoop(name string, ln net.Listener, info *pt.ServerInfo, serverHandler ServerHandler) {
+	err := AcceptSessions(name, ln, func(conn net.Conn) {
+		serverHandler(name, conn, info)
+	}, nil)
+	log.Errorf("ServerAcceptLoop failed: %s", err)
+	_ = ln.Close()
 }
@@ -0,0 +1,127 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// The destination header is sent by the client over a new transport
+// connection, before any application data, when the server should connect
+// to an address chosen by the client instead of its ORPort.  The encoding is
+// the same as the address part of a SOCKS5 request.
+//
+//	uint8_t atyp
+//	uint8_t dst_addr[]
+//	uint16_t dst_port
+const (
+	destinationIPv4       = 0x01
+	destinationDomainName = 0x03
+	destinationIPv6       = 0x04
+)
+
+// WriteDestination sends the destination header for the given host:port
+// address.
+func WriteDestination(w io.Writer, destination string) error {
+	host, portStr, err := net.SplitHostPort(destination)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid destination port %q", portStr)
+	}
+
+	var header []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) == 0 || len(host) > 255 {
+			return fmt.Errorf("invalid destination host %q", host)
+		}
+		header = append([]byte{destinationDomainName, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		header = append([]byte{destinationIPv4}, ip4...)
+	} else {
+		header = append([]byte{destinationIPv6}, ip.To16()...)
+	}
+
+	var rawPort [2]byte
+	binary.BigEndian.PutUint16(rawPort[:], uint16(port))
+	header = append(header, rawPort[:]...)
+
+	_, err = w.Write(header)
+	return err
+}
+
+// ReadDestination receives a destination header and returns the host:port
+// address it contains.
+func ReadDestination(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case destinationIPv4:
+		addr := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(r, addr); err != nil {
+			return "", err
+		}
+		host = net.IP(addr).String()
+	case destinationDomainName:
+		var alen [1]byte
+		if _, err := io.ReadFull(r, alen[:]); err != nil {
+			return "", err
+		}
+		if alen[0] == 0 {
+			return "", errors.New("destination domain name with 0 length")
+		}
+		addr := make([]byte, alen[0])
+		if _, err := io.ReadFull(r, addr); err != nil {
+			return "", err
+		}
+		host = string(addr)
+	case destinationIPv6:
+		addr := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(r, addr); err != nil {
+			return "", err
+		}
+		host = net.IP(addr).String()
+	default:
+		return "", fmt.Errorf("unsupported destination address type 0x%02x", atyp[0])
+	}
+
+	var rawPort [2]byte
+	if _, err := io.ReadFull(r, rawPort[:]); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(rawPort[:])))), nil
+}
@@ -0,0 +1,50 @@
+package modes
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestDestinationRoundTrip tests that every address type survives
+// WriteDestination followed by ReadDestination.
+func TestDestinationRoundTrip(t *testing.T) {
+	for _, destination := range []string{"192.0.2.1:80", "[2001:db8::1]:443", "example.com:53"} {
+		var buf bytes.Buffer
+		if err := WriteDestination(&buf, destination); err != nil {
+			t.Error("WriteDestination failed:", err)
+			continue
+		}
+		// Application data that follows the header must not be consumed.
+		buf.WriteString("data")
+
+		result, err := ReadDestination(&buf)
+		if err != nil {
+			t.Error("ReadDestination failed:", err)
+			continue
+		}
+		if result != destination {
+			t.Errorf("ReadDestination returned %s, expected %s", result, destination)
+		}
+		if buf.String() != "data" {
+			t.Errorf("ReadDestination consumed application data, %q left", buf.String())
+		}
+	}
+}
+
+// TestDestinationInvalid tests that malformed destinations are rejected.
+func TestDestinationInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteDestination(&buf, "example.com"); err == nil {
+		t.Error("WriteDestination accepted an address without a port")
+	}
+	if err := WriteDestination(&buf, "example.com:65536"); err == nil {
+		t.Error("WriteDestination accepted an out of range port")
+	}
+
+	if _, err := ReadDestination(bytes.NewReader([]byte{0x05, 1, 2, 3, 4, 0, 80})); err == nil {
+		t.Error("ReadDestination accepted an unknown address type")
+	}
+	if _, err := ReadDestination(bytes.NewReader([]byte{0x01, 1, 2})); err == nil {
+		t.Error("ReadDestination accepted a truncated header")
+	}
+}
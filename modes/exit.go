@@ -0,0 +1,167 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/policy"
+	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
+)
+
+// destinationTimeout bounds how long a server waits for the destination
+// header on a new connection.
+const destinationTimeout = 30 * time.Second
+
+var exitEnabled bool
+var exitPolicy = policy.Default()
+var clientDestination string
+
+// SetExit configures server exit mode.  When exit mode is enabled, server
+// handlers connect to the destination sent by the client in a destination
+// header instead of the ORPort.  Destinations are checked against rules, or
+// policy.DefaultRules if rules is nil.
+func SetExit(enabled bool, rules *policy.Policy) {
+	exitEnabled = enabled
+	if rules != nil {
+		exitPolicy = rules
+	}
+}
+
+// RequireExit reports whether exit mode is enabled, for server modes that
+// always connect to destinations chosen by clients and so would otherwise be
+// open proxies.  If it is not, each of the server transports is reported as
+// failed to the parent process.
+func RequireExit(ptServerInfo pt.ServerInfo, mode string) bool {
+	if exitEnabled {
+		return true
+	}
+
+	message := fmt.Sprintf("%s servers connect to destinations chosen by clients, and need -exit", mode)
+	log.Errorf("%s", message)
+	for _, bindaddr := range ptServerInfo.Bindaddrs {
+		_ = pt.SmethodError(bindaddr.MethodName, message)
+	}
+	pt.SmethodsDone()
+
+	return false
+}
+
+// SetClientDestination configures the destination that clients send to a
+// server in exit mode.  An empty destination disables the destination
+// header.
+func SetClientDestination(destination string) {
+	clientDestination = destination
+}
+
+// WriteClientDestination sends the destination header configured with
+// SetClientDestination over a new transport connection, if any.
+func WriteClientDestination(remote net.Conn) error {
+	if clientDestination == "" {
+		return nil
+	}
+
+	return WriteDestination(remote, clientDestination)
+}
+
+// ReadClientDestination receives the destination header from a new transport
+// connection.
+func ReadClientDestination(remote net.Conn) (string, error) {
+	_ = remote.SetReadDeadline(time.Now().Add(destinationTimeout))
+	destination, err := ReadDestination(remote)
+	if err != nil {
+		return "", err
+	}
+	_ = remote.SetReadDeadline(time.Time{})
+
+	return destination, nil
+}
+
+// DialServer connects a server handler to its backend, using the given
+// network ("tcp" or "udp").  This is the ORPort unless exit mode is enabled,
+// in which case it is the destination sent by the client.
+func DialServer(network string, name string, remote net.Conn, info *pt.ServerInfo) (net.Conn, error) {
+	if exitEnabled {
+		destination, err := ReadClientDestination(remote)
+		if err != nil {
+			return nil, err
+		}
+
+		return DialDestination(network, name, destination)
+	}
+
+	timeout := registeredServerTimeouts(name).Dial
+	if network == "tcp" {
+		return dialWithTimeout(name+" ORPort dial", timeout, func() (net.Conn, error) {
+			return pt.DialOr(info, remote.RemoteAddr().String(), name)
+		})
+	}
+
+	return net.DialTimeout(network, info.OrAddr.String(), timeout)
+}
+
+// DialDestination connects to a destination chosen by a client of the named
+// transport, if the exit policy allows it.  Domain names are resolved here so
+// that the policy is applied to the addresses that are actually used.
+func DialDestination(network string, name string, destination string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(destination)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination port %q", portStr)
+	}
+
+	var domain string
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		domain = host
+		if ips, err = net.LookupIP(host); err != nil {
+			return nil, err
+		}
+	}
+
+	err = fmt.Errorf("destination %s is not allowed by the exit policy", destination)
+	for _, ip := range ips {
+		if !exitPolicy.Allowed(domain, ip, port) {
+			continue
+		}
+
+		var conn net.Conn
+		address := net.JoinHostPort(ip.String(), portStr)
+		if conn, err = net.DialTimeout(network, address, registeredServerTimeouts(name).Dial); err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, err
+}
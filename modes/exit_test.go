@@ -0,0 +1,46 @@
+package modes
+
+import (
+	"net"
+	"testing"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/policy"
+)
+
+// TestDialServerExit tests that in exit mode the server connects to the
+// destination sent by the client, if the policy allows it.
+func TestDialServerExit(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen failed:", err)
+	}
+	defer ln.Close()
+
+	rules, err := policy.Parse("allow=127.0.0.1:" + portOf(ln.Addr()))
+	if err != nil {
+		t.Fatal("policy.Parse failed:", err)
+	}
+	SetExit(true, rules)
+	defer SetExit(false, policy.Default())
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() { _ = WriteDestination(client, ln.Addr().String()) }()
+
+	conn, err := DialServer("tcp", "test", server, nil)
+	if err != nil {
+		t.Fatal("DialServer failed:", err)
+	}
+	conn.Close()
+
+	// Other ports on the same address are denied.
+	if conn, err = DialDestination("tcp", "test", "127.0.0.1:9"); err == nil {
+		conn.Close()
+		t.Error("DialDestination connected to a denied destination")
+	}
+}
+
+func portOf(addr net.Addr) string {
+	_, port, _ := net.SplitHostPort(addr.String())
+	return port
+}
@@ -0,0 +1,342 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+)
+
+// Target is one of the transport servers that a client can connect to.
+type Target struct {
+	Address string
+
+	// Weight is the relative chance of trying the target first.  If no
+	// target in a list has a weight, the targets are tried in order.
+	Weight int
+}
+
+// ParseTargets parses a comma separated list of transport server addresses,
+// each optionally followed by /weight, for example
+// "192.0.2.1:443/3,198.51.100.1:443/1".
+func ParseTargets(spec string) ([]Target, error) {
+	var targets []Target
+	for _, text := range strings.Split(spec, ",") {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		target := Target{Address: text}
+		if slash := strings.LastIndexByte(text, '/'); slash != -1 {
+			weight, err := strconv.Atoi(text[slash+1:])
+			if err != nil || weight < 1 {
+				return nil, fmt.Errorf("invalid target weight in %q", text)
+			}
+			target = Target{Address: text[:slash], Weight: weight}
+		}
+
+		if _, _, err := net.SplitHostPort(target.Address); err != nil {
+			return nil, fmt.Errorf("invalid target %q: %s", text, err)
+		}
+		targets = append(targets, target)
+	}
+
+	if len(targets) == 0 {
+		return nil, errors.New("no targets specified")
+	}
+
+	return targets, nil
+}
+
+// RetryPolicy controls how clients retry and fail over between targets.
+type RetryPolicy struct {
+	// Rounds is the number of times each target is tried for a single
+	// connection.
+	Rounds int
+
+	// InitialBackoff is the delay before the second round, which doubles
+	// for each following round up to MaxBackoff.  If MaxBackoff is 0, it
+	// is the larger of DefaultRetryPolicy.MaxBackoff and twice
+	// InitialBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// BlacklistTime is how long a target that failed is skipped, while
+	// other targets are available.  It doubles for each consecutive failure
+	// up to MaxBlacklistTime.  If MaxBlacklistTime is 0, it is the larger
+	// of DefaultRetryPolicy.MaxBlacklistTime and twice BlacklistTime.
+	BlacklistTime    time.Duration
+	MaxBlacklistTime time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy used unless SetRetryPolicy is
+// called.
+var DefaultRetryPolicy = RetryPolicy{
+	Rounds:           2,
+	InitialBackoff:   500 * time.Millisecond,
+	MaxBackoff:       5 * time.Second,
+	BlacklistTime:    10 * time.Second,
+	MaxBlacklistTime: 5 * time.Minute,
+}
+
+var retryPolicy = DefaultRetryPolicy
+var targetSets = make(map[string]*TargetSet)
+var targetSetsLock sync.Mutex
+
+// SetRetryPolicy configures the retry policy used by DialTarget.  It must be
+// called before any client connections are made.
+func SetRetryPolicy(policy RetryPolicy) {
+	retryPolicy = policy
+}
+
+// DialTarget creates the named transport and connects to one of the targets
+// in the comma separated list, failing over to the next target when a dial
+// fails.  It returns the connection and the target that it was made to.  The
+// session is reported with the connection's STATUS events.
+func DialTarget(name string, session string, targets string, options string, proxyURI *url.URL) (net.Conn, string, error) {
+	dialer, err := ProxyDialer(proxyURI, options)
+	if err != nil {
+		return nil, "", err
+	}
+	dialer = CaptureDialer(dialer, session, options)
+
+	targetSetsLock.Lock()
+	set, ok := targetSets[name+"\x00"+targets]
+	if !ok {
+		parsed, parseErr := ParseTargets(targets)
+		if parseErr != nil {
+			targetSetsLock.Unlock()
+			return nil, "", parseErr
+		}
+		set = NewTargetSet(name, parsed, retryPolicy)
+		targetSets[name+"\x00"+targets] = set
+	}
+	targetSetsLock.Unlock()
+
+	return set.Dial(func(target string) (net.Conn, error) {
+		transport, err := pt_extras.ArgsToDialer(target, name, options, dialer)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := DialTransport(name, session, target, options, transport.Dial)
+		if err == nil && conn == nil {
+			err = errors.New("transport server connection is nil")
+		}
+		return conn, err
+	})
+}
+
+type targetState struct {
+	Target
+	failures         int
+	blacklistedUntil time.Time
+}
+
+// TargetSet tracks which of a transport's targets are failing.
+type TargetSet struct {
+	name     string
+	policy   RetryPolicy
+	lock     sync.Mutex
+	targets  []*targetState
+	weighted bool
+}
+
+// NewTargetSet creates a target set for the named transport.
+func NewTargetSet(name string, targets []Target, policy RetryPolicy) *TargetSet {
+	set := &TargetSet{name: name, policy: policy.withCaps()}
+	for _, target := range targets {
+		set.targets = append(set.targets, &targetState{Target: target})
+		if target.Weight > 0 {
+			set.weighted = true
+		}
+	}
+
+	return set
+}
+
+// withCaps returns the policy with the caps that are 0 set to their defaults,
+// which are never shorter than twice the values they cap, so that a longer
+// backoff or blacklist time given without a cap is not cut short.
+func (policy RetryPolicy) withCaps() RetryPolicy {
+	if policy.MaxBackoff == 0 {
+		policy.MaxBackoff = maxDuration(DefaultRetryPolicy.MaxBackoff, 2*policy.InitialBackoff)
+	}
+	if policy.MaxBlacklistTime == 0 {
+		policy.MaxBlacklistTime = maxDuration(DefaultRetryPolicy.MaxBlacklistTime, 2*policy.BlacklistTime)
+	}
+
+	return policy
+}
+
+func maxDuration(a time.Duration, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+// Dial calls dial with each target in turn until it succeeds, following the
+// retry policy.
+func (set *TargetSet) Dial(dial func(target string) (net.Conn, error)) (net.Conn, string, error) {
+	backoff := set.policy.InitialBackoff
+	var lastErr error
+	for round := 0; round < set.policy.Rounds || round == 0; round++ {
+		if round > 0 {
+			log.Infof("%s - failover: all targets failed, retrying in %s", set.name, backoff)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > set.policy.MaxBackoff {
+				backoff = set.policy.MaxBackoff
+			}
+		}
+
+		for i, target := range set.candidates(round > 0) {
+			if i > 0 {
+				log.Infof("%s - failover: trying %s", set.name, log.ElideAddr(target.Address))
+			}
+
+			conn, err := dial(target.Address)
+			if err == nil {
+				set.succeeded(target)
+				return conn, target.Address, nil
+			}
+			lastErr = err
+			set.failed(target, err)
+		}
+	}
+
+	return nil, "", lastErr
+}
+
+// candidates returns the targets to try, in order.  Targets that are not
+// blacklisted come first, in the configured order or in a random order
+// following their weights, followed by blacklisted targets if all is true.
+// If every target is blacklisted, the one whose blacklisting ends first is
+// tried anyway.
+func (set *TargetSet) candidates(all bool) []*targetState {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+
+	now := time.Now()
+	var available []*targetState
+	var blacklisted []*targetState
+	for _, target := range set.targets {
+		if now.Before(target.blacklistedUntil) {
+			blacklisted = append(blacklisted, target)
+		} else {
+			available = append(available, target)
+		}
+	}
+
+	if set.weighted {
+		available = weightedOrder(available)
+	}
+	sort.Slice(blacklisted, func(i, j int) bool {
+		return blacklisted[i].blacklistedUntil.Before(blacklisted[j].blacklistedUntil)
+	})
+
+	if all {
+		return append(available, blacklisted...)
+	}
+	if len(available) == 0 {
+		return blacklisted[:1]
+	}
+
+	return available
+}
+
+// weightedOrder returns the targets in a random order, where targets with a
+// higher weight are more likely to come first.
+func weightedOrder(targets []*targetState) []*targetState {
+	remaining := append([]*targetState(nil), targets...)
+	ordered := make([]*targetState, 0, len(targets))
+	for len(remaining) > 0 {
+		total := 0
+		for _, target := range remaining {
+			total += weightOf(target)
+		}
+
+		pick := rand.Intn(total)
+		for i, target := range remaining {
+			if pick -= weightOf(target); pick < 0 {
+				ordered = append(ordered, target)
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return ordered
+}
+
+func weightOf(target *targetState) int {
+	if target.Weight < 1 {
+		return 1
+	}
+
+	return target.Weight
+}
+
+func (set *TargetSet) succeeded(target *targetState) {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+
+	if target.failures > 0 {
+		log.Infof("%s - failover: %s recovered after %d failures", set.name, log.ElideAddr(target.Address), target.failures)
+	}
+	target.failures = 0
+	target.blacklistedUntil = time.Time{}
+}
+
+func (set *TargetSet) failed(target *targetState, err error) {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+
+	blacklistTime := set.policy.BlacklistTime
+	for i := 0; i < target.failures && blacklistTime < set.policy.MaxBlacklistTime; i++ {
+		blacklistTime *= 2
+	}
+	if blacklistTime > set.policy.MaxBlacklistTime {
+		blacklistTime = set.policy.MaxBlacklistTime
+	}
+
+	target.failures++
+	target.blacklistedUntil = time.Now().Add(blacklistTime)
+	log.Warnf("%s - failover: %s failed (%d consecutive failures), skipping it for %s: %s",
+		set.name, log.ElideAddr(target.Address), target.failures, blacklistTime, log.ElideError(err))
+}
@@ -0,0 +1,132 @@
+package modes
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+var testRetryPolicy = RetryPolicy{
+	Rounds:           2,
+	InitialBackoff:   time.Millisecond,
+	MaxBackoff:       time.Millisecond,
+	BlacklistTime:    time.Minute,
+	MaxBlacklistTime: time.Hour,
+}
+
+// fakeDial returns a dial function that fails for the given targets, and
+// records the targets it was called with.
+func fakeDial(failing map[string]bool, attempts *[]string) func(target string) (net.Conn, error) {
+	return func(target string) (net.Conn, error) {
+		*attempts = append(*attempts, target)
+		if failing[target] {
+			return nil, errors.New("connection refused")
+		}
+
+		client, server := net.Pipe()
+		_ = server.Close()
+		return client, nil
+	}
+}
+
+// TestFailover tests that a failing target is skipped in favour of the next
+// one, and is then blacklisted.
+func TestFailover(t *testing.T) {
+	targets, err := ParseTargets("192.0.2.1:443, 192.0.2.2:443")
+	if err != nil {
+		t.Fatal("ParseTargets failed:", err)
+	}
+	set := NewTargetSet("test", targets, testRetryPolicy)
+
+	var attempts []string
+	dial := fakeDial(map[string]bool{"192.0.2.1:443": true}, &attempts)
+	conn, target, err := set.Dial(dial)
+	if err != nil {
+		t.Fatal("Dial failed:", err)
+	}
+	conn.Close()
+	if target != "192.0.2.2:443" || len(attempts) != 2 {
+		t.Errorf("connected to %s after %v", target, attempts)
+	}
+
+	// The failed target is now blacklisted and not tried first.
+	attempts = nil
+	if conn, target, err = set.Dial(dial); err != nil {
+		t.Fatal("Dial failed:", err)
+	}
+	conn.Close()
+	if target != "192.0.2.2:443" || len(attempts) != 1 {
+		t.Errorf("connected to %s after %v", target, attempts)
+	}
+}
+
+// TestFailoverAllFailing tests that every target is retried for each round
+// before giving up.
+func TestFailoverAllFailing(t *testing.T) {
+	targets, _ := ParseTargets("192.0.2.1:443,192.0.2.2:443")
+	set := NewTargetSet("test", targets, testRetryPolicy)
+
+	var attempts []string
+	dial := fakeDial(map[string]bool{"192.0.2.1:443": true, "192.0.2.2:443": true}, &attempts)
+	if _, _, err := set.Dial(dial); err == nil {
+		t.Fatal("Dial succeeded with no working targets")
+	}
+	if len(attempts) != 4 {
+		t.Errorf("made %d attempts, expected 4: %v", len(attempts), attempts)
+	}
+
+	// Once every target is blacklisted, the one that is due first is
+	// still tried.
+	attempts = nil
+	_, _, _ = set.Dial(dial)
+	if len(attempts) == 0 || attempts[0] != "192.0.2.1:443" {
+		t.Errorf("blacklisted targets were tried as %v", attempts)
+	}
+}
+
+// TestWeightedTargets tests that targets with a higher weight are preferred.
+func TestWeightedTargets(t *testing.T) {
+	targets, err := ParseTargets("192.0.2.1:443/9,192.0.2.2:443/1")
+	if err != nil {
+		t.Fatal("ParseTargets failed:", err)
+	}
+	set := NewTargetSet("test", targets, testRetryPolicy)
+
+	first := 0
+	for i := 0; i < 1000; i++ {
+		if set.candidates(false)[0].Address == "192.0.2.1:443" {
+			first++
+		}
+	}
+	if first < 800 || first > 980 {
+		t.Errorf("heavier target was first %d times out of 1000", first)
+	}
+}
+
+// TestParseTargetsInvalid tests that malformed target lists are rejected.
+func TestParseTargetsInvalid(t *testing.T) {
+	for _, spec := range []string{"", "192.0.2.1", "192.0.2.1:443/0", "192.0.2.1:443/x"} {
+		if _, err := ParseTargets(spec); err == nil {
+			t.Errorf("ParseTargets(%q) succeeded", spec)
+		}
+	}
+}
+
+// TestRetryPolicyCaps tests that caps that are not given never cut short the
+// backoff or blacklist time they cap, and that given caps are kept.
+func TestRetryPolicyCaps(t *testing.T) {
+	policy := RetryPolicy{Rounds: 1, InitialBackoff: 10 * time.Second, BlacklistTime: 10 * time.Minute}.withCaps()
+	if policy.MaxBackoff != 20*time.Second || policy.MaxBlacklistTime != 20*time.Minute {
+		t.Errorf("long values were capped at %s and %s", policy.MaxBackoff, policy.MaxBlacklistTime)
+	}
+
+	policy = RetryPolicy{Rounds: 1, InitialBackoff: time.Second, BlacklistTime: time.Second}.withCaps()
+	if policy.MaxBackoff != DefaultRetryPolicy.MaxBackoff || policy.MaxBlacklistTime != DefaultRetryPolicy.MaxBlacklistTime {
+		t.Errorf("short values were capped at %s and %s", policy.MaxBackoff, policy.MaxBlacklistTime)
+	}
+
+	if policy = testRetryPolicy.withCaps(); policy != testRetryPolicy {
+		t.Errorf("given caps were changed to %s and %s", policy.MaxBackoff, policy.MaxBlacklistTime)
+	}
+}
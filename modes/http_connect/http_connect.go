@@ -0,0 +1,286 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+// Package http_connect implements an HTTP proxy client mode.  Applications
+// send HTTP/1.1 CONNECT requests naming the transport server, in the same way
+// that socks5 mode uses the SOCKS target, and the connection is then relayed
+// over the transport.  Plain HTTP forward requests can optionally be accepted
+// as well.  These are relayed over the transport to the configured bridge,
+// which must be a server in exit mode, with the host of the request URL as
+// the destination.
+package http_connect
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
+	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
+)
+
+const requestTimeout = 5 * time.Second
+
+// Version returns a string suitable to be included in a call to Cmethod.
+func Version() string {
+	return "http-connect"
+}
+
+// ErrorToStatusCode converts a dial error to the "best" HTTP status code.
+// Errors wrapped by the transports are unwrapped to the underlying
+// *net.OpError and *os.SyscallError.
+func ErrorToStatusCode(err error) int {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+
+	var errno syscall.Errno
+	var syscallErr *os.SyscallError
+	var opErr *net.OpError
+	if errors.As(err, &syscallErr) {
+		if !errors.As(syscallErr.Err, &errno) {
+			return http.StatusBadGateway
+		}
+	} else if errors.As(err, &opErr) {
+		if !errors.As(opErr.Err, &errno) {
+			return http.StatusBadGateway
+		}
+	} else {
+		return http.StatusBadGateway
+	}
+	switch errno {
+	case syscall.ETIMEDOUT, syscall.ENETUNREACH, syscall.EHOSTUNREACH:
+		return http.StatusGatewayTimeout
+	case syscall.EPERM, syscall.EACCES:
+		return http.StatusForbidden
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// bufferedConn is a net.Conn whose reads are served from the bufio.Reader that
+// was used to parse the HTTP request, so that no pipelined data is lost.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+func (conn *bufferedConn) CloseWrite() error {
+	return modes.CloseWrite(conn.Conn)
+}
+
+// ClientSetup starts the client listeners.  When allowForward is set, plain
+// HTTP forward requests are accepted too, and relayed through the bridge
+// given by target.
+func ClientSetup(listenAddr string, target string, ptClientProxy *url.URL, names []string, options string, allowForward bool) (launched bool) {
+	limits, err := modes.ClientRateLimits(options)
+	if err != nil {
+		log.Errorf("%s", err)
+		return false
+	}
+
+	// Launch each of the client listeners.
+	for _, name := range names {
+		ln, err := net.Listen("tcp", listenAddr)
+		if err != nil {
+			_ = pt.CmethodError(name, err.Error())
+			continue
+		}
+
+		go clientAcceptLoop(name, ln, target, ptClientProxy, options, allowForward, limits)
+		pt.Cmethod(name, Version(), ln.Addr())
+
+		log.Infof("%s - registered listener: %s", name, ln.Addr())
+
+		launched = true
+	}
+	pt.CmethodsDone()
+
+	return
+}
+
+func clientAcceptLoop(name string, ln net.Listener, bridge string, proxyURI *url.URL, options string, allowForward bool, limits modes.RateLimits) {
+	err := modes.AcceptSessions(name, ln, func(conn net.Conn) {
+		clientHandler(name, conn, bridge, proxyURI, options, allowForward, ln.Addr().String(), limits)
+	}, nil)
+	log.Errorf("clientAcceptLoop failed: %s", err)
+	_ = ln.Close()
+}
+
+func clientHandler(name string, conn net.Conn, bridge string, proxyURI *url.URL, options string, allowForward bool, listener string, limits modes.RateLimits) {
+	session := modes.NewSessionID()
+
+	// Read the client's request, with the same handshake timeout as socks5 mode.
+	if err := conn.SetDeadline(time.Now().Add(requestTimeout)); err != nil {
+		conn.Close()
+		return
+	}
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		modes.SessionLogger(name, session, "").Errorf("client failed HTTP request: %s", err)
+		writeStatus(conn, http.StatusBadRequest)
+		conn.Close()
+		return
+	}
+	if err = conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return
+	}
+
+	var remote net.Conn
+	var logger *log.Logger
+	isConnect := req.Method == http.MethodConnect
+	if isConnect {
+		// The CONNECT request names the transport server.
+		target := req.Host
+		logger = modes.SessionLogger(name, session, target)
+		if remote, err = dialConnect(name, session, target, proxyURI, options); err == nil {
+			err = modes.WriteClientDestination(remote)
+		}
+	} else if allowForward && req.URL.IsAbs() && req.URL.Scheme == "http" {
+		// Forward requests go to the bridge, which connects to the host of
+		// the request URL as the client's destination.
+		destination := req.URL.Host
+		if req.URL.Port() == "" {
+			destination = net.JoinHostPort(req.URL.Hostname(), "80")
+		}
+		var target string
+		remote, target, err = modes.DialTarget(name, session, bridge, options, proxyURI)
+		logger = modes.SessionLogger(name, session, target)
+		if err == nil {
+			err = modes.WriteDestination(remote, destination)
+		}
+	} else {
+		modes.SessionLogger(name, session, "").Errorf("unsupported HTTP method: %s", req.Method)
+		writeStatus(conn, http.StatusMethodNotAllowed)
+		conn.Close()
+		return
+	}
+	if err != nil && remote == nil {
+		logger.Errorf("outgoing connection failed: %s", log.ElideError(err))
+		writeStatus(conn, ErrorToStatusCode(err))
+		conn.Close()
+		return
+	}
+	if err != nil {
+		logger.Errorf("failed to send destination: %s", log.ElideError(err))
+		writeStatus(conn, http.StatusBadGateway)
+		remote.Close()
+		conn.Close()
+		return
+	}
+
+	if isConnect {
+		_, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		if err != nil {
+			logger.Errorf("HTTP reply failed: %s", log.ElideError(err))
+			conn.Close()
+			remote.Close()
+			return
+		}
+	} else {
+		// Send the request on in origin-form, without the proxy specific
+		// headers.  Only one request is forwarded per connection.
+		req.Header.Del("Proxy-Connection")
+		req.Header.Del("Proxy-Authorization")
+		req.Close = true
+		if err = req.Write(remote); err != nil {
+			logger.Errorf("forwarding request failed: %s", log.ElideError(err))
+			writeStatus(conn, http.StatusBadGateway)
+			conn.Close()
+			remote.Close()
+			return
+		}
+	}
+
+	limiter := modes.NewRateLimiter(name, listener, modes.ClientIdentity(conn.RemoteAddr()), limits)
+	appConn := modes.CaptureConn(&bufferedConn{conn, reader}, session, modes.CaptureApplication)
+	if err = modes.CopyLoop(modes.RateLimitConn(appConn, limiter), remote); err != nil {
+		logger.Errorf("closed connection: %s", log.ElideError(err))
+	} else {
+		logger.Infof("closed connection")
+	}
+}
+
+// dialConnect connects to the transport server named in a CONNECT request.
+func dialConnect(name string, session string, target string, proxyURI *url.URL, options string) (net.Conn, error) {
+	// Obtain the proxy dialer if any, and create the outgoing TCP connection.
+	dialer, err := modes.ProxyDialer(proxyURI, options)
+	if err != nil {
+		return nil, err
+	}
+	dialer = modes.CaptureDialer(dialer, session, options)
+
+	// Deal with arguments.
+	transport, err := pt_extras.ArgsToDialer(target, name, options, dialer)
+	if err != nil {
+		return nil, err
+	}
+
+	return modes.DialTransport(name, session, target, options, transport.Dial)
+}
+
+func writeStatus(conn net.Conn, code int) {
+	response := fmt.Sprintf("HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", code, http.StatusText(code))
+	_, _ = conn.Write([]byte(response))
+}
+
+func ServerSetup(ptServerInfo pt.ServerInfo, stateDir string, options string) (launched bool) {
+	return modes.ServerSetupTCP(ptServerInfo, stateDir, options, serverHandler)
+}
+
+func serverHandler(name string, remote net.Conn, info *pt.ServerInfo) {
+	session := modes.SessionID(remote)
+	logger := modes.SessionLogger(name, session, remote.RemoteAddr().String())
+	logger.Infof("new connection")
+
+	// Connect to the orport, or the client's destination in exit mode.
+	orConn, err := modes.DialServer("tcp", name, remote, info)
+	if err != nil {
+		logger.Errorf("failed to connect to ORPort: %s", log.ElideError(err))
+		remote.Close()
+		return
+	}
+	orConn = modes.CaptureConn(orConn, session, modes.CaptureApplication)
+
+	if err = modes.CopyLoop(orConn, remote); err != nil {
+		logger.Warnf("closed connection: %s", log.ElideError(err))
+	} else {
+		logger.Infof("closed connection")
+	}
+}
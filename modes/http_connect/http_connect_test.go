@@ -0,0 +1,181 @@
+package http_connect
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/testutil"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
+)
+
+// startClient starts an http-connect client listener for obfs2, which
+// forwards plain HTTP requests to bridge if allowForward is set.
+func startClient(t *testing.T, bridge string, allowForward bool) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("could not start HTTP listener:", err)
+	}
+	go clientAcceptLoop("obfs2", ln, bridge, nil, "", allowForward, modes.RateLimits{})
+
+	return ln
+}
+
+// sendRequest writes a raw request and returns the parsed response.
+func sendRequest(t *testing.T, conn net.Conn, request string) (*http.Response, *bufio.Reader) {
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatal("write failed:", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal("could not read response:", err)
+	}
+
+	return resp, reader
+}
+
+// TestConnect tests that a CONNECT tunnel relays data over the transport.
+func TestConnect(t *testing.T) {
+	serverLn, serverAddr := testutil.StartObfs2Echo(t)
+	defer serverLn.Close()
+	clientLn := startClient(t, "", false)
+	defer clientLn.Close()
+
+	conn, err := net.Dial("tcp", clientLn.Addr().String())
+	if err != nil {
+		t.Fatal("could not connect to HTTP listener:", err)
+	}
+	defer conn.Close()
+
+	resp, reader := sendRequest(t, conn, "CONNECT "+serverAddr+" HTTP/1.1\r\nHost: "+serverAddr+"\r\n\r\n")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("CONNECT failed:", resp.Status)
+	}
+
+	message := []byte("hello through CONNECT")
+	if _, err = conn.Write(message); err != nil {
+		t.Fatal("write failed:", err)
+	}
+	echo := make([]byte, len(message))
+	if _, err = io.ReadFull(reader, echo); err != nil {
+		t.Fatal("read failed:", err)
+	}
+	if !bytes.Equal(message, echo) {
+		t.Error("unexpected echo:", string(echo))
+	}
+}
+
+// TestConnectRefused tests that a failed dial is reported as 502 Bad Gateway.
+func TestConnectRefused(t *testing.T) {
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("could not find a free port:", err)
+	}
+	closedAddr := probe.Addr().String()
+	_ = probe.Close()
+
+	clientLn := startClient(t, "", false)
+	defer clientLn.Close()
+
+	conn, err := net.Dial("tcp", clientLn.Addr().String())
+	if err != nil {
+		t.Fatal("could not connect to HTTP listener:", err)
+	}
+	defer conn.Close()
+
+	resp, _ := sendRequest(t, conn, "CONNECT "+closedAddr+" HTTP/1.1\r\nHost: "+closedAddr+"\r\n\r\n")
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Error("unexpected status:", resp.Status)
+	}
+}
+
+// TestForwardDisabled tests that plain HTTP requests are rejected unless
+// forwarding is enabled.
+func TestForwardDisabled(t *testing.T) {
+	clientLn := startClient(t, "", false)
+	defer clientLn.Close()
+
+	conn, err := net.Dial("tcp", clientLn.Addr().String())
+	if err != nil {
+		t.Fatal("could not connect to HTTP listener:", err)
+	}
+	defer conn.Close()
+
+	resp, _ := sendRequest(t, conn, "GET http://127.0.0.1:1/ HTTP/1.1\r\nHost: 127.0.0.1:1\r\n\r\n")
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Error("unexpected status:", resp.Status)
+	}
+}
+
+// TestForward tests that a plain HTTP request is sent on in origin-form to
+// the bridge, with the host of the request URL as the destination.
+func TestForward(t *testing.T) {
+	serverLn, serverAddr := testutil.StartObfs2Echo(t)
+	defer serverLn.Close()
+	clientLn := startClient(t, serverAddr, true)
+	defer clientLn.Close()
+
+	conn, err := net.Dial("tcp", clientLn.Addr().String())
+	if err != nil {
+		t.Fatal("could not connect to HTTP listener:", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	request := "GET http://origin.example/index.html HTTP/1.1\r\nHost: origin.example\r\nProxy-Connection: keep-alive\r\n\r\n"
+	if _, err = conn.Write([]byte(request)); err != nil {
+		t.Fatal("write failed:", err)
+	}
+
+	// The echo server sends the destination header and the forwarded request
+	// straight back.
+	reader := bufio.NewReader(conn)
+	destination, err := modes.ReadDestination(reader)
+	if err != nil {
+		t.Fatal("could not read destination:", err)
+	}
+	if destination != "origin.example:80" {
+		t.Error("unexpected destination:", destination)
+	}
+	echoed, err := http.ReadRequest(reader)
+	if err != nil {
+		t.Fatal("could not read forwarded request:", err)
+	}
+	if echoed.RequestURI != "/index.html" {
+		t.Error("request was not sent in origin-form:", echoed.RequestURI)
+	}
+	if echoed.Header.Get("Proxy-Connection") != "" {
+		t.Error("proxy header was forwarded")
+	}
+}
+
+// TestErrorToStatusCode tests that wrapped dial errors are unwrapped.
+func TestErrorToStatusCode(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	unreachable := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}
+
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{refused, http.StatusBadGateway},
+		{fmt.Errorf("transport dial: %w", unreachable), http.StatusGatewayTimeout},
+		{os.NewSyscallError("connect", syscall.EACCES), http.StatusForbidden},
+		{io.EOF, http.StatusBadGateway},
+	}
+	for _, test := range tests {
+		if code := ErrorToStatusCode(test.err); code != test.code {
+			t.Errorf("ErrorToStatusCode(%v) = %d, want %d", test.err, code, test.code)
+		}
+	}
+}
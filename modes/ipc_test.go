@@ -0,0 +1,118 @@
+package modes
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+
+	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
+)
+
+// ipcLine is a line of the Pluggable Transport protocol on stdout.
+type ipcLine struct {
+	keyword string
+	args    []string
+}
+
+// captureIPC collects the lines written to stdout by run.
+func captureIPC(t *testing.T, run func()) []ipcLine {
+	var output bytes.Buffer
+	stdout := pt.Stdout
+	pt.Stdout = &output
+	defer func() { pt.Stdout = stdout }()
+
+	run()
+
+	var lines []ipcLine
+	scanner := bufio.NewScanner(&output)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			t.Errorf("empty IPC line")
+			continue
+		}
+		lines = append(lines, ipcLine{keyword: fields[0], args: fields[1:]})
+	}
+
+	return lines
+}
+
+// TestServerIPC tests that a server announces each listener with its bound
+// address, reports the listeners that failed, and ends with SMETHODS DONE.
+func TestServerIPC(t *testing.T) {
+	bindaddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	info := pt.ServerInfo{Bindaddrs: []pt.Bindaddr{
+		{MethodName: "obfs2", Addr: bindaddr},
+		{MethodName: "unknown", Addr: bindaddr},
+	}}
+
+	var launched bool
+	lines := captureIPC(t, func() {
+		launched = ServerSetupTCP(info, "", "", func(name string, remote net.Conn, info *pt.ServerInfo) {
+			_ = remote.Close()
+		})
+	})
+	if !launched {
+		t.Error("ServerSetupTCP failed")
+	}
+
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, expected 3: %v", len(lines), lines)
+	}
+	if lines[0].keyword != "SMETHOD" || len(lines[0].args) != 2 || lines[0].args[0] != "obfs2" {
+		t.Fatalf("got %v, expected an SMETHOD line for obfs2", lines[0])
+	}
+	if lines[1].keyword != "SMETHOD-ERROR" || lines[1].args[0] != "unknown" {
+		t.Errorf("got %v, expected an SMETHOD-ERROR line for the unknown transport", lines[1])
+	}
+	if lines[2].keyword != "SMETHODS" || len(lines[2].args) != 1 || lines[2].args[0] != "DONE" {
+		t.Errorf("got %v, expected SMETHODS DONE", lines[2])
+	}
+
+	// The announced address is the one that was bound, not port 0.
+	conn, err := net.Dial("tcp", lines[0].args[1])
+	if err != nil {
+		t.Fatalf("could not connect to the announced address %s: %s", lines[0].args[1], err)
+	}
+	_ = conn.Close()
+}
+
+// TestClientIPC tests that a client announces its listener with the
+// protocol spoken on it, reports a listener that could not be opened, and
+// ends with CMETHODS DONE.
+func TestClientIPC(t *testing.T) {
+	handler := func(target string, name string, options string, conn net.Conn, proxyURI *url.URL) {
+		_ = conn.Close()
+	}
+
+	lines := captureIPC(t, func() {
+		if !ClientSetupTCP("127.0.0.1:0", "127.0.0.1:1", nil, []string{"obfs2"}, "", "transparent-TCP", handler) {
+			t.Error("ClientSetupTCP failed")
+		}
+	})
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, expected 2: %v", len(lines), lines)
+	}
+	if lines[0].keyword != "CMETHOD" || len(lines[0].args) != 3 || lines[0].args[0] != "obfs2" || lines[0].args[1] != "transparent-TCP" {
+		t.Fatalf("got %v, expected a CMETHOD line for obfs2", lines[0])
+	}
+	if strings.HasSuffix(lines[0].args[2], ":0") {
+		t.Errorf("got %s, expected the bound address", lines[0].args[2])
+	}
+	if lines[1].keyword != "CMETHODS" || lines[1].args[0] != "DONE" {
+		t.Errorf("got %v, expected CMETHODS DONE", lines[1])
+	}
+
+	// Listening on the same address again fails.
+	lines = captureIPC(t, func() {
+		if ClientSetupTCP(lines[0].args[2], "127.0.0.1:1", nil, []string{"obfs2"}, "", "transparent-TCP", handler) {
+			t.Error("ClientSetupTCP listened on an address in use")
+		}
+	})
+	if len(lines) != 2 || lines[0].keyword != "CMETHOD-ERROR" || lines[0].args[0] != "obfs2" || lines[1].keyword != "CMETHODS" {
+		t.Errorf("got %v, expected CMETHOD-ERROR and CMETHODS DONE", lines)
+	}
+}
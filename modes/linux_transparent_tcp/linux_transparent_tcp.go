@@ -0,0 +1,143 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+// Package linux_transparent_tcp proxies TCP connections that were redirected
+// to the dispatcher by iptables/nftables (REDIRECT or TPROXY).  The original
+// destination of each connection is recovered on the client and sent to the
+// server, which connects to it instead of a fixed ORPort.
+package linux_transparent_tcp
+
+import (
+	"net"
+	"net/url"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
+	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
+)
+
+// Version returns a string suitable to be included in a call to Cmethod.
+func Version() string {
+	return "linux-transparent-TCP"
+}
+
+func ClientSetup(listenAddr string, target string, ptClientProxy *url.URL, names []string, options string) (launched bool) {
+	limits, err := modes.ClientRateLimits(options)
+	if err != nil {
+		log.Errorf("%s", err)
+		return false
+	}
+
+	// Launch each of the client listeners.
+	for _, name := range names {
+		ln, err := modes.ListenTransparentTCP(listenAddr)
+		if err != nil {
+			log.Errorf("failed to listen %s %s", name, err.Error())
+			_ = pt.CmethodError(name, err.Error())
+			continue
+		}
+
+		go clientAcceptLoop(target, name, options, ln, ptClientProxy, limits)
+		pt.Cmethod(name, Version(), ln.Addr())
+		log.Infof("%s - registered listener: %s", name, ln.Addr())
+		launched = true
+	}
+	pt.CmethodsDone()
+
+	return
+}
+
+func clientAcceptLoop(target string, name string, options string, ln net.Listener, proxyURI *url.URL, limits modes.RateLimits) {
+	err := modes.AcceptSessions(name, ln, func(conn net.Conn) {
+		clientHandler(target, name, options, conn, ln.Addr(), proxyURI, limits)
+	}, nil)
+	log.Errorf("Fatal listener error: %s", err.Error())
+}
+
+func clientHandler(target string, name string, options string, conn net.Conn, listenAddr net.Addr, proxyURI *url.URL, limits modes.RateLimits) {
+	defer conn.Close()
+
+	session := modes.NewSessionID()
+	destination, err := modes.OriginalDestination(conn, listenAddr)
+	if err != nil {
+		modes.SessionLogger(name, session, "").Errorf("failed to recover original destination: %s", err)
+		return
+	}
+
+	// Create the outgoing connection, failing over between the targets.
+	remote, target, err := modes.DialTarget(name, session, target, options, proxyURI)
+	logger := modes.SessionLogger(name, session, target)
+	if err != nil {
+		logger.Errorf("outgoing connection failed: %s", log.ElideError(err))
+		return
+	}
+
+	if err = modes.WriteDestination(remote, destination.String()); err != nil {
+		logger.Errorf("failed to send destination: %s", log.ElideError(err))
+		remote.Close()
+		return
+	}
+
+	logger.Infof("proxying connection to %s", log.ElideAddr(destination.String()))
+	limiter := modes.NewRateLimiter(name, listenAddr.String(), modes.ClientIdentity(conn.RemoteAddr()), limits)
+	appConn := modes.CaptureConn(conn, session, modes.CaptureApplication)
+	if err = modes.CopyLoop(modes.RateLimitConn(appConn, limiter), remote); err != nil {
+		logger.Warnf("closed connection: %s", log.ElideError(err))
+	} else {
+		logger.Infof("closed connection")
+	}
+}
+
+func ServerSetup(ptServerInfo pt.ServerInfo, stateDir string, options string) (launched bool) {
+	if !modes.RequireExit(ptServerInfo, Version()) {
+		return false
+	}
+
+	return modes.ServerSetupTCP(ptServerInfo, stateDir, options, serverHandler)
+}
+
+func serverHandler(name string, remote net.Conn, info *pt.ServerInfo) {
+	session := modes.SessionID(remote)
+	destination, err := modes.ReadClientDestination(remote)
+	if err != nil {
+		modes.SessionLogger(name, session, "").Errorf("failed to read destination: %s", log.ElideError(err))
+		remote.Close()
+		return
+	}
+	logger := modes.SessionLogger(name, session, destination)
+
+	destConn, err := modes.DialDestination("tcp", name, destination)
+	if err != nil {
+		logger.Errorf("failed to connect to destination: %s", log.ElideError(err))
+		remote.Close()
+		return
+	}
+	destConn = modes.CaptureConn(destConn, session, modes.CaptureApplication)
+
+	if err = modes.CopyLoop(destConn, remote); err != nil {
+		logger.Warnf("closed connection: %s", log.ElideError(err))
+	} else {
+		logger.Infof("closed connection")
+	}
+}
@@ -0,0 +1,132 @@
+package linux_transparent_tcp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/policy"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
+	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
+)
+
+// TestServerHandlerDialsDestination tests that the server connects to the
+// destination sent by the client rather than to the ORPort.
+func TestServerHandlerDialsDestination(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen failed:", err)
+	}
+	defer ln.Close()
+
+	rules, err := policy.Parse("allow=127.0.0.1")
+	if err != nil {
+		t.Fatal("policy.Parse failed:", err)
+	}
+	modes.SetExit(true, rules)
+	defer modes.SetExit(false, policy.Default())
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go serverHandler("test", server, nil)
+
+	if err = modes.WriteDestination(client, ln.Addr().String()); err != nil {
+		t.Fatal("WriteDestination failed:", err)
+	}
+	if _, err = client.Write([]byte("ping")); err != nil {
+		t.Fatal("write failed:", err)
+	}
+
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(client, buf); err != nil {
+		t.Fatal("read failed:", err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("received %q, expected \"ping\"", buf)
+	}
+}
+
+// TestServerHandlerAppliesPolicy tests that the server refuses destinations
+// that are denied by the exit policy.
+func TestServerHandlerAppliesPolicy(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go serverHandler("test", server, nil)
+
+	// The default policy denies loopback addresses.
+	if err := modes.WriteDestination(client, "127.0.0.1:9"); err != nil {
+		t.Fatal("WriteDestination failed:", err)
+	}
+
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Error("server did not close a connection to a denied destination")
+	}
+}
+
+// TestOriginalDestinationNotRedirected tests that a connection made directly
+// to the listener is not treated as a redirected connection.
+func TestOriginalDestinationNotRedirected(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen failed:", err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("dial failed:", err)
+	}
+	defer client.Close()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal("accept failed:", err)
+	}
+	defer conn.Close()
+
+	if destination, err := modes.OriginalDestination(conn, ln.Addr()); err == nil {
+		t.Error("OriginalDestination returned", destination, "for a direct connection")
+	}
+}
+
+// TestServerSetupRequiresExit tests that a server started without exit mode
+// does not listen, so that it never connects to a destination chosen by a
+// client.
+func TestServerSetupRequiresExit(t *testing.T) {
+	var output bytes.Buffer
+	stdout := pt.Stdout
+	pt.Stdout = &output
+	defer func() { pt.Stdout = stdout }()
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("listen failed:", err)
+	}
+	bindaddr := ln.Addr().(*net.TCPAddr)
+	_ = ln.Close()
+
+	modes.SetExit(false, policy.Default())
+	info := pt.ServerInfo{Bindaddrs: []pt.Bindaddr{{MethodName: "obfs2", Addr: bindaddr}}}
+	if ServerSetup(info, t.TempDir(), "") {
+		t.Fatal("the server launched without exit mode")
+	}
+	if !strings.Contains(output.String(), "SMETHOD-ERROR obfs2") {
+		t.Errorf("the failure was not reported to the parent: %q", output.String())
+	}
+
+	if conn, err := net.Dial("tcp", bindaddr.String()); err == nil {
+		_ = conn.Close()
+		t.Error("the server accepted a connection without exit mode")
+	}
+}
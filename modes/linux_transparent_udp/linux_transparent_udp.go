@@ -0,0 +1,300 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+// Package linux_transparent_udp proxies UDP packets that were redirected to
+// the dispatcher by the iptables/nftables TPROXY target.  Packets are grouped
+// into sessions by source and original destination.  Each session uses its
+// own transport connection, which starts with the original destination so
+// that the server can forward the packets to it, and replies are sent back
+// to the client from the original destination address.
+package linux_transparent_udp
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
+	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
+)
+
+const (
+	// maxPacketSize is the largest packet that fits the 16 bit length
+	// prefix used on transport connections.
+	maxPacketSize = 65535
+
+	// sessionQueueSize is how many packets are buffered for a session
+	// before further packets are dropped.
+	sessionQueueSize = 64
+
+	// idleTimeout is how long a session is kept open without any traffic
+	// in either direction.
+	idleTimeout = 2 * time.Minute
+)
+
+// Version returns a string suitable to be included in a call to Cmethod.
+func Version() string {
+	return "linux-transparent-UDP"
+}
+
+func ClientSetup(listenAddr string, target string, ptClientProxy *url.URL, names []string, options string) (launched bool) {
+	limits, err := modes.ClientRateLimits(options)
+	if err != nil {
+		log.Errorf("%s", err)
+		return false
+	}
+
+	// Launch each of the client listeners.
+	for _, name := range names {
+		conn, err := modes.ListenTransparentUDP(listenAddr)
+		if err != nil {
+			log.Errorf("failed to listen %s %s", name, err.Error())
+			_ = pt.CmethodError(name, err.Error())
+			continue
+		}
+
+		go clientHandler(target, name, options, conn, ptClientProxy, limits)
+		pt.Cmethod(name, Version(), conn.LocalAddr())
+		log.Infof("%s - registered listener: %s", name, conn.LocalAddr())
+		launched = true
+	}
+	pt.CmethodsDone()
+
+	return
+}
+
+type session struct {
+	packets chan []byte
+}
+
+func clientHandler(target string, name string, options string, conn *net.UDPConn, proxyURI *url.URL, limits modes.RateLimits) {
+	var lock sync.Mutex
+	sessions := make(map[string]*session)
+
+	for {
+		buf := make([]byte, maxPacketSize)
+		numBytes, source, destination, err := modes.ReadFromUDPOriginalDst(conn, buf)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && !e.Temporary() {
+				log.Errorf("%s - fatal listener error: %s", name, err.Error())
+				return
+			}
+			log.Warnf("%s - dropping packet: %s", name, err.Error())
+			continue
+		}
+
+		key := source.String() + "->" + destination.String()
+		lock.Lock()
+		s, ok := sessions[key]
+		if !ok {
+			s = &session{packets: make(chan []byte, sessionQueueSize)}
+			sessions[key] = s
+			go func() {
+				limiter := modes.NewRateLimiter(name, conn.LocalAddr().String(), source.IP.String(), limits)
+				runSession(target, name, options, proxyURI, source, destination, s, limiter)
+				lock.Lock()
+				delete(sessions, key)
+				lock.Unlock()
+			}()
+		}
+		lock.Unlock()
+
+		select {
+		case s.packets <- buf[:numBytes]:
+		default:
+			// The session is not keeping up, drop the packet.
+		}
+	}
+}
+
+func runSession(target string, name string, options string, proxyURI *url.URL, source *net.UDPAddr, destination *net.UDPAddr, s *session, limiter *modes.RateLimiter) {
+	defer limiter.Close()
+
+	// Create the outgoing connection, failing over between the targets.
+	session := modes.NewSessionID()
+	remote, target, err := modes.DialTarget(name, session, target, options, proxyURI)
+	logger := modes.SessionLogger(name, session, target)
+	if err != nil {
+		logger.Errorf("outgoing connection failed: %s", log.ElideError(err))
+		return
+	}
+	remote = modes.RateLimitConn(remote, limiter)
+	defer remote.Close()
+
+	if err = modes.WriteDestination(remote, destination.String()); err != nil {
+		logger.Errorf("failed to send destination: %s", log.ElideError(err))
+		return
+	}
+
+	reply, err := modes.DialUDPFrom(destination, source)
+	if err != nil {
+		logger.Errorf("failed to open reply socket for %s: %s", log.ElideAddr(destination.String()), log.ElideError(err))
+		return
+	}
+	defer reply.Close()
+
+	logger.Infof("new session to %s", log.ElideAddr(destination.String()))
+
+	// Relay replies from the server back to the client.
+	activity := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := modes.GetPacketBuffer()
+		defer modes.PutPacketBuffer(buf)
+		for {
+			packet, err := readPacket(remote, buf)
+			if err != nil {
+				return
+			}
+			if _, err = reply.Write(packet); err != nil {
+				return
+			}
+			select {
+			case activity <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	timer := time.NewTimer(idleTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case packet := <-s.packets:
+			if err = writePacket(remote, packet); err != nil {
+				logger.Warnf("closed session: %s", log.ElideError(err))
+				return
+			}
+		case <-activity:
+		case <-done:
+			logger.Infof("closed session")
+			return
+		case <-timer.C:
+			logger.Infof("session timed out")
+			return
+		}
+
+		if !timer.Stop() {
+			<-timer.C
+		}
+		timer.Reset(idleTimeout)
+	}
+}
+
+func ServerSetup(ptServerInfo pt.ServerInfo, stateDir string, options string) (launched bool) {
+	if !modes.RequireExit(ptServerInfo, Version()) {
+		return false
+	}
+
+	return modes.ServerSetupUDP(ptServerInfo, stateDir, options, serverHandler)
+}
+
+func serverHandler(name string, remote net.Conn, info *pt.ServerInfo) {
+	defer remote.Close()
+
+	session := modes.SessionID(remote)
+	destination, err := modes.ReadClientDestination(remote)
+	if err != nil {
+		modes.SessionLogger(name, session, "").Errorf("failed to read destination: %s", log.ElideError(err))
+		return
+	}
+	logger := modes.SessionLogger(name, session, destination)
+
+	dest, err := modes.DialDestination("udp", name, destination)
+	if err != nil {
+		logger.Errorf("failed to connect to destination: %s", log.ElideError(err))
+		return
+	}
+	dest = modes.CaptureConn(dest, session, modes.CaptureApplication)
+	defer dest.Close()
+
+	// Relay replies from the destination back to the client.
+	go func() {
+		defer remote.Close()
+		buf := modes.GetPacketBuffer()
+		defer modes.PutPacketBuffer(buf)
+		for {
+			_ = dest.SetReadDeadline(time.Now().Add(idleTimeout))
+			numBytes, err := dest.Read(buf[2 : 2+maxPacketSize])
+			if err != nil {
+				return
+			}
+			if err = writeFrame(remote, buf[:2+numBytes]); err != nil {
+				return
+			}
+		}
+	}()
+
+	buf := modes.GetPacketBuffer()
+	defer modes.PutPacketBuffer(buf)
+	for {
+		packet, err := readPacket(remote, buf)
+		if err != nil {
+			break
+		}
+		if _, err = dest.Write(packet); err != nil {
+			break
+		}
+	}
+
+	logger.Infof("closed session")
+}
+
+// writePacket sends a packet over a transport connection, prefixed by its
+// length as a little endian uint16, as in transparent-UDP mode.
+func writePacket(w io.Writer, packet []byte) error {
+	frame := modes.GetPacketBuffer()
+	defer modes.PutPacketBuffer(frame)
+
+	n := copy(frame[2:], packet)
+	return writeFrame(w, frame[:2+n])
+}
+
+// writeFrame sends a frame whose packet is already in place after the two
+// bytes reserved for its length.
+func writeFrame(w io.Writer, frame []byte) error {
+	binary.LittleEndian.PutUint16(frame, uint16(len(frame)-2))
+	_, err := w.Write(frame)
+	return err
+}
+
+// readPacket receives a packet sent by writePacket into buf, which must be
+// large enough for any packet.
+func readPacket(r io.Reader, buf []byte) ([]byte, error) {
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return nil, err
+	}
+
+	packet := buf[:binary.LittleEndian.Uint16(buf[:2])]
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return nil, err
+	}
+
+	return packet, nil
+}
@@ -0,0 +1,43 @@
+package linux_transparent_udp
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/policy"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
+	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
+)
+
+// TestServerSetupRequiresExit tests that a server started without exit mode
+// does not listen, so that it never sends packets to a destination chosen by
+// a client.
+func TestServerSetupRequiresExit(t *testing.T) {
+	var output bytes.Buffer
+	stdout := pt.Stdout
+	pt.Stdout = &output
+	defer func() { pt.Stdout = stdout }()
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("listen failed:", err)
+	}
+	bindaddr := ln.Addr().(*net.TCPAddr)
+	_ = ln.Close()
+
+	modes.SetExit(false, policy.Default())
+	info := pt.ServerInfo{Bindaddrs: []pt.Bindaddr{{MethodName: "obfs2", Addr: bindaddr}}}
+	if ServerSetup(info, t.TempDir(), "") {
+		t.Fatal("the server launched without exit mode")
+	}
+	if !strings.Contains(output.String(), "SMETHOD-ERROR obfs2") {
+		t.Errorf("the failure was not reported to the parent: %q", output.String())
+	}
+
+	if conn, err := net.Dial("tcp", bindaddr.String()); err == nil {
+		_ = conn.Close()
+		t.Error("the server accepted a connection without exit mode")
+	}
+}
@@ -0,0 +1,311 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
+	"github.com/xtaci/smux"
+)
+
+// muxOptionsKey is the key in the transport options that enables stream
+// multiplexing.  Client options contain it directly, for example
+// {"cert": "...", "mux": {"connections": 2}}, and server options contain it
+// in the options for each transport, for example {"obfs4": {"mux": true}}.
+// "mux": true enables it with the default settings.  Both the client and the
+// server must enable it.
+const muxOptionsKey = "mux"
+
+// defaultMuxConnections is the default number of transport connections that
+// a client shares between all of its streams.
+const defaultMuxConnections = 1
+
+// MuxConfig configures stream multiplexing for a transport.
+type MuxConfig struct {
+	// Connections is the number of transport connections that a client
+	// spreads its streams over.
+	Connections int `json:"connections"`
+}
+
+// ParseMuxOptions returns the multiplexing configuration in the client
+// transport options, and whether multiplexing is enabled.
+func ParseMuxOptions(options string) (MuxConfig, bool, error) {
+	return parseMuxConfig(clientOption(options, muxOptionsKey))
+}
+
+// ParseServerMuxOptions returns the multiplexing configuration for the named
+// transport in the server transport options, and whether multiplexing is
+// enabled.
+func ParseServerMuxOptions(name string, options string) (MuxConfig, bool, error) {
+	return parseMuxConfig(serverOption(name, options, muxOptionsKey))
+}
+
+func parseMuxConfig(raw json.RawMessage) (MuxConfig, bool, error) {
+	config := MuxConfig{Connections: defaultMuxConnections}
+	if raw == nil {
+		return config, false, nil
+	}
+
+	var enabled bool
+	if err := json.Unmarshal(raw, &enabled); err == nil {
+		return config, enabled, nil
+	}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return config, false, errors.New("could not parse mux options")
+	}
+	if config.Connections < 1 {
+		return config, false, errors.New("mux connections must be at least 1")
+	}
+
+	return config, true, nil
+}
+
+var muxGroups = make(map[string]*muxGroup)
+var muxGroupsLock sync.Mutex
+var muxReaper sync.Once
+
+// errMuxGroupClosed is returned for a group that was closed after it was
+// looked up, in which case the lookup is repeated.
+var errMuxGroupClosed = errors.New("multiplexed transport connections closed")
+
+// DialTransport returns a new connection to the transport server for the
+// given transport, target and options, made for the given session.  If multiplexing is enabled in the
+// options, the connection is a stream over a shared transport connection,
+// otherwise it is a pooled or newly dialed transport connection.
+func DialTransport(name string, session string, target string, options string, dial func() (net.Conn, error)) (net.Conn, error) {
+	key := PoolKey(name, target, options)
+
+	timeouts, err := ClientTimeouts(options)
+	if err != nil {
+		return nil, err
+	}
+	transportDial := dial
+	dial = func() (net.Conn, error) {
+		return dialWithTimeout(name+" handshake", timeouts.Handshake, transportDial)
+	}
+
+	config, enabled, err := ParseMuxOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		conn, err := DialPooled(key, dial)
+		connectStatus(name, session, err)
+		if err != nil {
+			return nil, err
+		}
+		return newIdleConn(newStatsConn(name, conn), timeouts.Idle, false), nil
+	}
+
+	muxReaper.Do(func() { go reapMuxGroups(time.Minute) })
+
+	var stream net.Conn
+	for {
+		muxGroupsLock.Lock()
+		group, ok := muxGroups[key]
+		if !ok {
+			group = &muxGroup{size: config.Connections, dial: func() (net.Conn, error) { return DialPooled(key, dial) }}
+			muxGroups[key] = group
+		}
+		muxGroupsLock.Unlock()
+
+		if stream, err = group.openStream(); err != errMuxGroupClosed {
+			break
+		}
+	}
+	connectStatus(name, session, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return newIdleConn(newStatsConn(name, stream), timeouts.Idle, false), nil
+}
+
+// muxGroup is the set of multiplexed transport connections that a client
+// uses for one transport server.
+type muxGroup struct {
+	lock     sync.Mutex
+	sessions []*smux.Session
+	next     int
+	size     int
+	dial     func() (net.Conn, error)
+	lastUsed time.Time
+	closed   bool
+}
+
+// reapMuxGroups closes the transport connections of groups that have had no
+// open streams for poolUnusedTimeout, checking every interval.
+func reapMuxGroups(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		muxGroupsLock.Lock()
+		for key, group := range muxGroups {
+			if group.unused() {
+				delete(muxGroups, key)
+				group.close()
+			}
+		}
+		muxGroupsLock.Unlock()
+	}
+}
+
+// closeMuxGroups closes the transport connections of all groups.
+func closeMuxGroups() {
+	muxGroupsLock.Lock()
+	closing := muxGroups
+	muxGroups = make(map[string]*muxGroup)
+	muxGroupsLock.Unlock()
+
+	for _, group := range closing {
+		group.close()
+	}
+}
+
+func (group *muxGroup) unused() bool {
+	group.lock.Lock()
+	defer group.lock.Unlock()
+
+	for _, session := range group.sessions {
+		if !session.IsClosed() && session.NumStreams() > 0 {
+			return false
+		}
+	}
+	return time.Since(group.lastUsed) > poolUnusedTimeout
+}
+
+func (group *muxGroup) close() {
+	group.lock.Lock()
+	defer group.lock.Unlock()
+
+	group.closed = true
+	for _, session := range group.sessions {
+		_ = session.Close()
+	}
+	group.sessions = nil
+}
+
+func (group *muxGroup) openStream() (net.Conn, error) {
+	session, err := group.session()
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := session.OpenStream()
+	if err != nil {
+		// The transport connection has failed, try again with a new one.
+		_ = session.Close()
+		if session, err = group.session(); err != nil {
+			return nil, err
+		}
+		if stream, err = session.OpenStream(); err != nil {
+			return nil, err
+		}
+	}
+
+	return stream, nil
+}
+
+// session returns the next transport connection to use, dialing a new one
+// if there are fewer than the configured number.
+func (group *muxGroup) session() (*smux.Session, error) {
+	group.lock.Lock()
+	defer group.lock.Unlock()
+
+	if group.closed {
+		return nil, errMuxGroupClosed
+	}
+	group.lastUsed = time.Now()
+	live := group.sessions[:0]
+	for _, session := range group.sessions {
+		if !session.IsClosed() {
+			live = append(live, session)
+		}
+	}
+	group.sessions = live
+
+	if len(group.sessions) < group.size {
+		session, err := group.newSession()
+		if err == nil {
+			group.sessions = append(group.sessions, session)
+			return session, nil
+		}
+		if len(group.sessions) == 0 {
+			return nil, err
+		}
+		log.Warnf("failed to open multiplexed transport connection: %s", log.ElideError(err))
+	}
+
+	group.next = (group.next + 1) % len(group.sessions)
+	return group.sessions[group.next], nil
+}
+
+func (group *muxGroup) newSession() (*smux.Session, error) {
+	conn, err := group.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := smux.Client(conn, smux.DefaultConfig())
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// muxServerHandler wraps a server handler so that it is called for each
+// stream multiplexed over a transport connection.
+func muxServerHandler(serverHandler ServerHandler) ServerHandler {
+	return func(name string, remote net.Conn, info *pt.ServerInfo) {
+		session, err := smux.Server(remote, smux.DefaultConfig())
+		if err != nil {
+			log.Errorf("%s - failed to start multiplexing: %s", name, err)
+			_ = remote.Close()
+			return
+		}
+		defer session.Close()
+
+		for {
+			stream, err := session.AcceptStream()
+			if err != nil {
+				if !session.IsClosed() {
+					log.Warnf("%s - multiplexed connection failed: %s", name, log.ElideError(err))
+				}
+				return
+			}
+
+			go serverHandler(name, stream, info)
+		}
+	}
+}
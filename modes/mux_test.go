@@ -0,0 +1,77 @@
+package modes
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
+)
+
+// TestMuxStreams tests that streams opened with DialTransport share a single
+// transport connection and reach the server handler separately.
+func TestMuxStreams(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen failed:", err)
+	}
+	defer ln.Close()
+
+	echo := func(name string, remote net.Conn, info *pt.ServerInfo) {
+		_, _ = io.Copy(remote, remote)
+		_ = remote.Close()
+	}
+	go ServerAcceptLoop("test", ln, nil, muxServerHandler(echo))
+
+	var dials int32
+	dial := func() (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return net.Dial("tcp", ln.Addr().String())
+	}
+
+	options := `{"mux": {"connections": 1}}`
+	for _, message := range []string{"one", "two", "three"} {
+		stream, err := DialTransport("test", "", ln.Addr().String(), options, dial)
+		if err != nil {
+			t.Fatal("DialTransport failed:", err)
+		}
+		if _, err = stream.Write([]byte(message)); err != nil {
+			t.Fatal("write failed:", err)
+		}
+		buf := make([]byte, len(message))
+		if _, err = io.ReadFull(stream, buf); err != nil {
+			t.Fatal("read failed:", err)
+		}
+		if string(buf) != message {
+			t.Errorf("received %q, expected %q", buf, message)
+		}
+		_ = stream.Close()
+	}
+
+	if atomic.LoadInt32(&dials) != 1 {
+		t.Errorf("%d transport connections were dialed, expected 1", dials)
+	}
+}
+
+// TestParseMuxOptions tests the client and server forms of the mux options.
+func TestParseMuxOptions(t *testing.T) {
+	if _, enabled, err := ParseMuxOptions(`{"cert": "abc"}`); enabled || err != nil {
+		t.Error("mux enabled without the mux option:", err)
+	}
+	if config, enabled, err := ParseMuxOptions(`{"mux": true}`); !enabled || err != nil || config.Connections != defaultMuxConnections {
+		t.Error("ParseMuxOptions failed for mux=true:", config, err)
+	}
+	if config, enabled, err := ParseMuxOptions(`{"mux": {"connections": 3}}`); !enabled || err != nil || config.Connections != 3 {
+		t.Error("ParseMuxOptions failed for mux connections:", config, err)
+	}
+	if _, _, err := ParseMuxOptions(`{"mux": {"connections": 0}}`); err == nil {
+		t.Error("ParseMuxOptions accepted 0 connections")
+	}
+	if _, enabled, err := ParseServerMuxOptions("obfs4", `{"obfs4": {"mux": true}}`); !enabled || err != nil {
+		t.Error("ParseServerMuxOptions failed:", err)
+	}
+	if _, enabled, _ := ParseServerMuxOptions("shadow", `{"obfs4": {"mux": true}}`); enabled {
+		t.Error("ParseServerMuxOptions enabled mux for another transport")
+	}
+}
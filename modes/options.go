@@ -0,0 +1,53 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"encoding/json"
+)
+
+// clientOption returns the value of a dispatcher option in the client
+// transport options, which are a JSON object passed to the transport, or nil
+// if it is not set.
+func clientOption(options string, key string) json.RawMessage {
+	var args map[string]json.RawMessage
+	if options == "" || json.Unmarshal([]byte(options), &args) != nil {
+		// Options that are not a JSON object are left to the transport.
+		return nil
+	}
+
+	return args[key]
+}
+
+// serverOption returns the value of a dispatcher option in the server
+// options for the named transport, or nil if it is not set.
+func serverOption(name string, options string, key string) json.RawMessage {
+	var args map[string]map[string]json.RawMessage
+	if options == "" || json.Unmarshal([]byte(options), &args) != nil {
+		return nil
+	}
+
+	return args[name][key]
+}
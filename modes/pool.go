@@ -0,0 +1,417 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+)
+
+// PoolConfig configures the pools of pre-dialed transport connections that
+// clients keep for each transport server.
+type PoolConfig struct {
+	// Size is the number of idle connections kept in each pool.  Pooling
+	// is disabled if it is 0.
+	Size int
+
+	// MaxIdle is how long an idle connection is kept before it is replaced,
+	// since servers close connections that send nothing before their
+	// handshake timeout.  It should be shorter than the servers' handshake
+	// timeout, which is DefaultTimeouts.Handshake unless they set another.
+	MaxIdle time.Duration
+
+	// CheckInterval is how often expired connections are replaced, and the
+	// pool refilled.
+	CheckInterval time.Duration
+}
+
+// poolUnusedTimeout is how long a pool is kept after it was last used.  The
+// pools used by socks5 and http-connect clients depend on the targets that
+// applications ask for, so pools that are no longer used are closed.
+const poolUnusedTimeout = 10 * time.Minute
+
+// maxRetryData is how much data written to a pooled connection is kept to be
+// sent again, in case the server closed the connection while it was idle.
+const maxRetryData = 64 * 1024
+
+var poolConfig PoolConfig
+var pools = make(map[string]*ConnPool)
+var poolsLock sync.Mutex
+
+// SetPoolConfig configures the pools used by DialPooled.  It must be called
+// before any client connections are made.
+func SetPoolConfig(config PoolConfig) {
+	poolConfig = config
+}
+
+// PoolKey returns the key used to share a pool between connections that use
+// the same transport server, transport and options.
+func PoolKey(name string, target string, options string) string {
+	return name + "\x00" + target + "\x00" + options
+}
+
+// DialPooled returns a connection from the pool for key, which is created
+// with dial the first time it is used.  If pooling is disabled it simply
+// calls dial.
+func DialPooled(key string, dial func() (net.Conn, error)) (net.Conn, error) {
+	if poolConfig.Size <= 0 {
+		return dial()
+	}
+
+	poolsLock.Lock()
+	pool, ok := pools[key]
+	if !ok {
+		pool = NewConnPool(poolConfig, dial)
+		pool.key = key
+		pools[key] = pool
+	}
+	poolsLock.Unlock()
+
+	return pool.Get()
+}
+
+// ClosePools closes the pools used by DialPooled and the multiplexed
+// transport connections used by DialTransport.  It is called when the
+// dispatcher shuts down.
+func ClosePools() {
+	poolsLock.Lock()
+	closing := pools
+	pools = make(map[string]*ConnPool)
+	poolsLock.Unlock()
+
+	for _, pool := range closing {
+		pool.Close()
+	}
+
+	closeMuxGroups()
+}
+
+type pooledConn struct {
+	conn    net.Conn
+	created time.Time
+}
+
+// ConnPool keeps a number of pre-dialed connections so that new connections
+// do not have to wait for the transport handshake.
+type ConnPool struct {
+	config   PoolConfig
+	dial     func() (net.Conn, error)
+	key      string
+	lock     sync.Mutex
+	idle     []pooledConn
+	dialing  int
+	closed   bool
+	lastUsed time.Time
+}
+
+// NewConnPool creates a pool and starts filling it with connections made
+// with dial.
+func NewConnPool(config PoolConfig, dial func() (net.Conn, error)) *ConnPool {
+	pool := &ConnPool{config: config, dial: dial, lastUsed: time.Now()}
+	pool.fill()
+	if config.CheckInterval > 0 {
+		go pool.maintain()
+	}
+
+	return pool
+}
+
+// Get returns an idle connection that has not expired if there is one, and
+// otherwise dials a new connection.  Idle connections are never read from
+// before they are returned, since that would consume data from the
+// transport's stream, so the server may have closed them.  They are returned
+// as connections that are dialed again once if they fail before the server
+// first sends data.
+func (pool *ConnPool) Get() (net.Conn, error) {
+	defer pool.fill()
+
+	for {
+		pool.lock.Lock()
+		pool.lastUsed = time.Now()
+		if len(pool.idle) == 0 {
+			pool.lock.Unlock()
+			return pool.dial()
+		}
+		idle := pool.idle[0]
+		pool.idle = pool.idle[1:]
+		pool.lock.Unlock()
+
+		if pool.expired(idle) {
+			_ = idle.conn.Close()
+			continue
+		}
+		return &retryConn{conn: idle.conn, dial: pool.dial}, nil
+	}
+}
+
+// Close closes the idle connections and stops refilling the pool.
+func (pool *ConnPool) Close() {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	pool.closed = true
+	for _, idle := range pool.idle {
+		_ = idle.conn.Close()
+	}
+	pool.idle = nil
+}
+
+func (pool *ConnPool) expired(idle pooledConn) bool {
+	return pool.config.MaxIdle > 0 && time.Since(idle.created) > pool.config.MaxIdle
+}
+
+// fill starts dialing connections until there are enough idle connections.
+// Failed dials are not retried until the next fill.
+func (pool *ConnPool) fill() {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	for !pool.closed && len(pool.idle)+pool.dialing < pool.config.Size {
+		pool.dialing++
+		go func() {
+			conn, err := pool.dial()
+
+			pool.lock.Lock()
+			defer pool.lock.Unlock()
+			pool.dialing--
+			if err != nil {
+				log.Warnf("failed to dial pooled connection: %s", log.ElideError(err))
+				return
+			}
+			if pool.closed {
+				_ = conn.Close()
+				return
+			}
+			pool.idle = append(pool.idle, pooledConn{conn, time.Now()})
+		}()
+	}
+}
+
+// maintain periodically replaces idle connections that have expired, and
+// closes the pool once it has not been used for poolUnusedTimeout.
+func (pool *ConnPool) maintain() {
+	ticker := time.NewTicker(pool.config.CheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		pool.lock.Lock()
+		if pool.closed {
+			pool.lock.Unlock()
+			return
+		}
+		unused := time.Since(pool.lastUsed) > poolUnusedTimeout
+		var live []pooledConn
+		for _, idle := range pool.idle {
+			if pool.expired(idle) {
+				_ = idle.conn.Close()
+				continue
+			}
+			live = append(live, idle)
+		}
+		pool.idle = live
+		pool.lock.Unlock()
+
+		if unused {
+			pool.evict()
+			return
+		}
+		pool.fill()
+	}
+}
+
+// evict removes an unused pool from the pools used by DialPooled and closes
+// it.
+func (pool *ConnPool) evict() {
+	poolsLock.Lock()
+	if pools[pool.key] == pool {
+		delete(pools, pool.key)
+	}
+	poolsLock.Unlock()
+
+	pool.Close()
+}
+
+// retryConn is an idle connection taken from a pool.  A server that closed it
+// while it was idle is only noticed when it is used, so the data written is
+// kept until the server first sends data, and is sent again over a new
+// connection if the first read or write fails before then.  Reads and writes
+// may be made at the same time, as by CopyLoop.
+type retryConn struct {
+	dial func() (net.Conn, error)
+
+	lock          sync.Mutex
+	conn          net.Conn
+	sent          []byte
+	settled       bool
+	closed        bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func (conn *retryConn) Read(b []byte) (int, error) {
+	for {
+		conn.lock.Lock()
+		current, settled := conn.conn, conn.settled
+		conn.lock.Unlock()
+
+		n, err := current.Read(b)
+		if settled || n > 0 || err == nil {
+			if n > 0 {
+				conn.settle()
+			}
+			return n, err
+		}
+		if timedOut(err) || !conn.retry(current) {
+			return n, err
+		}
+	}
+}
+
+func (conn *retryConn) Write(b []byte) (int, error) {
+	conn.lock.Lock()
+	current := conn.conn
+	if !conn.settled {
+		if len(conn.sent)+len(b) > maxRetryData {
+			conn.settled = true
+			conn.sent = nil
+		} else {
+			conn.sent = append(conn.sent, b...)
+		}
+	}
+	conn.lock.Unlock()
+
+	n, err := current.Write(b)
+	if err != nil && !timedOut(err) && conn.retry(current) {
+		// The data was sent again over the new connection.
+		return len(b), nil
+	}
+
+	return n, err
+}
+
+// settle stops keeping the data written, once the server has sent data.
+func (conn *retryConn) settle() {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	conn.settled = true
+	conn.sent = nil
+}
+
+// retry replaces failed with a new connection, and sends the data written so
+// far over it.  It reports whether the connection was replaced, here or by a
+// concurrent read or write.
+func (conn *retryConn) retry(failed net.Conn) bool {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	if conn.conn != failed {
+		return true
+	}
+	if conn.settled || conn.closed {
+		return false
+	}
+	conn.settled = true
+
+	fresh, err := conn.dial()
+	if err != nil {
+		log.Warnf("failed to replace a closed pooled connection: %s", log.ElideError(err))
+		return false
+	}
+	_ = fresh.SetReadDeadline(conn.readDeadline)
+	_ = fresh.SetWriteDeadline(conn.writeDeadline)
+	if _, err = fresh.Write(conn.sent); err != nil {
+		_ = fresh.Close()
+		return false
+	}
+	log.Debugf("replaced a pooled connection closed by the server")
+
+	_ = failed.Close()
+	conn.conn = fresh
+	conn.sent = nil
+	return true
+}
+
+// timedOut reports whether err is a timeout, which does not mean that the
+// connection was closed.
+func timedOut(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func (conn *retryConn) current() net.Conn {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	return conn.conn
+}
+
+func (conn *retryConn) Close() error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	conn.closed = true
+	return conn.conn.Close()
+}
+
+func (conn *retryConn) CloseWrite() error {
+	return CloseWrite(conn.current())
+}
+
+func (conn *retryConn) LocalAddr() net.Addr {
+	return conn.current().LocalAddr()
+}
+
+func (conn *retryConn) RemoteAddr() net.Addr {
+	return conn.current().RemoteAddr()
+}
+
+func (conn *retryConn) SetDeadline(t time.Time) error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	conn.readDeadline, conn.writeDeadline = t, t
+	return conn.conn.SetDeadline(t)
+}
+
+func (conn *retryConn) SetReadDeadline(t time.Time) error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	conn.readDeadline = t
+	return conn.conn.SetReadDeadline(t)
+}
+
+func (conn *retryConn) SetWriteDeadline(t time.Time) error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	conn.writeDeadline = t
+	return conn.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,201 @@
+package modes
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startPoolServer starts a TCP server that reports each accepted connection,
+// and a dial function for it that counts dials.
+func startPoolServer(t *testing.T, dials *int32) (net.Listener, chan net.Conn, func() (net.Conn, error)) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen failed:", err)
+	}
+
+	accepted := make(chan net.Conn, 16)
+	go func() {
+		for {
+			conn, acceptErr := ln.Accept()
+			if acceptErr != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	dial := func() (net.Conn, error) {
+		atomic.AddInt32(dials, 1)
+		return net.Dial("tcp", ln.Addr().String())
+	}
+
+	return ln, accepted, dial
+}
+
+// waitForDials waits until at least count dials have been made.
+func waitForDials(t *testing.T, dials *int32, count int32) {
+	for i := 0; i < 100; i++ {
+		if atomic.LoadInt32(dials) >= count {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("only %d of %d dials were made", atomic.LoadInt32(dials), count)
+}
+
+// waitForIdle waits until the pool has count idle connections.
+func waitForIdle(t *testing.T, pool *ConnPool, count int) {
+	for i := 0; i < 100; i++ {
+		pool.lock.Lock()
+		idle := len(pool.idle)
+		pool.lock.Unlock()
+		if idle >= count {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("pool did not reach %d idle connections", count)
+}
+
+// TestPoolWarmConnections tests that connections are dialed ahead of time
+// and replaced after they are used.
+func TestPoolWarmConnections(t *testing.T) {
+	var dials int32
+	ln, _, dial := startPoolServer(t, &dials)
+	defer ln.Close()
+
+	pool := NewConnPool(PoolConfig{Size: 2, MaxIdle: time.Minute}, dial)
+	defer pool.Close()
+	waitForIdle(t, pool, 2)
+
+	conn, err := pool.Get()
+	if err != nil {
+		t.Fatal("Get failed:", err)
+	}
+	defer conn.Close()
+
+	// The connection came from the pool, which is then refilled.
+	waitForDials(t, &dials, 3)
+	waitForIdle(t, pool, 2)
+}
+
+// TestPoolKeepsData tests that idle connections are not read from, so that
+// data sent by the server before a connection is used is not lost.
+func TestPoolKeepsData(t *testing.T) {
+	var dials int32
+	ln, accepted, dial := startPoolServer(t, &dials)
+	defer ln.Close()
+
+	pool := NewConnPool(PoolConfig{Size: 1, MaxIdle: time.Minute, CheckInterval: time.Millisecond}, dial)
+	defer pool.Close()
+	waitForIdle(t, pool, 1)
+
+	server := <-accepted
+	defer server.Close()
+	if _, err := server.Write([]byte("hi")); err != nil {
+		t.Fatal("write failed:", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	conn, err := pool.Get()
+	if err != nil {
+		t.Fatal("Get failed:", err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 2)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "hi" {
+		t.Errorf("read %q, %v, expected \"hi\"", buf, err)
+	}
+}
+
+// TestClosePools tests that the idle connections of pools are closed on
+// shutdown.
+func TestClosePools(t *testing.T) {
+	var dials int32
+	ln, accepted, dial := startPoolServer(t, &dials)
+	defer ln.Close()
+
+	SetPoolConfig(PoolConfig{Size: 1, MaxIdle: time.Minute})
+	defer SetPoolConfig(PoolConfig{})
+
+	conn, err := DialPooled("test", dial)
+	if err != nil {
+		t.Fatal("DialPooled failed:", err)
+	}
+	defer conn.Close()
+	waitForDials(t, &dials, 2)
+	<-accepted
+	idle := <-accepted
+	defer idle.Close()
+
+	ClosePools()
+
+	_ = idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = idle.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("idle connection was not closed:", err)
+	}
+}
+
+// TestPoolMaxIdle tests that expired connections are replaced.
+func TestPoolMaxIdle(t *testing.T) {
+	var dials int32
+	ln, _, dial := startPoolServer(t, &dials)
+	defer ln.Close()
+
+	pool := NewConnPool(PoolConfig{Size: 1, MaxIdle: 20 * time.Millisecond, CheckInterval: 10 * time.Millisecond}, dial)
+	defer pool.Close()
+
+	waitForDials(t, &dials, 3)
+}
+
+// TestPoolRetriesClosedConnections tests that a pooled connection that the
+// server closed while it was idle is dialed again, and that the data written
+// to it is sent over the new connection.
+func TestPoolRetriesClosedConnections(t *testing.T) {
+	var dials int32
+	ln, accepted, dial := startPoolServer(t, &dials)
+	defer ln.Close()
+
+	pool := NewConnPool(PoolConfig{Size: 1, MaxIdle: time.Minute}, dial)
+	defer pool.Close()
+	waitForIdle(t, pool, 1)
+
+	// The server drops the idle connection, as on its handshake timeout,
+	// and echoes over the others.
+	idle := <-accepted
+	_ = idle.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case server := <-accepted:
+				go func() {
+					defer server.Close()
+					_, _ = io.Copy(server, server)
+				}()
+			case <-done:
+				return
+			}
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	conn, err := pool.Get()
+	if err != nil {
+		t.Fatal("Get failed:", err)
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal("write failed:", err)
+	}
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("read %q, %v, expected \"ping\"", buf, err)
+	}
+}
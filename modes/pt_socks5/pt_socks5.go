@@ -30,19 +30,23 @@
 package pt_socks5
 
 import (
-	"github.com/OperatorFoundation/obfs4/common/log"
-	commonLog "github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/socks5"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
 	"github.com/OperatorFoundation/shapeshifter-ipc/v2"
 
-	"golang.org/x/net/proxy"
 	"net"
 	"net/url"
 )
 
 func ClientSetup(socksAddr string, ptClientProxy *url.URL, names []string, options string) (launched bool) {
+	limits, err := modes.ClientRateLimits(options)
+	if err != nil {
+		log.Errorf("%s", err)
+		return false
+	}
+
 	// Launch each of the client listeners.
 	for _, name := range names {
 		ln, err := net.Listen("tcp", socksAddr)
@@ -51,7 +55,7 @@ func ClientSetup(socksAddr string, ptClientProxy *url.URL, names []string, optio
 			continue
 		}
 
-		go clientAcceptLoop(name, ln, ptClientProxy, options)
+		go clientAcceptLoop(name, ln, ptClientProxy, options, limits)
 		pt.Cmethod(name, socks5.Version(), ln.Addr())
 
 		log.Infof("%s - registered listener: %s", name, ln.Addr())
@@ -63,126 +67,142 @@ func ClientSetup(socksAddr string, ptClientProxy *url.URL, names []string, optio
 	return
 }
 
-func clientAcceptLoop(name string, ln net.Listener, proxyURI *url.URL, options string) {
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			if e, ok := err.(net.Error); ok && !e.Temporary() {
-				log.Errorf("serverAcceptLoop failed")
-				_ = ln.Close()
-				return
-			}
-			continue
-		}
-		go clientHandler(name, conn, proxyURI, options)
+func clientAcceptLoop(name string, ln net.Listener, proxyURI *url.URL, options string, limits modes.RateLimits) {
+	err := modes.AcceptSessions(name, ln, func(conn net.Conn) {
+		clientHandler(name, conn, proxyURI, options, ln.Addr().String(), limits)
+	}, rejectClient)
+	log.Errorf("clientAcceptLoop failed: %s", err)
+	_ = ln.Close()
+}
+
+// maxRejections bounds how many clients over the session limits are sent a
+// SOCKS reply at the same time.  Any more are reset.
+const maxRejections = 64
+
+var rejections = make(chan struct{}, maxRejections)
+
+// rejectClient completes the SOCKS handshake of a client over the session
+// limits, to tell it that the connection is not allowed.
+func rejectClient(conn net.Conn) {
+	select {
+	case rejections <- struct{}{}:
+	default:
+		modes.ResetConn(conn)
+		return
 	}
+
+	go func() {
+		defer func() { <-rejections }()
+
+		if socksReq, err := socks5.Handshake(conn, false); err == nil {
+			_ = socksReq.Reply(socks5.ReplyConnectionNotAllowed)
+		}
+		_ = conn.Close()
+	}()
 }
 
-func clientHandler(name string, conn net.Conn, proxyURI *url.URL, options string) {
+func clientHandler(name string, conn net.Conn, proxyURI *url.URL, options string, listener string, limits modes.RateLimits) {
 	var needOptions = options == ""
+	session := modes.NewSessionID()
 
 	// Read the client's SOCKS handshake.
 	socksReq, err := socks5.Handshake(conn, needOptions)
 	if err != nil {
-		log.Errorf("%s - client failed socks handshake: %s", name, err)
+		modes.SessionLogger(name, session, "").Errorf("client failed socks handshake: %s", err)
 		conn.Close()
 		return
 	}
-	addrStr := commonLog.ElideAddr(socksReq.Target)
+	logger := modes.SessionLogger(name, session, socksReq.Target)
 
-	var dialer proxy.Dialer = proxy.Direct
+	// Obtain the proxy dialer if any, and create the outgoing TCP connection.
+	dialer, err := modes.ProxyDialer(proxyURI, options)
+	if err != nil {
+		// This should basically never happen, since config protocol
+		// verifies this.
+		logger.Errorf("failed to obtain proxy dialer: %s", log.ElideError(err))
+		_ = socksReq.Reply(socks5.ReplyGeneralFailure)
+		conn.Close()
+		return
+	}
 
 	// Deal with arguments.
-	transport, argsToDialerErr := pt_extras.ArgsToDialer(socksReq.Target, name, options, dialer)
-	if argsToDialerErr != nil {
-		log.Errorf("Error creating a transport with the provided options: %s", options)
-		log.Errorf("Error: %s", argsToDialerErr)
+	connOptions, mergeErr := pt_extras.MergeOptions(options, socksReq.Args)
+	if mergeErr != nil {
+		logger.Errorf("could not merge SOCKS arguments with transport options: %s", mergeErr)
+		_ = socksReq.Reply(socks5.ReplyGeneralFailure)
 		conn.Close()
 		return
 	}
-	// Obtain the proxy dialer if any, and create the outgoing TCP connection.
-	if proxyURI != nil {
-		var proxyErr error
-		dialer, proxyErr = proxy.FromURL(proxyURI, proxy.Direct)
-		if proxyErr != nil {
-			// This should basically never happen, since config protocol
-			// verifies this.
-			log.Errorf("%s(%s) - failed to obtain proxy dialer: %s", name, addrStr, commonLog.ElideError(err))
-			_ = socksReq.Reply(socks5.ReplyGeneralFailure)
-			conn.Close()
-			return
-		}
-	}
+	dialer = modes.CaptureDialer(dialer, session, connOptions)
 
-	remote, err2 := transport.Dial()
+	transport, argsToDialerErr := pt_extras.ArgsToDialer(socksReq.Target, name, connOptions, dialer)
+	if argsToDialerErr != nil {
+		// The options are not logged, since they hold the transport's keys.
+		logger.Errorf("failed to create %s transport: %s", name, log.ElideError(argsToDialerErr))
+		_ = socksReq.Reply(socks5.ReplyGeneralFailure)
+		conn.Close()
+		return
+	}
+	remote, err2 := modes.DialTransport(name, session, socksReq.Target, connOptions, transport.Dial)
 	if err2 != nil {
-		log.Errorf("%s(%s) - outgoing connection failed: %s", name, addrStr, commonLog.ElideError(err2))
+		logger.Errorf("outgoing connection failed: %s", log.ElideError(err2))
 		_ = socksReq.Reply(socks5.ErrorToReplyCode(err2))
 		conn.Close()
 		return
 	}
+	if err = modes.WriteClientDestination(remote); err != nil {
+		logger.Errorf("failed to send destination: %s", log.ElideError(err))
+		_ = socksReq.Reply(socks5.ReplyGeneralFailure)
+		remote.Close()
+		conn.Close()
+		return
+	}
 	err = socksReq.Reply(socks5.ReplySucceeded)
 	if err != nil {
-		log.Errorf("%s(%s) - SOCKS reply failed: %s", name, addrStr, commonLog.ElideError(err))
+		logger.Errorf("SOCKS reply failed: %s", log.ElideError(err))
 		conn.Close()
 		return
 	}
 
-	if err = modes.CopyLoop(conn, remote); err != nil {
-		log.Errorf("%s(%s) - closed connection: %s", name, addrStr, commonLog.ElideError(err))
+	// Clients that authenticate with a username are rate limited by it.
+	identity := socksReq.Username
+	if identity == "" {
+		identity = modes.ClientIdentity(conn.RemoteAddr())
+	}
+	limiter := modes.NewRateLimiter(name, listener, identity, limits)
+	appConn := modes.CaptureConn(conn, session, modes.CaptureApplication)
+	if err = modes.CopyLoop(modes.RateLimitConn(appConn, limiter), remote); err != nil {
+		logger.Errorf("closed connection: %s", log.ElideError(err))
 	} else {
-		log.Infof("%s(%s) - closed connection", name, addrStr)
+		logger.Infof("closed connection")
 	}
 
 	return
 }
 
 func ServerSetup(ptServerInfo pt.ServerInfo, stateDir string, options string) (launched bool) {
-	for _, bindaddr := range ptServerInfo.Bindaddrs {
-		name := bindaddr.MethodName
-
-		// Deal with arguments.
-		listen, parseError := pt_extras.ArgsToListener(name, stateDir, options)
-		if parseError != nil {
-			return false
-		}
-
-		go func() {
-			for {
-				transportLn := listen(bindaddr.Addr.String())
-				log.Infof("%s - registered listener: %s", name, log.ElideAddr(bindaddr.Addr.String()))
-				modes.ServerAcceptLoop(name, transportLn, &ptServerInfo, serverHandler)
-				transportLnErr := transportLn.Close()
-				if transportLnErr != nil {
-					log.Errorf("Listener close error: %s", transportLnErr.Error())
-				}
-			}
-		}()
-
-		launched = true
-	}
-	pt.SmethodsDone()
-
-	return
+	return modes.ServerSetupTCP(ptServerInfo, stateDir, options, serverHandler)
 }
 
 func serverHandler(name string, remote net.Conn, info *pt.ServerInfo) {
 
-	addrStr := log.ElideAddr(remote.RemoteAddr().String())
-	log.Infof("%s(%s) - new connection", name, addrStr)
+	session := modes.SessionID(remote)
+	logger := modes.SessionLogger(name, session, remote.RemoteAddr().String())
+	logger.Infof("new connection")
 
-	// Connect to the orport.
-	orConn, err := pt.DialOr(info, remote.RemoteAddr().String(), name)
+	// Connect to the orport, or the client's destination in exit mode.
+	orConn, err := modes.DialServer("tcp", name, remote, info)
 	if err != nil {
-		log.Errorf("%s(%s) - failed to connect to ORPort: %s", name, addrStr, log.ElideError(err))
+		logger.Errorf("failed to connect to ORPort: %s", log.ElideError(err))
 		remote.Close()
 		return
 	}
+	orConn = modes.CaptureConn(orConn, session, modes.CaptureApplication)
 
 	if err = modes.CopyLoop(orConn, remote); err != nil {
-		log.Warnf("%s(%s) - closed connection: %s", name, addrStr, log.ElideError(err))
+		logger.Warnf("closed connection: %s", log.ElideError(err))
 	} else {
-		log.Infof("%s(%s) - closed connection", name, addrStr)
+		logger.Infof("closed connection")
 	}
 
 	return
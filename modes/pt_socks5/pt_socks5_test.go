@@ -0,0 +1,256 @@
+package pt_socks5
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/testutil"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
+)
+
+// startHTTPProxy starts a stand-in HTTP CONNECT proxy and counts the tunnels
+// it opens.
+func startHTTPProxy(t *testing.T, tunnels *int32) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("could not start proxy:", err)
+	}
+
+	go func() {
+		for {
+			conn, acceptErr := ln.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+
+				reader := bufio.NewReader(conn)
+				req, reqErr := http.ReadRequest(reader)
+				if reqErr != nil || req.Method != http.MethodConnect {
+					return
+				}
+
+				upstream, dialErr := net.Dial("tcp", req.Host)
+				if dialErr != nil {
+					_, _ = conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+					return
+				}
+				defer upstream.Close()
+
+				atomic.AddInt32(tunnels, 1)
+				_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+
+				go func() {
+					_, _ = io.Copy(upstream, reader)
+				}()
+				_, _ = io.Copy(conn, upstream)
+			}()
+		}
+	}()
+
+	return ln
+}
+
+// socksConnect performs a SOCKS5 CONNECT, authenticating with uname and a
+// NUL password as tor does if uname is not empty.
+func socksConnect(conn net.Conn, target string, uname string) error {
+	method := byte(0x00)
+	if uname != "" {
+		method = 0x02
+	}
+	if _, err := conn.Write([]byte{0x05, 0x01, method}); err != nil {
+		return err
+	}
+	methodReply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, methodReply); err != nil {
+		return err
+	}
+	if methodReply[1] != method {
+		return fmt.Errorf("server chose method %d", methodReply[1])
+	}
+
+	if uname != "" {
+		auth := append([]byte{0x01, byte(len(uname))}, uname...)
+		if _, err := conn.Write(append(auth, 0x01, 0x00)); err != nil {
+			return err
+		}
+		authReply := make([]byte, 2)
+		if _, err := io.ReadFull(conn, authReply); err != nil {
+			return err
+		}
+		if authReply[1] != 0x00 {
+			return errors.New("authentication failed")
+		}
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", target)
+	if err != nil {
+		return err
+	}
+	request := []byte{0x05, 0x01, 0x00, 0x01}
+	request = append(request, addr.IP.To4()...)
+	port := make([]byte, 2)
+	binary.BigEndian.PutUint16(port, uint16(addr.Port))
+	request = append(request, port...)
+	if _, err = conn.Write(request); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 10)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return io.ErrUnexpectedEOF
+	}
+
+	return nil
+}
+
+// TestClientHandlerUsesProxy tests that socks5 mode reaches the transport
+// server through the configured upstream proxy.
+func TestClientHandlerUsesProxy(t *testing.T) {
+	serverLn, serverAddr := testutil.StartObfs2Echo(t)
+	defer serverLn.Close()
+
+	var tunnels int32
+	proxyLn := startHTTPProxy(t, &tunnels)
+	defer proxyLn.Close()
+
+	proxyURI, err := url.Parse("http://" + proxyLn.Addr().String())
+	if err != nil {
+		t.Fatal("could not parse proxy URI:", err)
+	}
+
+	socksLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("could not start SOCKS listener:", err)
+	}
+	defer socksLn.Close()
+	go clientAcceptLoop("obfs2", socksLn, proxyURI, "", modes.RateLimits{})
+
+	conn, err := net.Dial("tcp", socksLn.Addr().String())
+	if err != nil {
+		t.Fatal("could not connect to SOCKS listener:", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if err = socksConnect(conn, serverAddr, ""); err != nil {
+		t.Fatal("SOCKS CONNECT failed:", err)
+	}
+
+	message := []byte("hello through the proxy")
+	if _, err = conn.Write(message); err != nil {
+		t.Fatal("write failed:", err)
+	}
+	echo := make([]byte, len(message))
+	if _, err = io.ReadFull(conn, echo); err != nil {
+		t.Fatal("read failed:", err)
+	}
+	if !bytes.Equal(message, echo) {
+		t.Error("unexpected echo:", string(echo))
+	}
+
+	if atomic.LoadInt32(&tunnels) != 1 {
+		t.Error("expected one proxy tunnel, got", atomic.LoadInt32(&tunnels))
+	}
+}
+
+// TestRejectClient tests that a client over the session limits is told that
+// the connection is not allowed.
+func TestRejectClient(t *testing.T) {
+	client, conn := net.Pipe()
+	defer client.Close()
+
+	rejectClient(conn)
+
+	if _, err := client.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		t.Fatal("write failed:", err)
+	}
+	methodReply := make([]byte, 2)
+	if _, err := io.ReadFull(client, methodReply); err != nil {
+		t.Fatal("read failed:", err)
+	}
+	if _, err := client.Write([]byte{0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0x00, 0x50}); err != nil {
+		t.Fatal("write failed:", err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal("read failed:", err)
+	}
+	if reply[1] != 0x02 {
+		t.Errorf("got reply code %d, expected connection not allowed", reply[1])
+	}
+}
+
+// TestClientHandlerRFC1929Args tests that transport arguments sent as the
+// SOCKS username and password, as tor sends them, reach the transport.  The
+// obfs4 client cannot connect without the server's cert.
+func TestClientHandlerRFC1929Args(t *testing.T) {
+	stateDir := t.TempDir()
+	listen, err := pt_extras.ArgsToListener("obfs4", stateDir, "{}")
+	if err != nil {
+		t.Fatal("could not create obfs4 server:", err)
+	}
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("could not find a free port:", err)
+	}
+	serverAddr := probe.Addr().String()
+	_ = probe.Close()
+	serverLn := listen(serverAddr)
+	if serverLn == nil {
+		t.Fatal("could not start obfs4 server")
+	}
+	defer serverLn.Close()
+	go testutil.Echo(serverLn)
+
+	args, err := pt_extras.ListenerArgs("obfs4", stateDir)
+	if err != nil {
+		t.Fatal("could not read the obfs4 client arguments:", err)
+	}
+
+	socksLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("could not start SOCKS listener:", err)
+	}
+	defer socksLn.Close()
+	go clientAcceptLoop("obfs4", socksLn, nil, "", modes.RateLimits{})
+
+	conn, err := net.Dial("tcp", socksLn.Addr().String())
+	if err != nil {
+		t.Fatal("could not connect to SOCKS listener:", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	uname := fmt.Sprintf("cert=%s;iat-mode=%s", args["cert"], args["iat-mode"])
+	if err = socksConnect(conn, serverAddr, uname); err != nil {
+		t.Fatal("SOCKS CONNECT failed:", err)
+	}
+
+	message := []byte("hello with arguments")
+	if _, err = conn.Write(message); err != nil {
+		t.Fatal("write failed:", err)
+	}
+	echo := make([]byte, len(message))
+	if _, err = io.ReadFull(conn, echo); err != nil {
+		t.Fatal("read failed:", err)
+	}
+	if !bytes.Equal(message, echo) {
+		t.Error("unexpected echo:", string(echo))
+	}
+}
@@ -0,0 +1,423 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
+)
+
+// rateLimitOptionsKey is the key in the transport options that overrides the
+// rate limits for a transport, for example
+// {"rateLimit": {"transport": "10M", "listener": "5M", "client": "512K"}}.
+// As with "mux", client options contain it directly and server options
+// contain it in the options for each transport.
+const rateLimitOptionsKey = "rateLimit"
+
+// RateLimits are the bandwidth limits, in bytes per second, for the traffic
+// relayed in both directions.  A zero value disables the limit.
+type RateLimits struct {
+	// Global limits all traffic of the dispatcher.
+	Global int64
+
+	// Transport limits the traffic of each transport.
+	Transport int64
+
+	// Listener limits the traffic of each listener.
+	Listener int64
+
+	// Client limits the traffic of each client, identified by its source
+	// address, or by its username in SOCKS5 mode.
+	Client int64
+}
+
+var rateLimits RateLimits
+var globalBucket *tokenBucket
+var rateBuckets = make(map[string]*sharedBucket)
+var rateBucketsLock sync.Mutex
+
+// SetRateLimits configures the rate limits for transports that do not
+// override them in their options.  It must be called before any listeners
+// are started.
+func SetRateLimits(limits RateLimits) {
+	rateLimits = limits
+	globalBucket = nil
+	if limits.Global > 0 {
+		globalBucket = newRateBucket(limits.Global)
+	}
+}
+
+// ParseRate parses a rate in bytes per second, with an optional K, M or G
+// suffix for multiples of 1024.
+func ParseRate(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	if value != "" {
+		switch value[len(value)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			value = value[:len(value)-1]
+		}
+	}
+
+	rate, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || rate < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+
+	return rate * multiplier, nil
+}
+
+// ClientRateLimits returns the rate limits for a client transport, from the
+// defaults and the client transport options.
+func ClientRateLimits(options string) (RateLimits, error) {
+	return parseRateLimits(clientOption(options, rateLimitOptionsKey))
+}
+
+// ServerRateLimits returns the rate limits for the named server transport,
+// from the defaults and the server transport options.
+func ServerRateLimits(name string, options string) (RateLimits, error) {
+	return parseRateLimits(serverOption(name, options, rateLimitOptionsKey))
+}
+
+func parseRateLimits(raw json.RawMessage) (RateLimits, error) {
+	limits := rateLimits
+	if raw == nil {
+		return limits, nil
+	}
+
+	var args map[string]string
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return limits, fmt.Errorf("could not parse rateLimit options")
+	}
+
+	for key, value := range args {
+		rate, err := ParseRate(value)
+		if err != nil {
+			return limits, err
+		}
+
+		switch key {
+		case "transport":
+			limits.Transport = rate
+		case "listener":
+			limits.Listener = rate
+		case "client":
+			limits.Client = rate
+		default:
+			return limits, fmt.Errorf("unknown rate limit %q", key)
+		}
+	}
+
+	return limits, nil
+}
+
+// tokenBucket allows an average rate of bytes per second, with bursts of up
+// to burst bytes.  Bytes may be taken before they are available, and the debt
+// is paid by waiting.
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64, burst int64) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// newRateBucket returns a bucket for a rate limit, which allows bursts of one
+// second of traffic, or of the largest packet for rates below
+// PacketBufferSize, so that packets larger than the rate are delayed or
+// dropped until there is room for them rather than always dropped.
+func newRateBucket(rate int64) *tokenBucket {
+	burst := rate
+	if burst < PacketBufferSize {
+		burst = PacketBufferSize
+	}
+
+	return newTokenBucket(rate, burst)
+}
+
+func (bucket *tokenBucket) refill(now time.Time) {
+	bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.rate
+	if bucket.tokens > bucket.burst {
+		bucket.tokens = bucket.burst
+	}
+	bucket.last = now
+}
+
+// reserve takes n bytes from the bucket and returns how long to wait before
+// using them.
+func (bucket *tokenBucket) reserve(n int) time.Duration {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+
+	bucket.refill(time.Now())
+	bucket.tokens -= float64(n)
+	if bucket.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+}
+
+// available reports whether n bytes can be taken without waiting.
+func (bucket *tokenBucket) available(n int) bool {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+
+	bucket.refill(time.Now())
+	return bucket.tokens >= float64(n)
+}
+
+// sharedBucket is a token bucket for a transport, listener or client, which
+// is removed when no connection uses it.
+type sharedBucket struct {
+	*tokenBucket
+	key  string
+	refs int
+}
+
+func acquireBucket(key string, rate int64) *sharedBucket {
+	rateBucketsLock.Lock()
+	defer rateBucketsLock.Unlock()
+
+	bucket, ok := rateBuckets[key]
+	if !ok {
+		bucket = &sharedBucket{tokenBucket: newRateBucket(rate), key: key}
+		rateBuckets[key] = bucket
+	}
+	bucket.refs++
+
+	return bucket
+}
+
+func releaseBucket(bucket *sharedBucket) {
+	rateBucketsLock.Lock()
+	defer rateBucketsLock.Unlock()
+
+	bucket.refs--
+	if bucket.refs == 0 {
+		delete(rateBuckets, bucket.key)
+	}
+}
+
+// limit is one of the buckets that a RateLimiter applies, with the number
+// of times the connection had to wait for it or dropped a packet.
+type limit struct {
+	scope  string
+	bucket *tokenBucket
+	shared *sharedBucket
+	hits   int64
+}
+
+// RateLimiter applies the rate limits for one connection.
+type RateLimiter struct {
+	lock   sync.Mutex
+	label  string
+	limits []*limit
+	closed bool
+}
+
+// NewRateLimiter returns the rate limiter for a connection of the named
+// transport, accepted on listener from the client identified by identity.
+func NewRateLimiter(name string, listener string, identity string, limits RateLimits) *RateLimiter {
+	limiter := &RateLimiter{label: fmt.Sprintf("%s(%s)", name, log.ElideAddr(identity))}
+
+	if globalBucket != nil {
+		limiter.limits = append(limiter.limits, &limit{scope: "global", bucket: globalBucket})
+	}
+	limiter.add("transport", "transport/"+name, limits.Transport)
+	limiter.add("listener", "listener/"+listener, limits.Listener)
+	limiter.add("client", "client/"+name+"/"+identity, limits.Client)
+
+	return limiter
+}
+
+func (limiter *RateLimiter) add(scope string, key string, rate int64) {
+	if rate <= 0 {
+		return
+	}
+
+	shared := acquireBucket(key, rate)
+	limiter.limits = append(limiter.limits, &limit{scope: scope, bucket: shared.tokenBucket, shared: shared})
+}
+
+// Wait takes n bytes from every limit, and blocks until they are all
+// available.
+func (limiter *RateLimiter) Wait(n int) {
+	var wait time.Duration
+	limiter.lock.Lock()
+	for _, l := range limiter.limits {
+		if d := l.bucket.reserve(n); d > 0 {
+			l.hits++
+			if d > wait {
+				wait = d
+			}
+		}
+	}
+	limiter.lock.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Allow takes n bytes from every limit if they are all available now, and
+// reports whether it did.  It is used for packets, which are dropped rather
+// than delayed.
+func (limiter *RateLimiter) Allow(n int) bool {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	for _, l := range limiter.limits {
+		if !l.bucket.available(n) {
+			l.hits++
+			return false
+		}
+	}
+	for _, l := range limiter.limits {
+		l.bucket.reserve(n)
+	}
+
+	return true
+}
+
+// Close releases the limits and logs how often they were hit.
+func (limiter *RateLimiter) Close() {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	if limiter.closed {
+		return
+	}
+	limiter.closed = true
+
+	for _, l := range limiter.limits {
+		if l.hits > 0 {
+			log.Infof("%s - %s rate limit hit %d times", limiter.label, l.scope, l.hits)
+		}
+		if l.shared != nil {
+			releaseBucket(l.shared)
+		}
+	}
+}
+
+// RateLimitConn applies a rate limiter to the data read from and written to
+// a stream connection.  Closing the connection closes the limiter.
+func RateLimitConn(conn net.Conn, limiter *RateLimiter) net.Conn {
+	if len(limiter.limits) == 0 {
+		return conn
+	}
+
+	return &rateLimitedConn{Conn: conn, limiter: limiter}
+}
+
+// RateLimitPacketConn applies a rate limiter to a connection that carries
+// one packet per write.  Packets that exceed the limits are dropped.
+func RateLimitPacketConn(conn net.Conn, limiter *RateLimiter) net.Conn {
+	if len(limiter.limits) == 0 {
+		return conn
+	}
+
+	return &rateLimitedConn{Conn: conn, limiter: limiter, packets: true}
+}
+
+type rateLimitedConn struct {
+	net.Conn
+	limiter *RateLimiter
+	packets bool
+}
+
+func (conn *rateLimitedConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	if n > 0 {
+		conn.limiter.Wait(n)
+	}
+
+	return n, err
+}
+
+func (conn *rateLimitedConn) Write(b []byte) (int, error) {
+	if conn.packets {
+		if !conn.limiter.Allow(len(b)) {
+			return len(b), nil
+		}
+	} else {
+		conn.limiter.Wait(len(b))
+	}
+
+	return conn.Conn.Write(b)
+}
+
+func (conn *rateLimitedConn) CloseWrite() error {
+	return CloseWrite(conn.Conn)
+}
+
+func (conn *rateLimitedConn) Close() error {
+	conn.limiter.Close()
+	return conn.Conn.Close()
+}
+
+// rateLimitServerHandler wraps a server handler to apply the rate limits to
+// each connection accepted on listener.  Clients are identified by their
+// address.
+func rateLimitServerHandler(listener string, limits RateLimits, serverHandler ServerHandler) ServerHandler {
+	return func(name string, remote net.Conn, info *pt.ServerInfo) {
+		limiter := NewRateLimiter(name, listener, ClientIdentity(remote.RemoteAddr()), limits)
+		serverHandler(name, RateLimitConn(remote, limiter), info)
+	}
+}
+
+// ClientIdentity returns the host part of a client address, which
+// identifies the client for its rate limit.
+func ClientIdentity(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	return host
+}
@@ -0,0 +1,119 @@
+package modes
+
+import (
+	"testing"
+	"time"
+)
+
+// TestParseRate tests rates with and without a unit suffix.
+func TestParseRate(t *testing.T) {
+	for value, expected := range map[string]int64{
+		"0":    0,
+		"1000": 1000,
+		"512K": 512 << 10,
+		"10m":  10 << 20,
+		"1G":   1 << 30,
+	} {
+		if rate, err := ParseRate(value); err != nil || rate != expected {
+			t.Errorf("ParseRate(%q) = %d, %v, expected %d", value, rate, err, expected)
+		}
+	}
+
+	for _, value := range []string{"", "K", "fast", "-1", "1T"} {
+		if _, err := ParseRate(value); err == nil {
+			t.Errorf("ParseRate accepted %q", value)
+		}
+	}
+}
+
+// TestParseRateLimits tests the client and server forms of the rate limit
+// options.
+func TestParseRateLimits(t *testing.T) {
+	limits, err := ClientRateLimits(`{"rateLimit": {"transport": "1M", "client": "1K"}}`)
+	if err != nil || limits.Transport != 1<<20 || limits.Client != 1<<10 || limits.Listener != 0 {
+		t.Errorf("got %+v, %v", limits, err)
+	}
+
+	limits, err = ServerRateLimits("obfs2", `{"obfs2": {"rateLimit": {"listener": "2K"}}}`)
+	if err != nil || limits.Listener != 2<<10 {
+		t.Errorf("got %+v, %v", limits, err)
+	}
+
+	for _, options := range []string{
+		`{"rateLimit": {"global": "1M"}}`,
+		`{"rateLimit": {"client": "lots"}}`,
+		`{"rateLimit": "1M"}`,
+	} {
+		if _, err = ClientRateLimits(options); err == nil {
+			t.Errorf("ClientRateLimits accepted %s", options)
+		}
+	}
+}
+
+// TestTokenBucket tests that a bucket allows a burst of one second of
+// traffic, and then makes the excess wait.
+func TestTokenBucket(t *testing.T) {
+	bucket := newRateBucket(100000)
+
+	if wait := bucket.reserve(100000); wait != 0 {
+		t.Errorf("a burst of the rate waited %s", wait)
+	}
+	if bucket.available(100) {
+		t.Error("an empty bucket has bytes available")
+	}
+	if wait := bucket.reserve(50000); wait < 400*time.Millisecond || wait > 500*time.Millisecond {
+		t.Errorf("500 bytes over the rate waited %s, expected about 500ms", wait)
+	}
+}
+
+// TestRateLimiterSharing tests that connections from the same client share
+// a bucket, which is removed when the last of them closes.
+func TestRateLimiterSharing(t *testing.T) {
+	limits := RateLimits{Client: 100000}
+	first := NewRateLimiter("test", "listener", "192.0.2.1", limits)
+	second := NewRateLimiter("test", "listener", "192.0.2.1", limits)
+	other := NewRateLimiter("test", "listener", "192.0.2.2", limits)
+
+	if !first.Allow(100000) {
+		t.Error("the first packet was dropped")
+	}
+	if second.Allow(100) {
+		t.Error("a second connection from the same client was not limited")
+	}
+	if !other.Allow(100) {
+		t.Error("a different client was limited")
+	}
+
+	first.Close()
+	second.Close()
+	other.Close()
+
+	rateBucketsLock.Lock()
+	defer rateBucketsLock.Unlock()
+	if len(rateBuckets) != 0 {
+		t.Errorf("%d buckets were not removed", len(rateBuckets))
+	}
+}
+
+// TestRateLimiterLargePackets tests that packets larger than the rate are
+// throttled rather than always dropped.
+func TestRateLimiterLargePackets(t *testing.T) {
+	limiter := NewRateLimiter("test", "listener", "192.0.2.1", RateLimits{Client: 1000})
+	defer limiter.Close()
+
+	if !limiter.Allow(60000) {
+		t.Fatal("a packet larger than the rate was dropped")
+	}
+	if limiter.Allow(60000) {
+		t.Error("a second large packet was not limited")
+	}
+
+	// Once the bucket has refilled, large packets are allowed again.
+	bucket := limiter.limits[0].bucket
+	bucket.lock.Lock()
+	bucket.last = bucket.last.Add(-time.Minute)
+	bucket.lock.Unlock()
+	if !limiter.Allow(60000) {
+		t.Error("a large packet was dropped after the bucket refilled")
+	}
+}
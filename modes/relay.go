@@ -0,0 +1,196 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+)
+
+// lingerTimeout bounds how long Relay keeps copying in one direction after
+// the other direction has finished and been half-closed.
+var lingerTimeout = 30 * time.Second
+
+var errHalfCloseUnsupported = errors.New("connection does not support half-close")
+
+// RelayResult reports what Relay copied in each direction, and why each
+// direction stopped.  Errors caused by Relay closing the connections itself
+// are not reported.
+type RelayResult struct {
+	ClientToServer    int64
+	ServerToClient    int64
+	ClientToServerErr error
+	ServerToClientErr error
+}
+
+// Err returns the first error of either direction, or nil.
+func (result RelayResult) Err() error {
+	if result.ClientToServerErr != nil {
+		return result.ClientToServerErr
+	}
+
+	return result.ServerToClientErr
+}
+
+// CopyLoop relays data between client and server until both directions are
+// finished, then closes both connections.
+func CopyLoop(client net.Conn, server net.Conn) error {
+	return Relay(client, server).Err()
+}
+
+// Relay copies data between client and server in both directions.  When one
+// direction reaches EOF, the write side of its destination is closed if it
+// supports half-close, so that the peer sees the EOF too, and the other
+// direction may continue until it reaches EOF as well or for up to
+// lingerTimeout.  Transport connections cannot be half-closed, so their peer
+// only sees the EOF when both connections are closed.  If either direction
+// fails, both connections are closed at once.  Relay returns after both
+// directions have stopped, and always closes both connections.
+func Relay(client net.Conn, server net.Conn) RelayResult {
+	var result RelayResult
+	if client == nil || server == nil {
+		result.ClientToServerErr = errors.New("relay has a nil connection")
+		if client != nil {
+			_ = client.Close()
+		}
+		if server != nil {
+			_ = server.Close()
+		}
+		return result
+	}
+
+	// Any handshake deadline no longer applies once relaying starts.
+	_ = client.SetReadDeadline(time.Time{})
+	_ = server.SetReadDeadline(time.Time{})
+
+	var watchdog <-chan time.Time
+	var activity *activityTracker
+	idleTimeout := idleTimeoutOf(client, server)
+	if idleTimeout > 0 {
+		activity = newActivityTracker()
+		client = &activityConn{client, activity}
+		server = &activityConn{server, activity}
+
+		ticker := time.NewTicker(idleCheckInterval(idleTimeout))
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
+
+	type copyResult struct {
+		clientToServer bool
+		n              int64
+		err            error
+	}
+
+	// The channel has room for both results, so the copying goroutines never
+	// block on it and always exit once their copy returns.
+	results := make(chan copyResult, 2)
+	copyHalf := func(dst net.Conn, src net.Conn, clientToServer bool) {
+		n, err := copyBuffered(dst, src)
+		results <- copyResult{clientToServer, n, err}
+	}
+	go copyHalf(server, client, true)
+	go copyHalf(client, server, false)
+
+	closed := false
+	closeBoth := func() {
+		if !closed {
+			closed = true
+			_ = client.Close()
+			_ = server.Close()
+		}
+	}
+
+	var linger <-chan time.Time
+	for remaining := 2; remaining > 0; {
+		select {
+		case r := <-results:
+			remaining--
+
+			dst := client
+			if r.clientToServer {
+				dst = server
+				result.ClientToServer = r.n
+			} else {
+				result.ServerToClient = r.n
+			}
+
+			if closed {
+				continue
+			}
+
+			if r.err != nil {
+				if r.clientToServer {
+					result.ClientToServerErr = r.err
+				} else {
+					result.ServerToClientErr = r.err
+				}
+				closeBoth()
+				continue
+			}
+
+			if remaining == 0 {
+				continue
+			}
+
+			_ = CloseWrite(dst)
+			if lingerTimeout <= 0 {
+				closeBoth()
+				continue
+			}
+
+			timer := time.NewTimer(lingerTimeout)
+			defer timer.Stop()
+			linger = timer.C
+		case <-linger:
+			log.Debugf("closing half-closed connection after %s", lingerTimeout)
+			closeBoth()
+		case <-watchdog:
+			if activity.idleFor() >= idleTimeout {
+				log.Infof("closing idle connection after %s", idleTimeout)
+				closeBoth()
+				watchdog = nil
+			}
+		}
+	}
+
+	closeBoth()
+
+	return result
+}
+
+// CloseWrite closes the write side of conn, if it supports half-close.
+// Connections that wrap another connection can implement CloseWrite by
+// calling this on the wrapped connection.
+func CloseWrite(conn net.Conn) error {
+	if halfCloser, ok := conn.(interface{ CloseWrite() error }); ok {
+		return halfCloser.CloseWrite()
+	}
+
+	return errHalfCloseUnsupported
+}
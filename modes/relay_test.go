@@ -0,0 +1,214 @@
+package modes
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t testing.TB) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen failed:", err)
+	}
+	defer ln.Close()
+
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("dial failed:", err)
+	}
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatal("accept failed:", err)
+	}
+
+	return dialed, accepted
+}
+
+// relayAsync runs Relay in the background and returns its result channel.
+func relayAsync(client net.Conn, server net.Conn) chan RelayResult {
+	done := make(chan RelayResult, 1)
+	go func() {
+		done <- Relay(client, server)
+	}()
+
+	return done
+}
+
+func waitRelay(t *testing.T, done chan RelayResult) RelayResult {
+	select {
+	case result := <-done:
+		return result
+	case <-time.After(5 * time.Second):
+		t.Fatal("Relay did not return")
+		return RelayResult{}
+	}
+}
+
+// TestRelayHalfClose tests that an EOF from the client reaches the server,
+// and that the server can still respond afterwards.
+func TestRelayHalfClose(t *testing.T) {
+	app, client := tcpPair(t)
+	server, backend := tcpPair(t)
+	defer app.Close()
+	defer backend.Close()
+
+	done := relayAsync(client, server)
+
+	if _, err := app.Write([]byte("request")); err != nil {
+		t.Fatal("write failed:", err)
+	}
+	if err := app.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal("CloseWrite failed:", err)
+	}
+
+	request, err := ioutil.ReadAll(backend)
+	if err != nil || string(request) != "request" {
+		t.Fatalf("backend received %q, %v", request, err)
+	}
+	if _, err = backend.Write([]byte("response")); err != nil {
+		t.Fatal("write failed:", err)
+	}
+	_ = backend.Close()
+
+	response, err := ioutil.ReadAll(app)
+	if err != nil || string(response) != "response" {
+		t.Fatalf("app received %q, %v", response, err)
+	}
+
+	result := waitRelay(t, done)
+	if result.ClientToServer != 7 || result.ServerToClient != 8 || result.Err() != nil {
+		t.Errorf("got %+v, expected 7 and 8 bytes without errors", result)
+	}
+}
+
+// TestRelayWithoutHalfClose tests that the server can still respond after
+// the client half-closes, when the connection to the server cannot be
+// half-closed, as is the case for transport connections.
+func TestRelayWithoutHalfClose(t *testing.T) {
+	app, client := tcpPair(t)
+	server, backend := net.Pipe()
+	defer app.Close()
+	defer backend.Close()
+
+	done := relayAsync(client, server)
+
+	if _, err := app.Write([]byte("request")); err != nil {
+		t.Fatal("write failed:", err)
+	}
+	if err := app.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal("CloseWrite failed:", err)
+	}
+
+	request := make([]byte, 7)
+	if _, err := io.ReadFull(backend, request); err != nil || string(request) != "request" {
+		t.Fatalf("backend received %q, %v", request, err)
+	}
+	if _, err := backend.Write([]byte("response")); err != nil {
+		t.Fatal("write failed:", err)
+	}
+	_ = backend.Close()
+
+	response, err := ioutil.ReadAll(app)
+	if err != nil || string(response) != "response" {
+		t.Fatalf("app received %q, %v", response, err)
+	}
+
+	result := waitRelay(t, done)
+	if result.ClientToServer != 7 || result.ServerToClient != 8 || result.Err() != nil {
+		t.Errorf("got %+v, expected 7 and 8 bytes without errors", result)
+	}
+}
+
+// TestRelayLinger tests that Relay gives up on the remaining direction after
+// the linger timeout.
+func TestRelayLinger(t *testing.T) {
+	saved := lingerTimeout
+	lingerTimeout = 50 * time.Millisecond
+	defer func() { lingerTimeout = saved }()
+
+	app, client := tcpPair(t)
+	server, backend := tcpPair(t)
+	defer app.Close()
+	defer backend.Close()
+
+	done := relayAsync(client, server)
+	if err := app.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal("CloseWrite failed:", err)
+	}
+
+	waitRelay(t, done)
+}
+
+// TestRelayNilConnection tests that Relay reports a missing connection and
+// closes the other one.
+func TestRelayNilConnection(t *testing.T) {
+	app, client := net.Pipe()
+	defer app.Close()
+
+	if err := CopyLoop(client, nil); err == nil {
+		t.Error("CopyLoop accepted a nil connection")
+	}
+	if _, err := client.Write([]byte("x")); err == nil {
+		t.Error("the other connection was not closed")
+	}
+}
+
+const benchmarkSessionSize = 1 << 20
+
+// benchmarkRelay measures relaying a session of benchmarkSessionSize bytes
+// from the client to the server, with connections made by wrap.
+func benchmarkRelay(b *testing.B, wrap func(net.Conn) net.Conn) {
+	data := make([]byte, 64*1024)
+	b.SetBytes(benchmarkSessionSize)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		app, client := tcpPair(b)
+		server, backend := tcpPair(b)
+		b.StartTimer()
+
+		done := relayAsync(wrap(client), wrap(server))
+		go func() {
+			for sent := 0; sent < benchmarkSessionSize; sent += len(data) {
+				if _, err := app.Write(data); err != nil {
+					return
+				}
+			}
+			_ = app.(*net.TCPConn).CloseWrite()
+		}()
+
+		if n, err := io.Copy(ioutil.Discard, backend); n != benchmarkSessionSize || err != nil {
+			b.Fatalf("backend received %d bytes, %v", n, err)
+		}
+		_ = backend.Close()
+		<-done
+		_ = app.Close()
+	}
+}
+
+// BenchmarkRelayTCP benchmarks relaying between raw TCP connections, which
+// are spliced on Linux.
+func BenchmarkRelayTCP(b *testing.B) {
+	benchmarkRelay(b, func(conn net.Conn) net.Conn { return conn })
+}
+
+// BenchmarkRelayBuffered benchmarks relaying between wrapped connections,
+// which are copied through pooled buffers.
+func BenchmarkRelayBuffered(b *testing.B) {
+	benchmarkRelay(b, func(conn net.Conn) net.Conn { return wrappedConn{conn} })
+}
+
+// wrappedConn hides the type of the connection it wraps, like the transport
+// connections that the modes relay.
+type wrappedConn struct {
+	net.Conn
+}
+
+func (conn wrappedConn) CloseWrite() error {
+	return CloseWrite(conn.Conn)
+}
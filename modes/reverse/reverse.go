@@ -0,0 +1,462 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+// Package reverse implements reverse tunnel mode, which exposes services
+// running behind NAT through a transport.  The dispatcher behind NAT runs as
+// a client: it dials the public dispatcher over the transport and registers
+// each of its services by keeping idle transport connections open.  The
+// public dispatcher runs as a server: it accepts inbound TCP connections for
+// each service and hands them to one of the idle transport connections, which
+// the client then connects to the local service.
+//
+// Each transport connection carries a single inbound connection.  After the
+// transport handshake the client sends the service name (uint8 length
+// followed by the name) and waits.  When an inbound connection arrives, the
+// server sends signalConnect, the client connects to the local service and
+// answers with replySucceeded or replyFailed, and the connection is relayed.
+// While the connection is idle, the server sends signalHeartbeat every
+// heartbeatInterval and the client answers with replyHeartbeat, so that both
+// ends notice when a NAT between them has silently dropped the connection.
+package reverse
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
+	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
+)
+
+const (
+	signalConnect   = 0x01
+	signalHeartbeat = 0x02
+	replySucceeded  = 0x01
+	replyFailed     = 0x00
+	replyHeartbeat  = 0x02
+
+	// idleConnections is the number of idle transport connections that the
+	// client keeps open for each service and transport.
+	idleConnections = 4
+
+	// maxIdleConnections is the number of idle transport connections that
+	// the server accepts for each service.
+	maxIdleConnections = 64
+
+	// registerTimeout bounds how long the server waits for the service
+	// name on a new transport connection.
+	registerTimeout = 30 * time.Second
+
+	// heartbeatInterval is how often the server checks that each idle
+	// transport connection still answers.
+	heartbeatInterval = 30 * time.Second
+
+	// heartbeatTimeout bounds how long the server waits for the answer to
+	// a heartbeat.
+	heartbeatTimeout = 10 * time.Second
+
+	// idleTimeout is how long the client waits for a message on an idle
+	// transport connection before replacing it.  It allows for one missed
+	// heartbeat.
+	idleTimeout = 2*heartbeatInterval + heartbeatTimeout
+
+	// connectTimeout bounds how long the server waits for the client at
+	// the other end of each idle transport connection it tries to connect
+	// to the local service.
+	connectTimeout = 10 * time.Second
+
+	// waitTimeout bounds how long an inbound connection waits for an idle
+	// transport connection.
+	waitTimeout = 10 * time.Second
+
+	// minRetryDelay and maxRetryDelay bound the delay before the client
+	// dials the server again after a failure.
+	minRetryDelay = time.Second
+	maxRetryDelay = time.Minute
+)
+
+// ParseServices parses a comma separated list of services of the form
+// name=host:port.  On the client, the address is where the local service
+// runs.  On the server, it is where inbound connections for the service are
+// accepted.
+func ParseServices(spec string) (map[string]string, error) {
+	services := make(map[string]string)
+	for _, service := range strings.Split(spec, ",") {
+		service = strings.TrimSpace(service)
+		if service == "" {
+			continue
+		}
+
+		equals := strings.IndexByte(service, '=')
+		if equals <= 0 {
+			return nil, fmt.Errorf("invalid service %q: expected name=host:port", service)
+		}
+		name, address := service[:equals], service[equals+1:]
+		if len(name) > 255 {
+			return nil, fmt.Errorf("invalid service %q: name is too long", service)
+		}
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return nil, fmt.Errorf("invalid service %q: %s", service, err)
+		}
+		if _, ok := services[name]; ok {
+			return nil, fmt.Errorf("duplicate service %q", name)
+		}
+		services[name] = address
+	}
+
+	if len(services) == 0 {
+		return nil, errors.New("no services specified")
+	}
+
+	return services, nil
+}
+
+// Version returns a string suitable to be included in a call to Cmethod.
+func Version() string {
+	return "reverse"
+}
+
+// ClientSetup registers each service with the server at target, using each
+// of the named transports.
+func ClientSetup(target string, ptClientProxy *url.URL, names []string, options string, services map[string]string) (launched bool) {
+	if _, err := modes.ProxyDialer(ptClientProxy, options); err != nil {
+		log.Errorf("(%s) - failed to obtain proxy dialer: %s", target, log.ElideError(err))
+		for _, name := range names {
+			_ = pt.CmethodError(name, "failed to obtain proxy dialer")
+		}
+		pt.CmethodsDone()
+		return false
+	}
+
+	for _, name := range names {
+		transportName := name
+		dial := func(session string) (net.Conn, error) {
+			conn, _, err := modes.DialTarget(transportName, session, target, options, ptClientProxy)
+			return conn, err
+		}
+
+		for service, address := range services {
+			for i := 0; i < idleConnections; i++ {
+				go clientLoop(name, dial, service, address)
+			}
+			log.Infof("%s - registering service %s", name, service)
+		}
+		pt.Cmethod(name, Version(), targetAddr(target))
+		launched = true
+	}
+	pt.CmethodsDone()
+
+	return
+}
+
+// targetAddr is the address reported in the CMETHOD lines of the reverse
+// client, which does not listen, so it reports the servers it connects to.
+type targetAddr string
+
+func (addr targetAddr) Network() string {
+	return "tcp"
+}
+
+func (addr targetAddr) String() string {
+	return string(addr)
+}
+
+// clientLoop keeps one idle transport connection open for a service, and
+// replaces it each time it is used or fails.  Each transport connection is a
+// new session.
+func clientLoop(name string, dial func(session string) (net.Conn, error), service string, address string) {
+	delay := minRetryDelay
+	for {
+		session := modes.NewSessionID()
+		remote, err := register(dial, session, service)
+		if err != nil {
+			modes.SessionLogger(name, session, "").Warnf("failed to register service %s: %s", service, log.ElideError(err))
+			time.Sleep(delay)
+			if delay *= 2; delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+			continue
+		}
+
+		// Wait until the server has an inbound connection for us.
+		if err = waitForSignal(remote, idleTimeout); err != nil {
+			modes.SessionLogger(name, session, "").Debugf("idle connection for service %s closed: %s", service, log.ElideError(err))
+			_ = remote.Close()
+			time.Sleep(delay)
+			continue
+		}
+		delay = minRetryDelay
+
+		go clientHandler(name, session, remote, service, address)
+	}
+}
+
+// waitForSignal waits on an idle transport connection until the server sends
+// signalConnect, answering its heartbeats meanwhile.  It gives up if nothing
+// arrives for timeout, since the connection may have been dropped without
+// being closed.
+func waitForSignal(remote net.Conn, timeout time.Duration) error {
+	var message [1]byte
+	for {
+		_ = remote.SetReadDeadline(time.Now().Add(timeout))
+		if _, err := io.ReadFull(remote, message[:]); err != nil {
+			return err
+		}
+
+		switch message[0] {
+		case signalConnect:
+			_ = remote.SetReadDeadline(time.Time{})
+			return nil
+		case signalHeartbeat:
+			if _, err := remote.Write([]byte{replyHeartbeat}); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected signal %#x", message[0])
+		}
+	}
+}
+
+func register(dial func(session string) (net.Conn, error), session string, service string) (net.Conn, error) {
+	remote, err := dial(session)
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		return nil, errors.New("transport server connection is nil")
+	}
+
+	if _, err = remote.Write(append([]byte{byte(len(service))}, service...)); err != nil {
+		_ = remote.Close()
+		return nil, err
+	}
+
+	return remote, nil
+}
+
+func clientHandler(name string, session string, remote net.Conn, service string, address string) {
+	logger := modes.SessionLogger(name, session, "")
+	local, err := net.Dial("tcp", address)
+	if err != nil {
+		logger.Errorf("failed to connect to service %s: %s", service, log.ElideError(err))
+		_, _ = remote.Write([]byte{replyFailed})
+		_ = remote.Close()
+		return
+	}
+
+	if _, err = remote.Write([]byte{replySucceeded}); err != nil {
+		_ = local.Close()
+		_ = remote.Close()
+		return
+	}
+
+	local = modes.CaptureConn(local, session, modes.CaptureApplication)
+	if err = modes.CopyLoop(local, remote); err != nil {
+		logger.Warnf("closed connection to service %s: %s", service, log.ElideError(err))
+	} else {
+		logger.Infof("closed connection to service %s", service)
+	}
+}
+
+// ServerSetup accepts inbound connections for each service, and transport
+// connections from clients that provide the services.
+func ServerSetup(ptServerInfo pt.ServerInfo, stateDir string, options string, services map[string]string) (launched bool) {
+	pools := make(map[string]chan net.Conn)
+	for service, address := range services {
+		ln, err := net.Listen("tcp", address)
+		if err != nil {
+			log.Errorf("failed to listen for service %s: %s", service, err)
+			return false
+		}
+
+		pool := make(chan net.Conn, maxIdleConnections)
+		pools[service] = pool
+		go inboundAcceptLoop(service, ln, pool)
+		go heartbeatLoop(pool)
+		log.Infof("%s - registered service listener: %s", service, log.ElideAddr(ln.Addr().String()))
+	}
+
+	return modes.ServerSetupTCP(ptServerInfo, stateDir, options, func(name string, remote net.Conn, info *pt.ServerInfo) {
+		serverHandler(name, remote, pools)
+	})
+}
+
+func serverHandler(name string, remote net.Conn, pools map[string]chan net.Conn) {
+	logger := modes.SessionLogger(name, modes.SessionID(remote), remote.RemoteAddr().String())
+	_ = remote.SetReadDeadline(time.Now().Add(registerTimeout))
+	var length [1]byte
+	if _, err := io.ReadFull(remote, length[:]); err != nil {
+		logger.Errorf("failed to read service name: %s", log.ElideError(err))
+		_ = remote.Close()
+		return
+	}
+	service := make([]byte, length[0])
+	if _, err := io.ReadFull(remote, service); err != nil {
+		logger.Errorf("failed to read service name: %s", log.ElideError(err))
+		_ = remote.Close()
+		return
+	}
+	_ = remote.SetReadDeadline(time.Time{})
+
+	pool, ok := pools[string(service)]
+	if !ok {
+		logger.Warnf("client registered unknown service %q", service)
+		_ = remote.Close()
+		return
+	}
+
+	select {
+	case pool <- remote:
+	default:
+		logger.Warnf("too many idle connections for service %s", service)
+		_ = remote.Close()
+	}
+}
+
+// heartbeatLoop checks the idle transport connections of a service every
+// heartbeatInterval.
+func heartbeatLoop(pool chan net.Conn) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		checkIdle(pool, heartbeatTimeout)
+	}
+}
+
+// checkIdle sends a heartbeat over each of the idle transport connections in
+// pool, and returns those whose clients answer within timeout to the pool.
+// The others are closed, so that they are not given inbound connections.
+// Connections taken for inbound connections meanwhile are not checked.
+func checkIdle(pool chan net.Conn, timeout time.Duration) {
+	var wg sync.WaitGroup
+	for i := len(pool); i > 0; i-- {
+		select {
+		case remote := <-pool:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				heartbeat(remote, pool, timeout)
+			}()
+		default:
+		}
+	}
+	wg.Wait()
+}
+
+// heartbeat returns an idle transport connection to pool if its client
+// answers a heartbeat within timeout, and closes it otherwise.
+func heartbeat(remote net.Conn, pool chan net.Conn, timeout time.Duration) {
+	if reply, err := signal(remote, signalHeartbeat, timeout); err != nil || reply != replyHeartbeat {
+		_ = remote.Close()
+		return
+	}
+
+	select {
+	case pool <- remote:
+	default:
+		_ = remote.Close()
+	}
+}
+
+func inboundAcceptLoop(service string, ln net.Listener, pool chan net.Conn) {
+	err := modes.AcceptSessions(service, ln, func(conn net.Conn) {
+		inboundHandler(service, conn, pool)
+	}, nil)
+	log.Errorf("%s - fatal listener error: %s", service, err.Error())
+}
+
+// inboundHandler relays an inbound connection over an idle transport
+// connection, and logs it with the session of the transport connection.
+func inboundHandler(service string, conn net.Conn, pool chan net.Conn) {
+	addr := conn.RemoteAddr().String()
+
+	remote, reply, err := takeIdle(pool, connectTimeout, waitTimeout)
+	if err != nil {
+		modes.SessionLogger(service, "", addr).Errorf("no client available for service: %s", err)
+		_ = conn.Close()
+		return
+	}
+	logger := modes.SessionLogger(service, modes.SessionID(remote), addr)
+	if reply != replySucceeded {
+		logger.Errorf("client failed to connect to service")
+		_ = remote.Close()
+		_ = conn.Close()
+		return
+	}
+
+	conn = modes.CaptureConn(conn, modes.SessionID(remote), modes.CaptureApplication)
+	if err = modes.CopyLoop(conn, remote); err != nil {
+		logger.Warnf("closed connection: %s", log.ElideError(err))
+	} else {
+		logger.Infof("closed connection")
+	}
+}
+
+// takeIdle takes idle transport connections from pool until the client at
+// the other end of one answers signalConnect, and returns that connection
+// with the client's reply.  Idle transport connections may have been dropped
+// since they were last checked, so each attempt is bounded by connect, in
+// order that a dropped connection does not use up the time for the others.
+// It gives up when no idle connection arrives within wait.
+func takeIdle(pool chan net.Conn, connect time.Duration, wait time.Duration) (net.Conn, byte, error) {
+	for {
+		var remote net.Conn
+		select {
+		case remote = <-pool:
+		case <-time.After(wait):
+			return nil, 0, errors.New("timed out waiting for an idle connection")
+		}
+
+		reply, err := signal(remote, signalConnect, connect)
+		if err != nil {
+			_ = remote.Close()
+			continue
+		}
+
+		return remote, reply, nil
+	}
+}
+
+// signal sends message to the client at the other end of an idle transport
+// connection, and returns its reply if it arrives within timeout.
+func signal(remote net.Conn, message byte, timeout time.Duration) (byte, error) {
+	_ = remote.SetDeadline(time.Now().Add(timeout))
+	if _, err := remote.Write([]byte{message}); err != nil {
+		return 0, err
+	}
+
+	var reply [1]byte
+	if _, err := io.ReadFull(remote, reply[:]); err != nil {
+		return 0, err
+	}
+	_ = remote.SetDeadline(time.Time{})
+
+	return reply[0], nil
+}
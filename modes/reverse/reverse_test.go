@@ -0,0 +1,170 @@
+package reverse
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/testutil"
+	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
+)
+
+// freeAddr returns a local address that is not in use.
+func freeAddr(t *testing.T) *net.TCPAddr {
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("could not find a free port:", err)
+	}
+	defer probe.Close()
+
+	return probe.Addr().(*net.TCPAddr)
+}
+
+// TestReverseTunnel tests that an inbound connection to the server reaches a
+// service registered by the client.
+func TestReverseTunnel(t *testing.T) {
+	service := testutil.StartTCPEcho(t)
+	defer service.Close()
+
+	transportAddr := freeAddr(t)
+	publicAddr := freeAddr(t).String()
+
+	info := pt.ServerInfo{Bindaddrs: []pt.Bindaddr{{MethodName: "obfs2", Addr: transportAddr}}}
+	if !ServerSetup(info, t.TempDir(), "", map[string]string{"echo": publicAddr}) {
+		t.Fatal("ServerSetup failed")
+	}
+	if !ClientSetup(transportAddr.String(), nil, []string{"obfs2"}, "", map[string]string{"echo": service.Addr().String()}) {
+		t.Fatal("ClientSetup failed")
+	}
+
+	// The client may take a moment to register.
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", publicAddr); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal("could not connect to service listener:", err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal("write failed:", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		t.Fatal("read failed:", err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("received %q, expected \"ping\"", buf)
+	}
+}
+
+// TestParseServices tests parsing of service lists.
+func TestParseServices(t *testing.T) {
+	services, err := ParseServices("web=127.0.0.1:80, ssh=[::1]:22")
+	if err != nil {
+		t.Fatal("ParseServices failed:", err)
+	}
+	if services["web"] != "127.0.0.1:80" || services["ssh"] != "[::1]:22" || len(services) != 2 {
+		t.Error("ParseServices returned", services)
+	}
+
+	for _, spec := range []string{"", "web", "=127.0.0.1:80", "web=127.0.0.1", "web=127.0.0.1:80,web=127.0.0.1:81"} {
+		if _, err = ParseServices(spec); err == nil {
+			t.Errorf("ParseServices(%q) succeeded", spec)
+		}
+	}
+}
+
+// TestWaitForSignal tests that the client answers heartbeats on an idle
+// transport connection until the server asks it to connect.
+func TestWaitForSignal(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	result := make(chan error, 1)
+	go func() { result <- waitForSignal(client, 5*time.Second) }()
+
+	if reply, err := signal(server, signalHeartbeat, 5*time.Second); err != nil || reply != replyHeartbeat {
+		t.Fatalf("heartbeat returned %#x, %v", reply, err)
+	}
+	_ = server.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := server.Write([]byte{signalConnect}); err != nil {
+		t.Fatal("write failed:", err)
+	}
+	if err := <-result; err != nil {
+		t.Error("waitForSignal failed:", err)
+	}
+}
+
+// TestWaitForSignalIdle tests that the client gives up on an idle transport
+// connection that the server has stopped sending heartbeats over.
+func TestWaitForSignalIdle(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	if err := waitForSignal(client, 100*time.Millisecond); err == nil {
+		t.Error("waitForSignal returned without a signal")
+	}
+}
+
+// TestCheckIdle tests that the server keeps idle transport connections whose
+// clients answer heartbeats, and closes the others.
+func TestCheckIdle(t *testing.T) {
+	liveClient, live := net.Pipe()
+	defer liveClient.Close()
+	go func() { _ = waitForSignal(liveClient, 5*time.Second) }()
+	deadClient, dead := net.Pipe()
+	defer deadClient.Close()
+
+	pool := make(chan net.Conn, maxIdleConnections)
+	pool <- dead
+	pool <- live
+	checkIdle(pool, 100*time.Millisecond)
+
+	if len(pool) != 1 || <-pool != live {
+		t.Error("the pool does not hold only the connection that answered")
+	}
+	if _, err := dead.Write([]byte{0}); err == nil {
+		t.Error("the connection that did not answer was not closed")
+	}
+}
+
+// TestTakeIdleSkipsDeadConnections tests that an idle transport connection
+// that does not answer does not use up the time to connect over the next
+// one.
+func TestTakeIdleSkipsDeadConnections(t *testing.T) {
+	deadClient, dead := net.Pipe()
+	defer deadClient.Close()
+	liveClient, live := net.Pipe()
+	defer liveClient.Close()
+	go func() {
+		if waitForSignal(liveClient, 5*time.Second) == nil {
+			_, _ = liveClient.Write([]byte{replySucceeded})
+		}
+	}()
+
+	pool := make(chan net.Conn, maxIdleConnections)
+	pool <- dead
+	pool <- live
+
+	remote, reply, err := takeIdle(pool, 200*time.Millisecond, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal("takeIdle failed:", err)
+	}
+	if remote != live || reply != replySucceeded {
+		t.Errorf("takeIdle returned the wrong connection or reply %#x", reply)
+	}
+
+	if _, _, err = takeIdle(pool, 200*time.Millisecond, 200*time.Millisecond); err == nil {
+		t.Error("takeIdle returned a connection from an empty pool")
+	}
+}
@@ -0,0 +1,71 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+)
+
+// sessionIDSize is the number of random bytes in a session ID.
+const sessionIDSize = 6
+
+// NewSessionID returns a random ID for a new session, which identifies the
+// session in its log lines and STATUS events from accept to close.  The ID
+// is local to the client or server that chose it, and is not sent to the
+// other side, which would change what clients and servers send each other.
+func NewSessionID() string {
+	id := make([]byte, sessionIDSize)
+	if _, err := rand.Read(id); err != nil {
+		return "unknown"
+	}
+
+	return hex.EncodeToString(id)
+}
+
+// SessionID returns the ID of the session that a connection passed to a
+// server handler belongs to, or the ID of a new session for any other
+// connection.
+func SessionID(conn net.Conn) string {
+	if sessionConn, ok := conn.(interface{ SessionID() string }); ok {
+		return sessionConn.SessionID()
+	}
+
+	return NewSessionID()
+}
+
+// SessionLogger returns a logger for a session of the named transport.  The
+// address is scrubbed with ElideAddr, and may be empty.
+func SessionLogger(name string, session string, addr string) *log.Logger {
+	fields := log.Fields{Transport: name, Session: session}
+	if addr != "" {
+		fields.Addr = log.ElideAddr(addr)
+	}
+
+	return log.With(fields)
+}
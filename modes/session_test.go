@@ -0,0 +1,62 @@
+package modes
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
+)
+
+// TestNewSessionID tests that session IDs are distinct and of the expected
+// length.
+func TestNewSessionID(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := NewSessionID()
+		if len(id) != 2*sessionIDSize {
+			t.Fatalf("session ID %q has length %d", id, len(id))
+		}
+		if seen[id] {
+			t.Fatalf("session ID %q was repeated", id)
+		}
+		seen[id] = true
+	}
+}
+
+// TestServerSessionID tests that a server handler is passed a connection
+// carrying the session that its ACCEPT event was reported with.
+func TestServerSessionID(t *testing.T) {
+	_ = log.Init(false, "", log.LevelInfo)
+	defer func() { _ = log.Init(false, "", log.LevelNone) }()
+
+	var session string
+	handler, err := WrapServerHandler("sessiontest", "127.0.0.1:1", "", true, func(name string, remote net.Conn, info *pt.ServerInfo) {
+		session = SessionID(remote)
+		if SessionID(remote) != session {
+			t.Error("the session of the connection changed")
+		}
+	})
+	if err != nil {
+		t.Fatal("WrapServerHandler failed:", err)
+	}
+
+	lines := captureIPC(t, func() {
+		client, server := net.Pipe()
+		defer client.Close()
+		handler("sessiontest", server, nil)
+	})
+
+	var accepted bool
+	for _, line := range lines {
+		args := " " + strings.Join(line.args, " ")
+		if line.keyword == "STATUS" && strings.Contains(args, " TRANSPORT=sessiontest ") &&
+			strings.HasSuffix(args, " ACCEPT=Success SESSION="+session) {
+			accepted = true
+		}
+	}
+	if session == "" || !accepted {
+		t.Errorf("no ACCEPT event for session %q in %v", session, lines)
+	}
+}
@@ -0,0 +1,47 @@
+//go:build linux
+// +build linux
+
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import "net"
+
+// spliceCopy copies between two TCP connections with TCPConn.ReadFrom, which
+// uses splice(2) on Linux so that the data never enters user space.  It
+// reports whether it handled the copy.
+func spliceCopy(dst net.Conn, src net.Conn) (int64, bool, error) {
+	dstTCP, ok := dst.(*net.TCPConn)
+	if !ok {
+		return 0, false, nil
+	}
+	srcTCP, ok := src.(*net.TCPConn)
+	if !ok {
+		return 0, false, nil
+	}
+
+	n, err := dstTCP.ReadFrom(srcTCP)
+	return n, true, err
+}
@@ -0,0 +1,253 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
+)
+
+// statusEventRate is the number of STATUS events per second that are sent
+// for each transport.  Events beyond the rate are dropped, and counted in the
+// next summary.
+const statusEventRate = 5
+
+// transportStats are the counters for a transport that are reported in
+// STATUS summaries.
+type transportStats struct {
+	// The counters come first, so that they are aligned for atomic access.
+	connections int64
+	failures    int64
+	active      int64
+	sent        int64
+	received    int64
+	suppressed  int64
+
+	events *tokenBucket
+}
+
+var transportStatsByName = make(map[string]*transportStats)
+var transportStatsLock sync.Mutex
+
+func statsFor(name string) *transportStats {
+	transportStatsLock.Lock()
+	defer transportStatsLock.Unlock()
+
+	stats, ok := transportStatsByName[name]
+	if !ok {
+		stats = &transportStats{events: newTokenBucket(statusEventRate, statusEventRate)}
+		transportStatsByName[name] = stats
+	}
+
+	return stats
+}
+
+// statusEvent sends a STATUS message about an event of the named transport,
+// unless too many have been sent for it recently.
+func statusEvent(name string, level int, keyvals ...string) {
+	if !log.IPCEnabled(level) {
+		return
+	}
+
+	stats := statsFor(name)
+	if !stats.events.available(1) {
+		atomic.AddInt64(&stats.suppressed, 1)
+		return
+	}
+	stats.events.reserve(1)
+
+	log.Status(level, name, keyvals...)
+}
+
+// connectStatus counts a client connection of the named transport for a
+// session, and reports whether it succeeded.
+func connectStatus(name string, session string, err error) {
+	keyvals := []string{"CONNECT", "Success"}
+	if session != "" {
+		keyvals = append(keyvals, "SESSION", session)
+	}
+
+	stats := statsFor(name)
+	if err != nil {
+		atomic.AddInt64(&stats.failures, 1)
+		keyvals[1] = "Failed"
+		statusEvent(name, log.LevelWarn, append(keyvals, "ERROR", ErrorClass(err))...)
+		return
+	}
+
+	atomic.AddInt64(&stats.connections, 1)
+	statusEvent(name, log.LevelInfo, keyvals...)
+}
+
+// statusServerHandler wraps a server handler to count the connections of
+// each transport and the bytes relayed over them.  Each connection starts a
+// new session, or continues the one started by the capture front end, whose
+// ID the handler can get with SessionID.
+func statusServerHandler(serverHandler ServerHandler) ServerHandler {
+	return func(name string, remote net.Conn, info *pt.ServerInfo) {
+		session, ok := takeCaptureSession(remote.RemoteAddr())
+		if !ok {
+			session = NewSessionID()
+		}
+		atomic.AddInt64(&statsFor(name).connections, 1)
+		statusEvent(name, log.LevelInfo, "ACCEPT", "Success", "SESSION", session)
+
+		conn := newStatsConn(name, remote)
+		conn.session = session
+		defer conn.done()
+		serverHandler(name, conn, info)
+	}
+}
+
+// StartStatusReports sends a STATUS summary of the counters of each
+// transport at every interval, while IPC messages at the INFO level are
+// enabled.
+func StartStatusReports(interval time.Duration) {
+	if interval <= 0 || !log.IPCEnabled(log.LevelInfo) {
+		return
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			reportStatus()
+		}
+	}()
+}
+
+func reportStatus() {
+	transportStatsLock.Lock()
+	names := make([]string, 0, len(transportStatsByName))
+	for name := range transportStatsByName {
+		names = append(names, name)
+	}
+	transportStatsLock.Unlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		stats := statsFor(name)
+		log.Status(log.LevelInfo, name,
+			"CONNECTIONS", strconv.FormatInt(atomic.LoadInt64(&stats.connections), 10),
+			"FAILURES", strconv.FormatInt(atomic.LoadInt64(&stats.failures), 10),
+			"ACTIVE", strconv.FormatInt(atomic.LoadInt64(&stats.active), 10),
+			"BYTES-SENT", strconv.FormatInt(atomic.LoadInt64(&stats.sent), 10),
+			"BYTES-RECEIVED", strconv.FormatInt(atomic.LoadInt64(&stats.received), 10),
+			"SUPPRESSED", strconv.FormatInt(atomic.SwapInt64(&stats.suppressed, 0), 10))
+	}
+}
+
+// ErrorClass returns a short description of the kind of a dial error, which
+// is safe to report without scrubbing.  Errors wrapped by the transports are
+// unwrapped.
+func ErrorClass(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return "dns"
+	}
+
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return "other"
+	}
+	switch errno {
+	case syscall.ECONNREFUSED:
+		return "refused"
+	case syscall.ECONNRESET:
+		return "reset"
+	case syscall.ENETUNREACH, syscall.EHOSTUNREACH:
+		return "unreachable"
+	default:
+		return "other"
+	}
+}
+
+// statsConn counts the bytes sent and received over a transport connection,
+// and counts it as active until it is closed.
+type statsConn struct {
+	net.Conn
+	stats   *transportStats
+	session string
+	once    sync.Once
+}
+
+func newStatsConn(name string, conn net.Conn) *statsConn {
+	stats := statsFor(name)
+	atomic.AddInt64(&stats.active, 1)
+
+	return &statsConn{Conn: conn, stats: stats}
+}
+
+func (conn *statsConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	atomic.AddInt64(&conn.stats.received, int64(n))
+
+	return n, err
+}
+
+func (conn *statsConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	atomic.AddInt64(&conn.stats.sent, int64(n))
+
+	return n, err
+}
+
+// IdleTimeout returns the idle timeout of the wrapped connection, so that
+// CopyLoop still applies it.
+func (conn *statsConn) IdleTimeout() time.Duration {
+	return idleTimeoutOf(conn.Conn)
+}
+
+// SessionID returns the ID of the session that the connection belongs to.
+func (conn *statsConn) SessionID() string {
+	return conn.session
+}
+
+func (conn *statsConn) CloseWrite() error {
+	return CloseWrite(conn.Conn)
+}
+
+func (conn *statsConn) Close() error {
+	conn.done()
+	return conn.Conn.Close()
+}
+
+// done stops counting the connection as active.
+func (conn *statsConn) done() {
+	conn.once.Do(func() {
+		atomic.AddInt64(&conn.stats.active, -1)
+	})
+}
@@ -0,0 +1,95 @@
+package modes
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
+)
+
+// TestErrorClass tests the classes reported for common dial errors, and for
+// dial errors wrapped by a transport.
+func TestErrorClass(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen failed:", err)
+	}
+	address := ln.Addr().String()
+	_ = ln.Close()
+
+	_, refused := net.Dial("tcp", address)
+	wrapped := fmt.Errorf("transport dial failed: %w", &net.OpError{
+		Op:  "dial",
+		Net: "tcp",
+		Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED},
+	})
+	for _, test := range []struct {
+		err      error
+		expected string
+	}{
+		{&TimeoutError{Operation: "dial", After: time.Second}, "timeout"},
+		{refused, "refused"},
+		{wrapped, "refused"},
+		{fmt.Errorf("transport dial failed: %w", &net.DNSError{Err: "no such host"}), "dns"},
+		{errors.New("handshake failed"), "other"},
+	} {
+		if class := ErrorClass(test.err); class != test.expected {
+			t.Errorf("ErrorClass(%v) = %s, expected %s", test.err, class, test.expected)
+		}
+	}
+}
+
+// TestStatusEvents tests that client connections are reported in STATUS
+// events with their sessions, that events beyond the rate are suppressed, and that the summary
+// counts them all.
+func TestStatusEvents(t *testing.T) {
+	var output bytes.Buffer
+	stdout := pt.Stdout
+	pt.Stdout = &output
+	_ = log.Init(false, "", log.LevelInfo)
+	defer func() {
+		pt.Stdout = stdout
+		_ = log.Init(false, "", log.LevelNone)
+	}()
+
+	dialErr := errors.New("handshake failed")
+	if _, err := DialTransport("statustest", "a1b2", "192.0.2.1:1", "", func() (net.Conn, error) { return nil, dialErr }); err == nil {
+		t.Fatal("DialTransport succeeded")
+	}
+	for i := 0; i < 2*statusEventRate; i++ {
+		connectStatus("statustest", "c3d4", nil)
+	}
+	reportStatus()
+
+	// Other tests may have counted connections of other transports.
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		if strings.HasPrefix(line, "STATUS TRANSPORT=statustest ") {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) != statusEventRate+1 {
+		t.Fatalf("got %d lines, expected %d: %q", len(lines), statusEventRate+1, output.String())
+	}
+	if !strings.HasSuffix(lines[0], " CONNECT=Failed SESSION=a1b2 ERROR=other") {
+		t.Errorf("unexpected failure event %q", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], " CONNECT=Success SESSION=c3d4") {
+		t.Errorf("unexpected success event %q", lines[1])
+	}
+
+	summary := lines[len(lines)-1]
+	for _, field := range []string{"CONNECTIONS=10", "FAILURES=1", "ACTIVE=0", "SUPPRESSED=6"} {
+		if !strings.Contains(summary, " "+field) {
+			t.Errorf("summary %q does not contain %s", summary, field)
+		}
+	}
+}
@@ -30,61 +30,59 @@
 package stun_udp
 
 import (
-	"fmt"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
 
 	common "github.com/willscott/goturn/common"
 	"io"
-	golog "log"
 	"net"
 	"net/url"
 
-	"github.com/willscott/goturn"
-
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
 	"github.com/OperatorFoundation/shapeshifter-ipc/v2"
 )
 
+// Version returns a string suitable to be included in a call to Cmethod.
+func Version() string {
+	return "STUN"
+}
+
 func ClientSetup(socksAddr string, target string, ptClientProxy *url.URL, names []string, options string) bool {
-	return modes.ClientSetupUDP(socksAddr, target, ptClientProxy, names, options, clientHandler)
+	return modes.ClientSetupUDP(socksAddr, target, ptClientProxy, names, options, Version(), clientHandler)
 }
 
 func clientHandler(target string, name string, options string, conn *net.UDPConn, proxyURI *url.URL) {
 
-	//defers are never called due to infinite loop
-
-	fmt.Println("@@@ handling...")
-
-	tracker := make(modes.ConnTracker)
-
-	fmt.Println("Transport is", name)
+	tracker := modes.NewConnTracker()
 
-	buf := make([]byte, 1024)
+	buf := modes.GetPacketBuffer()
+	defer modes.PutPacketBuffer(buf)
 
-	// Receive UDP packets and forward them over transport connections forever
+	// Receive UDP packets and forward them over transport connections until
+	// the listener is closed.
 	for {
 		numBytes, addr, err := conn.ReadFromUDP(buf)
-		fmt.Println("Received ", string(buf[0:numBytes]), " from ", addr)
-
 		if err != nil {
-			fmt.Println("Error: ", err)
+			if e, ok := err.(net.Error); ok && !e.Temporary() {
+				log.Errorf("%s - fatal listener error: %s", name, log.ElideError(err))
+				return
+			}
+			log.Warnf("%s - failed to read packet: %s", name, log.ElideError(err))
+			continue
 		}
 
 		goodBytes := buf[:numBytes]
 
-		fmt.Println(tracker)
-
-		if state, ok := tracker[addr.String()]; ok {
+		if state, ok := tracker.Get(addr.String()); ok {
 			// There is an open transport connection, or a connection attempt is in progress.
 
 			if state.Waiting {
 				// The connection attempt is in progress.
 				// Drop the packet.
-				fmt.Println("recv: waiting")
+				log.Debugf("%s - dropping a packet while connecting", name)
 			} else {
 				// There is an open transport connection.
 				// Send the packet through the transport.
-				fmt.Println("recv: write")
+				log.Debugf("%s - sending a packet of %d bytes to the server", name, numBytes)
 				//ignoring failed writes because packets can be dropped
 				_, _ = state.Conn.Write(goodBytes)
 			}
@@ -92,81 +90,121 @@ func clientHandler(target string, name string, options string, conn *net.UDPConn
 			// There is not an open transport connection and a connection attempt is not in progress.
 			// Open a transport connection.
 
-			fmt.Println("Opening connection to ", target)
+			log.Debugf("%s - opening a connection for %s", name, log.ElideAddr(addr.String()))
 
-			modes.OpenConnection(&tracker, addr.String(), target, name, options, proxyURI)
+			source := addr
+			modes.OpenConnection(tracker, addr.String(), conn.LocalAddr().String(), target, name, options, proxyURI, func(remote net.Conn) {
+				relayReplies(name, remote, conn, source)
+			})
 
 			// Drop the packet.
-			fmt.Println("recv: Open")
 		}
 	}
 }
 
-func ServerSetup(ptServerInfo pt.ServerInfo, stateDir string, options string) (launched bool) {
-	return modes.ServerSetupUDP(ptServerInfo, stateDir, options, serverHandler)
-}
-
-func serverHandler(name string, remote net.Conn, info *pt.ServerInfo) {
-	var header *common.Message
+// relayReplies sends the STUN messages that the server sends back over
+// remote to the application at source, until the connection fails.
+func relayReplies(name string, remote net.Conn, conn *net.UDPConn, source *net.UDPAddr) {
+	var header common.Header
 
-	addrStr := log.ElideAddr(remote.RemoteAddr().String())
-	fmt.Println("### handling", name)
-	log.Infof("%s(%s) - new connection", name, addrStr)
+	packetBuffer := modes.GetPacketBuffer()
+	defer modes.PutPacketBuffer(packetBuffer)
 
-	serverAddr, err := net.ResolveUDPAddr("udp", info.OrAddr.String())
-	if err != nil {
-		_ = remote.Close()
+	for {
+		packet, err := readMessage(remote, packetBuffer, &header)
+		if err != nil {
+			log.Debugf("%s - failed to read reply: %s", name, log.ElideError(err))
+			return
+		}
 
-		golog.Fatal(err)
+		log.Debugf("%s - sending a reply of %d bytes to the application", name, len(packet))
+		if _, err = conn.WriteToUDP(packet, source); err != nil {
+			log.Debugf("%s - failed to send reply: %s", name, log.ElideError(err))
+		}
 	}
+}
 
-	localAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
-	if err != nil {
-		_ = remote.Close()
-		golog.Fatal(err)
+// readMessage reads a STUN message from r into packetBuffer, which must be
+// large enough for any message.  Only the header is decoded, since the
+// attributes are relayed as they are.
+func readMessage(r io.Reader, packetBuffer []byte, header *common.Header) ([]byte, error) {
+	headerBuffer := packetBuffer[:20]
+	if _, err := io.ReadFull(r, headerBuffer); err != nil {
+		return nil, err
+	}
+	if err := header.Decode(headerBuffer); err != nil {
+		return nil, err
 	}
 
-	dest, err := net.DialUDP("udp", localAddr, serverAddr)
-	if err != nil {
-		_ = remote.Close()
-		golog.Fatal(err)
+	packetLength := len(headerBuffer) + int(header.Length)
+	if _, err := io.ReadFull(r, packetBuffer[len(headerBuffer):packetLength]); err != nil {
+		return nil, err
 	}
 
-	fmt.Println("pumping")
+	return packetBuffer[:packetLength], nil
+}
 
-	headerBuffer := make([]byte, 20)
+func ServerSetup(ptServerInfo pt.ServerInfo, stateDir string, options string) (launched bool) {
+	return modes.ServerSetupUDP(ptServerInfo, stateDir, options, serverHandler)
+}
 
-	for {
-		fmt.Println("reading...")
-		// Read the incoming connection into the buffer.
-		_, err := io.ReadFull(remote, headerBuffer)
-		if err != nil {
-			fmt.Println("read error")
-			break
-		}
+func serverHandler(name string, remote net.Conn, info *pt.ServerInfo) {
+	var header common.Header
 
-		header, err = goturn.ParseStun(headerBuffer)
-		if err != nil {
-			fmt.Println("parse error")
-			break
-		}
+	session := modes.SessionID(remote)
+	logger := modes.SessionLogger(name, session, remote.RemoteAddr().String())
+	logger.Infof("new connection")
 
-		fmt.Println(header.Length)
+	// Connect to the orport, or the client's destination in exit mode.
+	dest, err := modes.DialServer("udp", name, remote, info)
+	if err != nil {
+		logger.Errorf("failed to connect to ORPort: %s", log.ElideError(err))
+		_ = remote.Close()
+		return
+	}
+	dest = modes.CaptureConn(dest, session, modes.CaptureApplication)
+
+	// Relay replies from the destination back to the client.  Replies that
+	// are not whole STUN messages are dropped, since the client could not
+	// find where the next message starts.
+	go func() {
+		defer remote.Close()
+		var replyHeader common.Header
+		replyBuffer := modes.GetPacketBuffer()
+		defer modes.PutPacketBuffer(replyBuffer)
+		for {
+			numBytes, err := dest.Read(replyBuffer)
+			if err != nil {
+				return
+			}
+			reply := replyBuffer[:numBytes]
+			if numBytes < 20 || replyHeader.Decode(reply[:20]) != nil || 20+int(replyHeader.Length) != numBytes {
+				logger.Debugf("dropping a reply that is not a STUN message")
+				continue
+			}
+			if _, err = remote.Write(reply); err != nil {
+				return
+			}
+		}
+	}()
 
-		fmt.Println("reading data")
+	// The header and data of each packet are read into one buffer, so that
+	// the packet can be written without copying.
+	packetBuffer := modes.GetPacketBuffer()
+	defer modes.PutPacketBuffer(packetBuffer)
 
-		readBuffer := make([]byte, header.Length)
-		_, err = io.ReadFull(remote, readBuffer)
+	for {
+		packet, err := readMessage(remote, packetBuffer, &header)
 		if err != nil {
-			fmt.Println("read error")
+			logger.Debugf("failed to read STUN message: %s", log.ElideError(err))
 			break
 		}
 
-		writeBuffer := append(headerBuffer, readBuffer...)
-
-		_, _ = dest.Write(writeBuffer)
+		logger.Debugf("relaying a STUN message of %d bytes", header.Length)
+		_, _ = dest.Write(packet)
 	}
 
 	_ = dest.Close()
 	_ = remote.Close()
+	logger.Infof("closed connection")
 }
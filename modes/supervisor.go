@@ -0,0 +1,143 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
+)
+
+// SupervisorPolicy controls how server listeners are restarted when they
+// cannot be opened or stop accepting connections.
+type SupervisorPolicy struct {
+	// MaxFailures is the number of consecutive failures after which a
+	// listener is given up on.  Zero retries forever.
+	MaxFailures int
+
+	// InitialBackoff is the delay before the first retry, which doubles for
+	// each following failure up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// ExitOnFailure makes the dispatcher exit when a listener is given up
+	// on, instead of marking it unhealthy and serving on the others.
+	ExitOnFailure bool
+}
+
+// DefaultSupervisorPolicy is the supervisor policy used unless
+// SetSupervisorPolicy is called.
+var DefaultSupervisorPolicy = SupervisorPolicy{
+	MaxFailures:    10,
+	InitialBackoff: time.Second,
+	MaxBackoff:     time.Minute,
+}
+
+var supervisorPolicy = DefaultSupervisorPolicy
+var unhealthyListeners = make(map[string]bool)
+var unhealthyListenersLock sync.Mutex
+
+// exit is replaced by tests.
+var exit = os.Exit
+
+// SetSupervisorPolicy configures how server listeners are restarted.  It must
+// be called before any listeners are started.
+func SetSupervisorPolicy(policy SupervisorPolicy) {
+	supervisorPolicy = policy
+}
+
+// UnhealthyListeners returns the listeners that were given up on, as
+// "name address" strings.
+func UnhealthyListeners() []string {
+	unhealthyListenersLock.Lock()
+	defer unhealthyListenersLock.Unlock()
+
+	listeners := make([]string, 0, len(unhealthyListeners))
+	for listener := range unhealthyListeners {
+		listeners = append(listeners, listener)
+	}
+	sort.Strings(listeners)
+
+	return listeners
+}
+
+// SuperviseListener opens the listener for the named transport on address
+// and runs serve with it, which must close the listener when it returns.
+// When the listener cannot be opened or serve returns, the listener is
+// opened again after a growing delay.  After too many failures in a row the
+// failure is reported with SMETHOD-ERROR, and the dispatcher either exits or
+// carries on without the listener.
+func SuperviseListener(name string, address string, listen func(address string) net.Listener, serve func(ln net.Listener)) {
+	policy := supervisorPolicy
+	failures := 0
+	backoff := policy.InitialBackoff
+	for {
+		started := time.Now()
+		ln := listen(address)
+		if ln != nil {
+			log.Infof("%s - registered listener: %s", name, log.ElideAddr(address))
+			serve(ln)
+			log.Warnf("%s - listener on %s stopped", name, log.ElideAddr(address))
+		} else {
+			log.Warnf("%s - failed to listen on %s", name, log.ElideAddr(address))
+		}
+
+		// A listener that served for longer than the longest delay was
+		// working, so the failures start again from the beginning.
+		if ln != nil && time.Since(started) > policy.MaxBackoff {
+			failures = 0
+			backoff = policy.InitialBackoff
+		}
+
+		failures++
+		if policy.MaxFailures > 0 && failures >= policy.MaxFailures {
+			break
+		}
+
+		log.Infof("%s - restarting listener on %s in %s", name, log.ElideAddr(address), backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+
+	log.Errorf("%s - giving up on listener on %s after %d failures", name, log.ElideAddr(address), failures)
+	_ = pt.SmethodError(name, fmt.Sprintf("listener on %s failed %d times", address, failures))
+	statusEvent(name, log.LevelError, "LISTENER", "Failed")
+
+	unhealthyListenersLock.Lock()
+	unhealthyListeners[name+" "+address] = true
+	unhealthyListenersLock.Unlock()
+
+	if policy.ExitOnFailure {
+		exit(1)
+	}
+}
@@ -0,0 +1,87 @@
+package modes
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
+)
+
+// TestSuperviseListenerGivesUp tests that a listener that cannot be opened
+// is retried with a growing delay, and then reported with SMETHOD-ERROR and
+// marked unhealthy.
+func TestSuperviseListenerGivesUp(t *testing.T) {
+	var output bytes.Buffer
+	stdout := pt.Stdout
+	pt.Stdout = &output
+	defer func() { pt.Stdout = stdout }()
+
+	SetSupervisorPolicy(SupervisorPolicy{MaxFailures: 3, InitialBackoff: 10 * time.Millisecond, MaxBackoff: time.Second})
+	defer SetSupervisorPolicy(DefaultSupervisorPolicy)
+
+	unhealthyListenersLock.Lock()
+	unhealthyListeners = make(map[string]bool)
+	unhealthyListenersLock.Unlock()
+
+	attempts := 0
+	start := time.Now()
+	SuperviseListener("test", "127.0.0.1:1", func(string) net.Listener {
+		attempts++
+		return nil
+	}, func(net.Listener) {
+		t.Error("serve was called without a listener")
+	})
+
+	if attempts != 3 {
+		t.Errorf("listen was called %d times, expected 3", attempts)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("gave up after %s, expected a backoff of 10ms and 20ms", elapsed)
+	}
+	if !strings.HasPrefix(output.String(), "SMETHOD-ERROR test ") {
+		t.Errorf("got %q, expected an SMETHOD-ERROR line", output.String())
+	}
+
+	unhealthy := UnhealthyListeners()
+	if len(unhealthy) != 1 || unhealthy[0] != "test 127.0.0.1:1" {
+		t.Errorf("got unhealthy listeners %v", unhealthy)
+	}
+}
+
+// TestSuperviseListenerRestarts tests that a listener is opened again after
+// it stops serving, and that the dispatcher exits when configured to.
+func TestSuperviseListenerRestarts(t *testing.T) {
+	stdout := pt.Stdout
+	pt.Stdout = &bytes.Buffer{}
+	defer func() { pt.Stdout = stdout }()
+
+	SetSupervisorPolicy(SupervisorPolicy{MaxFailures: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Second, ExitOnFailure: true})
+	defer SetSupervisorPolicy(DefaultSupervisorPolicy)
+
+	exitCode := -1
+	exit = func(code int) { exitCode = code }
+	defer func() { exit = os.Exit }()
+
+	served := 0
+	SuperviseListener("test", "127.0.0.1:0", func(address string) net.Listener {
+		ln, err := net.Listen("tcp", address)
+		if err != nil {
+			t.Fatal("listen failed:", err)
+		}
+		return ln
+	}, func(ln net.Listener) {
+		served++
+		_ = ln.Close()
+	})
+
+	if served != 2 {
+		t.Errorf("served %d times, expected 2", served)
+	}
+	if exitCode != 1 {
+		t.Errorf("exit code %d, expected 1", exitCode)
+	}
+}
@@ -25,144 +25,57 @@ SOFTWARE.
 package modes
 
 import (
-	"errors"
-	"fmt"
-
-	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
 	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
 
-	"io"
 	"net"
 	"net/url"
-	"os"
 
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
 )
 
-func ClientSetupTCP(socksAddr string, target string, ptClientProxy *url.URL, names []string, options string, clientHandler ClientHandlerTCP) (launched bool) {
+// ClientSetupTCP opens a listener for each of the client transports and
+// announces it to the parent process with a CMETHOD line for the protocol
+// spoken on it, or a CMETHOD-ERROR line if it could not be opened.
+func ClientSetupTCP(socksAddr string, target string, ptClientProxy *url.URL, names []string, options string, protocol string, clientHandler ClientHandlerTCP) (launched bool) {
+	limits, err := ClientRateLimits(options)
+	if err != nil {
+		log.Errorf("%s", err)
+		return false
+	}
+
 	// Launch each of the client listeners.
 	for _, name := range names {
 		ln, err := net.Listen("tcp", socksAddr)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to listen %s %s", name, err.Error())
 			log.Errorf("failed to listen %s %s", name, err.Error())
+			_ = pt.CmethodError(name, err.Error())
 			continue
 		}
 
-		go clientAcceptLoop(target, name, options, ln, ptClientProxy, clientHandler)
+		go clientAcceptLoop(target, name, options, ln, ptClientProxy, limits, clientHandler)
+		pt.Cmethod(name, protocol, ln.Addr())
 		log.Infof("%s - registered listener: %s", name, ln.Addr())
 		launched = true
 	}
+	pt.CmethodsDone()
 
 	return
 }
 
-func clientAcceptLoop(target string, name string, options string, ln net.Listener, proxyURI *url.URL, clientHandler ClientHandlerTCP) {
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			if e, ok := err.(net.Error); ok && !e.Temporary() {
-				fmt.Fprintf(os.Stderr, "Fatal listener error: %s", err.Error())
-				log.Errorf("Fatal listener error: %s", err.Error())
-				return
-			}
-			log.Errorf("Failed to accept connection: %s", err.Error())
-			continue
-		}
-
-		go clientHandler(target, name, options, conn, proxyURI)
-	}
-}
-
-func ServerSetupTCP(ptServerInfo pt.ServerInfo, stateDir string, options string, serverHandler ServerHandler) (launched bool) {
-	// Launch each of the server listeners.
-	for _, bindaddr := range ptServerInfo.Bindaddrs {
-		name := bindaddr.MethodName
-
-		// Deal with arguments.
-		listen, parseError := pt_extras.ArgsToListener(name, stateDir, options)
-		if parseError != nil {
-			return false
-		}
-
-		go func() {
-			for {
-				fmt.Println("listening on ", bindaddr.Addr.String())
-				transportLn := listen(bindaddr.Addr.String())
-				if transportLn == nil {
-					continue
-				}
-				log.Infof("%s - registered listener: %s", name, log.ElideAddr(bindaddr.Addr.String()))
-				ServerAcceptLoop(name, transportLn, &ptServerInfo, serverHandler)
-				transportLnErr := transportLn.Close()
-				if transportLnErr != nil {
-					fmt.Fprintf(os.Stderr, "Listener close error: %s", transportLnErr.Error())
-					log.Errorf("Listener close error: %s", transportLnErr.Error())
-				}
-			}
-		}()
-
-		launched = true
-	}
-
-	return
+func clientAcceptLoop(target string, name string, options string, ln net.Listener, proxyURI *url.URL, limits RateLimits, clientHandler ClientHandlerTCP) {
+	err := ServeClientTCP(ln, target, name, options, proxyURI, limits, clientHandler)
+	log.Errorf("Fatal listener error: %s", err.Error())
 }
 
-func CopyLoop(client net.Conn, server net.Conn) error {
-	fmt.Println("--> Entering copy loop.")
-
-	if server == nil {
-		fmt.Fprintln(os.Stderr, "--> Copy loop has a nil connection (b).")
-		return errors.New("copy loop has a nil connection (b)")
-	}
-
-	if client == nil {
-		fmt.Fprintln(os.Stderr, "--> Copy loop has a nil connection (a).")
-		return errors.New("copy loop has a nil connection (a)")
-	}
-
-	// Note: b is always the pt connection.  a is the SOCKS/ORPort connection.
-	okToCloseClientChannel := make(chan bool)
-	okToCloseServerChannel := make(chan bool)
-	copyErrorChannel := make(chan error)
-
-	go CopyClientToServer(client, server, okToCloseClientChannel, copyErrorChannel)
-
-	go CopyServerToClient(client, server, okToCloseServerChannel, copyErrorChannel)
-
-	serverRunning := true
-	clientRunning := true
-	var copyError error
-
-	for clientRunning || serverRunning {
-		select {
-			case <- okToCloseClientChannel:
-				clientRunning = false
-			case <- okToCloseServerChannel:
-				serverRunning = false
-			case copyError = <-copyErrorChannel:
-				log.Errorf("Error while copying")
-		}
-	}
-
-	client.Close()
-	server.Close()
-
-	return copyError
+// ServeClientTCP accepts application connections on ln for the named client
+// transport and runs clientHandler for each of them, until ln is closed.
+func ServeClientTCP(ln net.Listener, target string, name string, options string, proxyURI *url.URL, limits RateLimits, clientHandler ClientHandlerTCP) error {
+	return AcceptSessions(name, ln, func(conn net.Conn) {
+		limiter := NewRateLimiter(name, ln.Addr().String(), ClientIdentity(conn.RemoteAddr()), limits)
+		clientHandler(target, name, options, RateLimitConn(conn, limiter), proxyURI)
+	}, nil)
 }
 
-func CopyClientToServer(client net.Conn, server net.Conn, okToCloseClient chan bool, errorChannel chan error) {
-	_, copyError := io.Copy(server, client)
-	okToCloseClient <- true
-	if copyError != nil {
-		errorChannel <- copyError
-	}
+func ServerSetupTCP(ptServerInfo pt.ServerInfo, stateDir string, options string, serverHandler ServerHandler) (launched bool) {
+	return serverSetup(ptServerInfo, stateDir, options, true, serverHandler)
 }
-
-func CopyServerToClient(client net.Conn, server net.Conn, okToCloseServer chan bool, errorChannel chan error) {
-	_, copyError := io.Copy(client, server)
-	okToCloseServer <- true
-	if copyError != nil {
-		errorChannel <- copyError
-	}
-}
\ No newline at end of file
@@ -0,0 +1,307 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
+)
+
+// timeoutsOptionsKey is the key in the transport options that overrides the
+// timeouts for a transport, for example
+// {"timeouts": {"dial": "10s", "handshake": "20s", "idle": "5m"}}.  As with
+// "mux", client options contain it directly and server options contain it in
+// the options for each transport.
+const timeoutsOptionsKey = "timeouts"
+
+// Timeouts bounds how long connections may take or stay idle.  A zero value
+// disables the timeout.
+type Timeouts struct {
+	// Dial bounds making a network connection, to the transport server on
+	// the client, or to the ORPort or destination on the server.
+	Dial time.Duration
+
+	// Handshake bounds the transport handshake on the client, and how long
+	// the server waits for the client's first data on a new connection.
+	Handshake time.Duration
+
+	// Idle is how long a relayed connection may go without traffic in
+	// either direction before it is closed.
+	Idle time.Duration
+}
+
+// DefaultTimeouts are the timeouts used unless SetTimeouts is called.
+var DefaultTimeouts = Timeouts{
+	Dial:      30 * time.Second,
+	Handshake: 30 * time.Second,
+}
+
+var defaultTimeouts = DefaultTimeouts
+var serverTimeouts = make(map[string]Timeouts)
+var serverTimeoutsLock sync.Mutex
+
+// SetTimeouts configures the timeouts for transports that do not override
+// them in their options.  It must be called before any listeners are
+// started.
+func SetTimeouts(timeouts Timeouts) {
+	defaultTimeouts = timeouts
+}
+
+// ClientTimeouts returns the timeouts for a client transport, from the
+// defaults and the client transport options.
+func ClientTimeouts(options string) (Timeouts, error) {
+	return parseTimeouts(clientOption(options, timeoutsOptionsKey))
+}
+
+// ServerTimeouts returns the timeouts for the named server transport, from
+// the defaults and the server transport options.
+func ServerTimeouts(name string, options string) (Timeouts, error) {
+	return parseTimeouts(serverOption(name, options, timeoutsOptionsKey))
+}
+
+func parseTimeouts(raw json.RawMessage) (Timeouts, error) {
+	timeouts := defaultTimeouts
+	if raw == nil {
+		return timeouts, nil
+	}
+
+	var args map[string]string
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return timeouts, fmt.Errorf("could not parse timeouts options")
+	}
+
+	for key, value := range args {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration < 0 {
+			return timeouts, fmt.Errorf("invalid %s timeout %q", key, value)
+		}
+
+		switch key {
+		case "dial":
+			timeouts.Dial = duration
+		case "handshake":
+			timeouts.Handshake = duration
+		case "idle":
+			timeouts.Idle = duration
+		default:
+			return timeouts, fmt.Errorf("unknown timeout %q", key)
+		}
+	}
+
+	return timeouts, nil
+}
+
+// registeredServerTimeouts returns the timeouts of the named server
+// transport, as registered by the server setup.
+func registeredServerTimeouts(name string) Timeouts {
+	serverTimeoutsLock.Lock()
+	defer serverTimeoutsLock.Unlock()
+
+	if timeouts, ok := serverTimeouts[name]; ok {
+		return timeouts
+	}
+
+	return defaultTimeouts
+}
+
+// timeoutServerHandler registers the timeouts of a server transport and
+// wraps its handler to apply them.  For TCP (stream is true), the client has
+// to send its first data within the handshake timeout, and idle connections
+// are closed by CopyLoop.  For UDP, sessions end when nothing has been
+// received from the client for the idle timeout.
+func timeoutServerHandler(name string, timeouts Timeouts, stream bool, serverHandler ServerHandler) ServerHandler {
+	serverTimeoutsLock.Lock()
+	serverTimeouts[name] = timeouts
+	serverTimeoutsLock.Unlock()
+
+	return func(name string, remote net.Conn, info *pt.ServerInfo) {
+		if stream && timeouts.Handshake > 0 {
+			_ = remote.SetReadDeadline(time.Now().Add(timeouts.Handshake))
+		}
+
+		serverHandler(name, newIdleConn(remote, timeouts.Idle, !stream), info)
+	}
+}
+
+// TimeoutError is returned when an operation does not complete in time.
+type TimeoutError struct {
+	Operation string
+	After     time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %s", e.Operation, e.After)
+}
+
+// Timeout reports that the error is a timeout, as net.Error.
+func (e *TimeoutError) Timeout() bool { return true }
+
+// Temporary reports that the error is temporary, as net.Error.
+func (e *TimeoutError) Temporary() bool { return true }
+
+// dialWithTimeout calls dial, and gives up if it does not return within
+// timeout.  A connection that is made after giving up is closed.
+func dialWithTimeout(operation string, timeout time.Duration, dial func() (net.Conn, error)) (net.Conn, error) {
+	if timeout <= 0 {
+		return dial()
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		conn, err := dial()
+		results <- result{conn, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-results:
+		return r.conn, r.err
+	case <-timer.C:
+		go func() {
+			if r := <-results; r.conn != nil {
+				_ = r.conn.Close()
+			}
+		}()
+		log.Warnf("%s timed out after %s", operation, timeout)
+		return nil, &TimeoutError{operation, timeout}
+	}
+}
+
+// idleConn is a connection with an idle timeout.  CopyLoop closes relayed
+// connections that stay idle for longer than the timeout, and if rolling is
+// set every read also times out after it.
+type idleConn struct {
+	net.Conn
+	idleTimeout time.Duration
+	rolling     bool
+}
+
+func newIdleConn(conn net.Conn, idleTimeout time.Duration, rolling bool) net.Conn {
+	if idleTimeout <= 0 {
+		return conn
+	}
+
+	return &idleConn{Conn: conn, idleTimeout: idleTimeout, rolling: rolling}
+}
+
+func (conn *idleConn) Read(b []byte) (int, error) {
+	if conn.rolling {
+		_ = conn.Conn.SetReadDeadline(time.Now().Add(conn.idleTimeout))
+	}
+
+	return conn.Conn.Read(b)
+}
+
+func (conn *idleConn) CloseWrite() error {
+	return CloseWrite(conn.Conn)
+}
+
+// IdleTimeout returns the idle timeout of the connection.
+func (conn *idleConn) IdleTimeout() time.Duration {
+	return conn.idleTimeout
+}
+
+// idleTimeoutOf returns the shortest idle timeout of the connections, or 0
+// if neither has one.
+func idleTimeoutOf(conns ...net.Conn) time.Duration {
+	var timeout time.Duration
+	for _, conn := range conns {
+		if c, ok := conn.(interface{ IdleTimeout() time.Duration }); ok {
+			if t := c.IdleTimeout(); t > 0 && (timeout == 0 || t < timeout) {
+				timeout = t
+			}
+		}
+	}
+
+	return timeout
+}
+
+// idleCheckInterval is how often CopyLoop checks for an idle timeout.
+func idleCheckInterval(idleTimeout time.Duration) time.Duration {
+	interval := idleTimeout / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+
+	return interval
+}
+
+// activityTracker records when data was last relayed.
+type activityTracker struct {
+	last int64
+}
+
+func newActivityTracker() *activityTracker {
+	return &activityTracker{last: time.Now().UnixNano()}
+}
+
+func (a *activityTracker) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+func (a *activityTracker) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&a.last)))
+}
+
+// activityConn records reads and writes on a connection in a tracker.
+type activityConn struct {
+	net.Conn
+	activity *activityTracker
+}
+
+func (conn *activityConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	if n > 0 {
+		conn.activity.touch()
+	}
+
+	return n, err
+}
+
+func (conn *activityConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	if n > 0 {
+		conn.activity.touch()
+	}
+
+	return n, err
+}
+
+func (conn *activityConn) CloseWrite() error {
+	return CloseWrite(conn.Conn)
+}
@@ -0,0 +1,106 @@
+package modes
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
+)
+
+// TestParseTimeouts tests the client and server forms of the timeouts
+// options.
+func TestParseTimeouts(t *testing.T) {
+	timeouts, err := ClientTimeouts(`{"cert": "abc"}`)
+	if err != nil || timeouts != DefaultTimeouts {
+		t.Errorf("got %+v, %v without the timeouts option, expected the defaults", timeouts, err)
+	}
+
+	timeouts, err = ClientTimeouts(`{"timeouts": {"dial": "5s", "idle": "1m"}}`)
+	if err != nil {
+		t.Fatal("ClientTimeouts failed:", err)
+	}
+	expected := Timeouts{Dial: 5 * time.Second, Handshake: DefaultTimeouts.Handshake, Idle: time.Minute}
+	if timeouts != expected {
+		t.Errorf("got %+v, expected %+v", timeouts, expected)
+	}
+
+	timeouts, err = ServerTimeouts("obfs2", `{"obfs2": {"timeouts": {"handshake": "2s"}}}`)
+	if err != nil || timeouts.Handshake != 2*time.Second {
+		t.Errorf("got %+v, %v, expected a 2s handshake timeout", timeouts, err)
+	}
+
+	for _, options := range []string{
+		`{"timeouts": {"dial": "soon"}}`,
+		`{"timeouts": {"dial": "-1s"}}`,
+		`{"timeouts": {"connect": "1s"}}`,
+		`{"timeouts": "1s"}`,
+	} {
+		if _, err = ClientTimeouts(options); err == nil {
+			t.Errorf("ClientTimeouts accepted %s", options)
+		}
+	}
+}
+
+// TestDialWithTimeout tests that a dial that does not return in time fails
+// with a timeout error.
+func TestDialWithTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	dial := func() (net.Conn, error) {
+		time.Sleep(200 * time.Millisecond)
+		return client, nil
+	}
+
+	_, err := dialWithTimeout("test dial", 20*time.Millisecond, dial)
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("got %v, expected a timeout error", err)
+	}
+}
+
+// TestCopyLoopIdleTimeout tests that CopyLoop closes connections that carry
+// no traffic for the idle timeout.
+func TestCopyLoopIdleTimeout(t *testing.T) {
+	app, client := net.Pipe()
+	server, remote := net.Pipe()
+	defer app.Close()
+	defer remote.Close()
+
+	done := make(chan struct{})
+	go func() {
+		_ = CopyLoop(client, newIdleConn(server, 50*time.Millisecond, false))
+		close(done)
+	}()
+
+	if _, err := app.Write([]byte("ping")); err != nil {
+		t.Fatal("write failed:", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := remote.Read(buf); err != nil {
+		t.Fatal("read failed:", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle connection was not closed")
+	}
+}
+
+// TestServerHandlerIdleTimeout tests that the connections passed to a
+// wrapped server handler keep the idle timeout from the server options.
+func TestServerHandlerIdleTimeout(t *testing.T) {
+	handler, err := WrapServerHandler("idletest", "127.0.0.1:1", `{"idletest": {"timeouts": {"idle": "1m"}}}`, true, func(name string, remote net.Conn, info *pt.ServerInfo) {
+		if timeout := idleTimeoutOf(remote); timeout != time.Minute {
+			t.Errorf("got an idle timeout of %s, expected 1m", timeout)
+		}
+	})
+	if err != nil {
+		t.Fatal("WrapServerHandler failed:", err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	handler("idletest", server, nil)
+}
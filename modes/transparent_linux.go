@@ -0,0 +1,268 @@
+//go:build linux
+// +build linux
+
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"golang.org/x/sys/unix"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST (and IP6T_SO_ORIGINAL_DST) from
+// linux/netfilter_ipv4.h, which is not exported by golang.org/x/sys/unix.
+const soOriginalDst = 80
+
+// ListenTransparentTCP listens for TCP connections that were redirected to
+// address by iptables/nftables, using either the REDIRECT or TPROXY target.
+// TPROXY additionally requires IP_TRANSPARENT, which needs CAP_NET_ADMIN, so
+// failing to set it is not fatal.
+func ListenTransparentTCP(address string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		return c.Control(func(fd uintptr) {
+			if err := setTransparent(int(fd), network); err != nil {
+				log.Warnf("could not set IP_TRANSPARENT, only REDIRECT will work: %s", err)
+			}
+		})
+	}}
+
+	return lc.Listen(context.Background(), "tcp", address)
+}
+
+// OriginalDestination recovers the address that the client of a redirected
+// TCP connection originally tried to reach.  For REDIRECT this is obtained
+// from conntrack with SO_ORIGINAL_DST, for TPROXY it is the local address of
+// the accepted socket.
+func OriginalDestination(conn net.Conn, listenAddr net.Addr) (*net.TCPAddr, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("original destination requires a TCP connection")
+	}
+	localAddr, ok := tcpConn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, errors.New("could not determine local address")
+	}
+
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var destination *net.TCPAddr
+	var sockoptErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		if localAddr.IP.To4() != nil {
+			destination, sockoptErr = originalDestinationIPv4(int(fd))
+		} else {
+			destination, sockoptErr = originalDestinationIPv6(int(fd))
+		}
+	}); err != nil {
+		return nil, err
+	}
+	if sockoptErr != nil {
+		// Not tracked by conntrack, so this is either TPROXY or a direct
+		// connection.
+		destination = localAddr
+	}
+
+	if isListenAddr(destination.IP, destination.Port, listenAddr) {
+		return nil, errors.New("connection was not redirected")
+	}
+
+	return destination, nil
+}
+
+func originalDestinationIPv4(fd int) (*net.TCPAddr, error) {
+	// The kernel fills in a struct sockaddr_in, which fits in the larger
+	// struct ipv6_mreq.
+	mreq, err := unix.GetsockoptIPv6Mreq(fd, unix.SOL_IP, soOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := mreq.Multiaddr
+	return &net.TCPAddr{
+		IP:   net.IPv4(raw[4], raw[5], raw[6], raw[7]),
+		Port: int(binary.BigEndian.Uint16(raw[2:4])),
+	}, nil
+}
+
+func originalDestinationIPv6(fd int) (*net.TCPAddr, error) {
+	// The kernel fills in a struct sockaddr_in6, which fits in the larger
+	// struct ip6_mtuinfo.
+	info, err := unix.GetsockoptIPv6MTUInfo(fd, unix.SOL_IPV6, soOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+
+	port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, info.Addr.Addr[:])
+	return &net.TCPAddr{
+		IP:   ip,
+		Port: int(binary.BigEndian.Uint16(port[:])),
+	}, nil
+}
+
+// ListenTransparentUDP listens for UDP packets that were redirected to
+// address by the TPROXY target, and asks the kernel to report the original
+// destination of each packet.
+func ListenTransparentUDP(address string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var sockoptErr error
+		if err := c.Control(func(fd uintptr) {
+			if err := setTransparent(int(fd), network); err != nil {
+				log.Warnf("could not set IP_TRANSPARENT: %s", err)
+			}
+			sockoptErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1)
+			if sockoptErr == nil && network != "udp4" {
+				// Best effort, this fails on IPv4 only sockets.
+				_ = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1)
+			}
+		}); err != nil {
+			return err
+		}
+		return sockoptErr
+	}}
+
+	conn, err := lc.ListenPacket(context.Background(), "udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.(*net.UDPConn), nil
+}
+
+// ReadFromUDPOriginalDst reads a packet from a socket created by
+// ListenTransparentUDP, and returns the sender and the original destination
+// of the packet.
+func ReadFromUDPOriginalDst(conn *net.UDPConn, b []byte) (n int, source *net.UDPAddr, destination *net.UDPAddr, err error) {
+	oob := make([]byte, 128)
+	n, oobn, _, source, err := conn.ReadMsgUDP(b, oob)
+	if err != nil {
+		return n, source, nil, err
+	}
+
+	messages, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return n, source, nil, err
+	}
+
+	for _, message := range messages {
+		data := message.Data
+		switch {
+		case message.Header.Level == unix.SOL_IP && message.Header.Type == unix.IP_ORIGDSTADDR && len(data) >= 8:
+			destination = &net.UDPAddr{
+				IP:   net.IPv4(data[4], data[5], data[6], data[7]),
+				Port: int(binary.BigEndian.Uint16(data[2:4])),
+			}
+		case message.Header.Level == unix.SOL_IPV6 && message.Header.Type == unix.IPV6_ORIGDSTADDR && len(data) >= 24:
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, data[8:24])
+			destination = &net.UDPAddr{
+				IP:   ip,
+				Port: int(binary.BigEndian.Uint16(data[2:4])),
+			}
+		}
+	}
+
+	if destination == nil || isListenAddr(destination.IP, destination.Port, conn.LocalAddr()) {
+		return n, source, nil, errors.New("packet was not redirected")
+	}
+
+	return n, source, destination, nil
+}
+
+// DialUDPFrom returns a UDP socket bound to the non-local address local and
+// connected to remote.  It is used to send replies to TPROXY clients so that
+// they appear to come from the original destination.
+func DialUDPFrom(local *net.UDPAddr, remote *net.UDPAddr) (*net.UDPConn, error) {
+	dialer := net.Dialer{
+		LocalAddr: local,
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockoptErr error
+			if err := c.Control(func(fd uintptr) {
+				if sockoptErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); sockoptErr != nil {
+					return
+				}
+				sockoptErr = setTransparent(int(fd), network)
+			}); err != nil {
+				return err
+			}
+			return sockoptErr
+		},
+	}
+
+	conn, err := dialer.Dial("udp", remote.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.(*net.UDPConn), nil
+}
+
+func setTransparent(fd int, network string) error {
+	switch network {
+	case "tcp4", "udp4":
+		return unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+	default:
+		if err := unix.SetsockoptInt(fd, unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1); err != nil {
+			return err
+		}
+		// Dual stack sockets also need the IPv4 option.
+		_ = unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+		return nil
+	}
+}
+
+// isListenAddr reports whether ip:port is the address a transparent
+// listener is bound to, meaning that the client connected to the listener
+// directly.
+func isListenAddr(ip net.IP, port int, listenAddr net.Addr) bool {
+	var listenIP net.IP
+	var listenPort int
+	switch addr := listenAddr.(type) {
+	case *net.TCPAddr:
+		listenIP, listenPort = addr.IP, addr.Port
+	case *net.UDPAddr:
+		listenIP, listenPort = addr.IP, addr.Port
+	default:
+		return false
+	}
+
+	if port != listenPort {
+		return false
+	}
+
+	return listenIP == nil || listenIP.IsUnspecified() || listenIP.Equal(ip)
+}
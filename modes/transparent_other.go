@@ -0,0 +1,60 @@
+//go:build !linux
+// +build !linux
+
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"errors"
+	"net"
+)
+
+var errTransparentUnsupported = errors.New("linux transparent proxying is only supported on Linux")
+
+// ListenTransparentTCP is only supported on Linux.
+func ListenTransparentTCP(address string) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
+
+// OriginalDestination is only supported on Linux.
+func OriginalDestination(conn net.Conn, listenAddr net.Addr) (*net.TCPAddr, error) {
+	return nil, errTransparentUnsupported
+}
+
+// ListenTransparentUDP is only supported on Linux.
+func ListenTransparentUDP(address string) (*net.UDPConn, error) {
+	return nil, errTransparentUnsupported
+}
+
+// ReadFromUDPOriginalDst is only supported on Linux.
+func ReadFromUDPOriginalDst(conn *net.UDPConn, b []byte) (n int, source *net.UDPAddr, destination *net.UDPAddr, err error) {
+	return 0, nil, nil, errTransparentUnsupported
+}
+
+// DialUDPFrom is only supported on Linux.
+func DialUDPFrom(local *net.UDPAddr, remote *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errTransparentUnsupported
+}
@@ -30,99 +30,82 @@
 package transparent_tcp
 
 import (
-	"fmt"
-	"os"
-
-	"github.com/OperatorFoundation/obfs4/common/log"
-	commonLog "github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
-	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
 	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
 
 	"net"
 	"net/url"
-
-	"golang.org/x/net/proxy"
 )
 
+// Version returns a string suitable to be included in a call to Cmethod.
+func Version() string {
+	return "transparent-TCP"
+}
+
 func ClientSetup(socksAddr string, target string, ptClientProxy *url.URL, names []string, options string) (launched bool) {
-	return modes.ClientSetupTCP(socksAddr, target, ptClientProxy, names, options, clientHandler)
+	return modes.ClientSetupTCP(socksAddr, target, ptClientProxy, names, options, Version(), ClientHandler)
 }
 
-func clientHandler(target string, name string, options string, conn net.Conn, proxyURI *url.URL) {
+// ClientHandler relays an application connection to one of the targets over
+// the named transport.
+func ClientHandler(target string, name string, options string, conn net.Conn, proxyURI *url.URL) {
 	if conn == nil {
-		fmt.Fprintln(os.Stderr, "--> Application connection is nil")
 		log.Errorf("%s - closed connection. Application connection is nil", name)
 		return
 	}
 
-	var dialer proxy.Dialer = proxy.Direct
-	if proxyURI != nil {
-		var err error
-		dialer, err = proxy.FromURL(proxyURI, proxy.Direct)
-		if err != nil {
-			// This should basically never happen, since config protocol
-			// verifies this.
-			fmt.Println("-> failed to obtain dialer", proxyURI, proxy.Direct)
-			log.Errorf("(%s) - failed to obtain proxy dialer: %s", target, commonLog.ElideError(err))
-			conn.Close()
-			return
-		}
-	}
-
-	// Deal with arguments.
-	transport, argsToDialerErr := pt_extras.ArgsToDialer(target, name, options, dialer)
-	if argsToDialerErr != nil {
-		log.Errorf("Error creating a transport with the provided options: %v", options)
-		log.Errorf("Error: %v", argsToDialerErr.Error())
-		fmt.Fprintln(os.Stderr, "-> Error creating a transport with the provided options: ", options)
-		fmt.Fprintln(os.Stderr, "-> Error: ", argsToDialerErr.Error())
+	// Create the outgoing connection, failing over between the targets.
+	session := modes.NewSessionID()
+	remote, target, dialErr := modes.DialTarget(name, session, target, options, proxyURI)
+	logger := modes.SessionLogger(name, session, target)
+	if dialErr != nil {
+		logger.Errorf("unable to dial transport server: %s", log.ElideError(dialErr))
 		conn.Close()
 		return
 	}
-
-	fmt.Println("Dialing ", target)
-	remote, dialErr := transport.Dial()
-	if dialErr != nil {
-		fmt.Fprintln(os.Stderr, "--> Unable to dial transport server: ", dialErr.Error())
-		fmt.Fprintln(os.Stderr, "-> Name: ", name)
-		fmt.Fprintln(os.Stderr, "-> Options: ", options)
-		log.Errorf("--> Unable to dial transport server: %v", dialErr.Error())
+	if remote == nil {
+		logger.Errorf("closed connection. Transport server connection is nil")
 		conn.Close()
 		return
 	}
-	if remote == nil {
-		fmt.Fprintln(os.Stderr, "--> Transport server connection is nil.")
-		log.Errorf("%s - closed connection. Transport server connection is nil", name)
+	if err := modes.WriteClientDestination(remote); err != nil {
+		logger.Errorf("failed to send destination: %s", log.ElideError(err))
+		remote.Close()
 		conn.Close()
 		return
 	}
 
-	if err := modes.CopyLoop(conn, remote); err != nil {
-		log.Errorf("%s(%s) - closed connection: %s", name, target, commonLog.ElideError(err))
-		fmt.Fprintf(os.Stderr, "%s(%s) - closed connection: %s", name, target, commonLog.ElideError(err))
+	if err := modes.CopyLoop(modes.CaptureConn(conn, session, modes.CaptureApplication), remote); err != nil {
+		logger.Errorf("closed connection: %s", log.ElideError(err))
 	} else {
-		log.Infof("%s(%s) - closed connection", name, target)
-		fmt.Fprintf(os.Stderr, "%s(%s) - closed connection", name, target)
+		logger.Infof("closed connection")
 	}
 }
 
 func ServerSetup(ptServerInfo pt.ServerInfo, statedir string, options string) (launched bool) {
-	return modes.ServerSetupTCP(ptServerInfo, statedir, options, serverHandler)
+	return modes.ServerSetupTCP(ptServerInfo, statedir, options, ServerHandler)
 }
 
-func serverHandler(name string, remote net.Conn, info *pt.ServerInfo) {
-	// Connect to the orport.
-	orConn, err := pt.DialOr(info, remote.RemoteAddr().String(), name)
+// ServerHandler relays a transport connection to the ORPort, or to the
+// client's destination in exit mode.
+func ServerHandler(name string, remote net.Conn, info *pt.ServerInfo) {
+	session := modes.SessionID(remote)
+	logger := modes.SessionLogger(name, session, remote.RemoteAddr().String())
+	logger.Infof("new connection")
+
+	// Connect to the orport, or the client's destination in exit mode.
+	orConn, err := modes.DialServer("tcp", name, remote, info)
 	if err != nil {
-		log.Errorf("%s - failed to connect to ORPort: %s", name, log.ElideError(err))
+		logger.Errorf("failed to connect to ORPort: %s", log.ElideError(err))
 		remote.Close()
 		return
 	}
+	orConn = modes.CaptureConn(orConn, session, modes.CaptureApplication)
 
 	if err = modes.CopyLoop(orConn, remote); err != nil {
-		log.Warnf("%s - closed connection: %s", name, log.ElideError(err))
+		logger.Warnf("closed connection: %s", log.ElideError(err))
 	} else {
-		log.Infof("%s - closed connection", name)
+		logger.Infof("closed connection")
 	}
 }
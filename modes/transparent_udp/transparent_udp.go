@@ -32,40 +32,51 @@ package transparent_udp
 import (
 	"bytes"
 	"encoding/binary"
-	"fmt"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
 	"github.com/OperatorFoundation/shapeshifter-ipc/v2"
 
 	"io"
-	golog "log"
 	"net"
 	"net/url"
 )
 
+// Version returns a string suitable to be included in a call to Cmethod.
+func Version() string {
+	return "transparent-UDP"
+}
+
 func ClientSetup(socksAddr string, target string, ptClientProxy *url.URL, names []string, options string) bool {
-	return modes.ClientSetupUDP(socksAddr, target, ptClientProxy, names, options, clientHandler)
+	return modes.ClientSetupUDP(socksAddr, target, ptClientProxy, names, options, Version(), clientHandler)
 }
 
 func clientHandler(target string, name string, options string, conn *net.UDPConn, proxyURI *url.URL) {
 	var length16 uint16
 
-	tracker := make(modes.ConnTracker)
+	tracker := modes.NewConnTracker()
 
-	buf := make([]byte, 1024)
+	// Packets are read after the length in the frame, so that they are sent
+	// without copying.
+	frame := modes.GetPacketBuffer()
+	defer modes.PutPacketBuffer(frame)
+	buf := frame[2 : 2+65535]
 
-	// Receive UDP packets and forward them over transport connections forever
+	// Receive UDP packets and forward them over transport connections until
+	// the listener is closed.
 	for {
 		numBytes, addr, err := conn.ReadFromUDP(buf)
 		if err != nil {
-			fmt.Println("Error: ", err)
+			if e, ok := err.(net.Error); ok && !e.Temporary() {
+				log.Errorf("%s - fatal listener error: %s", name, log.ElideError(err))
+				return
+			}
+			log.Warnf("%s - failed to read packet: %s", name, log.ElideError(err))
+			continue
 		}
 
 		goodBytes := buf[:numBytes]
 
-		fmt.Println(tracker)
-
-		if state, ok := tracker[addr.String()]; ok {
+		if state, ok := tracker.Get(addr.String()); ok {
 			// There is an open transport connection, or a connection attempt is in progress.
 
 			if state.Waiting {
@@ -74,40 +85,58 @@ func clientHandler(target string, name string, options string, conn *net.UDPConn
 			} else {
 				// There is an open transport connection.
 				// Send the packet through the transport.
+				// The length and data are written together, so that a
+				// packet dropped by the rate limit does not break the framing.
 				length16 = uint16(numBytes)
-				lengthBuf := new(bytes.Buffer)
-				err = binary.Write(lengthBuf, binary.LittleEndian, length16)
-				if err != nil {
-					fmt.Println("binary.Write failed:", err)
-				} else {
-					println("writing data to server")
-					println(len(lengthBuf.Bytes()))
-					_, writErr := state.Conn.Write(lengthBuf.Bytes())
-					if writErr != nil {
-						continue
-					} else {
-						println("writing data to server")
-						println(len(goodBytes))
-						_, writeBufErr := state.Conn.Write(goodBytes)
-						if writeBufErr != nil {
-							_ = state.Conn.Close()
-							_ = conn.Close()
-						}
-
-					}
+				binary.LittleEndian.PutUint16(frame, length16)
+				log.Debugf("%s - sending a packet of %d bytes to the server", name, len(goodBytes))
+				_, writeErr := state.Conn.Write(frame[:2+numBytes])
+				if writeErr != nil {
+					// Only this application's connection has failed.  The
+					// next packet opens a new one.
+					log.Debugf("%s - failed to send packet: %s", name, log.ElideError(writeErr))
+					_ = state.Conn.Close()
+					tracker.Remove(addr.String(), state.Conn)
 				}
 			}
 		} else {
 			// There is not an open transport connection and a connection attempt is not in progress.
 			// Open a transport connection.
 
-			modes.OpenConnection(&tracker, addr.String(), target, name, options, proxyURI)
+			source := addr
+			modes.OpenConnection(tracker, addr.String(), conn.LocalAddr().String(), target, name, options, proxyURI, func(remote net.Conn) {
+				relayReplies(name, remote, conn, source)
+			})
 
 			// Drop the packet.
 		}
 	}
 }
 
+// relayReplies sends the packets that the server sends back over remote to
+// the application at source, until the connection fails.
+func relayReplies(name string, remote net.Conn, conn *net.UDPConn, source *net.UDPAddr) {
+	buf := modes.GetPacketBuffer()
+	defer modes.PutPacketBuffer(buf)
+
+	for {
+		if _, err := io.ReadFull(remote, buf[:2]); err != nil {
+			log.Debugf("%s - failed to read reply length: %s", name, log.ElideError(err))
+			return
+		}
+		packet := buf[:binary.LittleEndian.Uint16(buf[:2])]
+		if _, err := io.ReadFull(remote, packet); err != nil {
+			log.Debugf("%s - failed to read reply: %s", name, log.ElideError(err))
+			return
+		}
+
+		log.Debugf("%s - sending a reply of %d bytes to the application", name, len(packet))
+		if _, err := conn.WriteToUDP(packet, source); err != nil {
+			log.Debugf("%s - failed to send reply: %s", name, log.ElideError(err))
+		}
+	}
+}
+
 func ServerSetup(ptServerInfo pt.ServerInfo, stateDir string, options string) (launched bool) {
 	return modes.ServerSetupUDP(ptServerInfo, stateDir, options, serverHandler)
 }
@@ -115,61 +144,70 @@ func ServerSetup(ptServerInfo pt.ServerInfo, stateDir string, options string) (l
 func serverHandler(name string, remote net.Conn, info *pt.ServerInfo) {
 	var length16 uint16
 
-	addrStr := log.ElideAddr(remote.RemoteAddr().String())
-	fmt.Println("### handling", name)
-	log.Infof("%s(%s) - new connection", name, addrStr)
+	session := modes.SessionID(remote)
+	logger := modes.SessionLogger(name, session, remote.RemoteAddr().String())
+	logger.Infof("new connection")
 
-	serverAddr, err := net.ResolveUDPAddr("udp", info.OrAddr.String())
+	// Connect to the orport, or the client's destination in exit mode.
+	dest, err := modes.DialServer("udp", name, remote, info)
 	if err != nil {
-		golog.Fatal(err)
+		logger.Errorf("failed to connect to ORPort: %s", log.ElideError(err))
+		_ = remote.Close()
+		return
 	}
-
-	localAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
-	if err != nil {
-		golog.Fatal(err)
-	}
-
-	dest, err := net.DialUDP("udp", localAddr, serverAddr)
-	if err != nil {
-		golog.Fatal(err)
-	}
-
-	fmt.Println("pumping")
+	dest = modes.CaptureConn(dest, session, modes.CaptureApplication)
+
+	// Relay replies from the destination back to the client.  The length
+	// and data of each reply are written together, as the client does.
+	go func() {
+		defer remote.Close()
+		frame := modes.GetPacketBuffer()
+		defer modes.PutPacketBuffer(frame)
+		for {
+			numBytes, err := dest.Read(frame[2 : 2+65535])
+			if err != nil {
+				return
+			}
+			binary.LittleEndian.PutUint16(frame, uint16(numBytes))
+			if _, err = remote.Write(frame[:2+numBytes]); err != nil {
+				return
+			}
+		}
+	}()
 
 	lengthBuffer := make([]byte, 2)
+	readBuffer := modes.GetPacketBuffer()
+	defer modes.PutPacketBuffer(readBuffer)
 
 	for {
-		fmt.Println("reading...")
 		// Read the incoming connection into the buffer.
-		readLen, err := io.ReadFull(remote, lengthBuffer)
+		_, err := io.ReadFull(remote, lengthBuffer)
 		if err != nil {
-			fmt.Println("read error")
+			logger.Debugf("failed to read packet length: %s", log.ElideError(err))
 			break
 		}
 
-		fmt.Println(readLen)
-
 		err = binary.Read(bytes.NewReader(lengthBuffer), binary.LittleEndian, &length16)
 		if err != nil {
-			fmt.Println("deserialization error")
+			logger.Errorf("failed to decode packet length: %s", err)
 			_ = dest.Close()
 			return
 		}
 
-		fmt.Println("reading data")
-		fmt.Println(length16)
-		readBuffer := make([]byte, length16)
-		readLen, err = io.ReadFull(remote, readBuffer)
+		logger.Debugf("reading a packet of %d bytes", length16)
+		packet := readBuffer[:length16]
+		readLen, err := io.ReadFull(remote, packet)
 		if err != nil {
-			fmt.Println("read error")
+			logger.Debugf("failed to read packet: %s", log.ElideError(err))
 			break
 		}
 		if readLen != int(length16) {
-			println("short read")
+			logger.Warnf("short read of a packet")
 			break
 		}
-		_, _ = dest.Write(readBuffer)
+		_, _ = dest.Write(packet)
 	}
 
 	_ = dest.Close()
+	logger.Infof("closed connection")
 }
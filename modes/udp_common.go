@@ -26,61 +26,48 @@ package modes
 
 import (
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
-	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
 	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
 
 	"net"
 	"net/url"
 )
 
-func ClientSetupUDP(socksAddr string, target string, ptClientProxy *url.URL, names []string, options string, clientHandler ClientHandlerUDP) bool {
+// ClientSetupUDP opens a listener for each of the client transports and
+// announces it to the parent process with a CMETHOD line for the protocol
+// spoken on it, or a CMETHOD-ERROR line if it could not be opened.
+func ClientSetupUDP(socksAddr string, target string, ptClientProxy *url.URL, names []string, options string, protocol string, clientHandler ClientHandlerUDP) (launched bool) {
+	if _, err := ClientRateLimits(options); err != nil {
+		log.Errorf("%s", err)
+		return false
+	}
+
 	// Launch each of the client listeners.
 	for _, name := range names {
 		udpAddr, err := net.ResolveUDPAddr("udp", socksAddr)
 		if err != nil {
 			log.Errorf("Error resolving address %s", socksAddr)
+			_ = pt.CmethodError(name, err.Error())
+			continue
 		}
 
 		ln, err := net.ListenUDP("udp", udpAddr)
 		if err != nil {
 			log.Errorf("failed to listen %s %s", name, err.Error())
+			_ = pt.CmethodError(name, err.Error())
 			continue
 		}
 
 		log.Infof("%s - registered listener", name)
+		pt.Cmethod(name, protocol, ln.LocalAddr())
 
 		go clientHandler(target, name, options, ln, ptClientProxy)
+		launched = true
 	}
+	pt.CmethodsDone()
 
-	return true
+	return
 }
 
 func ServerSetupUDP(ptServerInfo pt.ServerInfo, stateDir string, options string, serverHandler ServerHandler) (launched bool) {
-	// Launch each of the server listeners.
-	for _, bindaddr := range ptServerInfo.Bindaddrs {
-		name := bindaddr.MethodName
-
-		// Deal with arguments.
-		listen, parseError := pt_extras.ArgsToListener(name, stateDir, options)
-		if parseError != nil {
-			return false
-		}
-
-
-		go func() {
-			for {
-				transportLn := listen(bindaddr.Addr.String())
-				log.Infof("%s - registered listener: %s", name, log.ElideAddr(bindaddr.Addr.String()))
-				ServerAcceptLoop(name, transportLn, &ptServerInfo, serverHandler)
-				transportLnErr := transportLn.Close()
-				if transportLnErr != nil {
-					log.Errorf("Listener close error: %s", transportLnErr.Error())
-				}
-			}
-		}()
-
-		launched = true
-	}
-
-	return
+	return serverSetup(ptServerInfo, stateDir, options, false, serverHandler)
 }
@@ -119,15 +119,15 @@ func validatetarget(targetHost *string, targetPort *string, targetAddr *string)
 
 func validatetargetSocks5(targetHost *string, targetPort *string, targetAddr *string) error {
 	if *targetHost != "" {
-		return errors.New("you cannot specify --targethost in socks5 mode")
+		return errors.New("you cannot specify --targethost in socks5 or http-connect mode")
 	}
 
 	if *targetPort != "" {
-		return errors.New("you cannot specify --targetport in socks5 mode")
+		return errors.New("you cannot specify --targetport in socks5 or http-connect mode")
 	}
 
 	if *targetAddr != "" {
-		return errors.New("you cannot specify --target in socks5 mode")
+		return errors.New("you cannot specify --target in socks5 or http-connect mode")
 	}
 
 	return nil
@@ -152,6 +152,14 @@ func validateMode(mode *string, transparent *bool, udp *bool) error {
 			return nil
 		case "STUN":
 			return nil
+		case "http-connect":
+			return nil
+		case "linux-transparent-TCP":
+			return nil
+		case "linux-transparent-UDP":
+			return nil
+		case "reverse":
+			return nil
 		default:
 			return errors.New("invalid mode")
 		}
@@ -0,0 +1,514 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+// Package replay replays traces of application traffic through a client and
+// server dispatcher pair on loopback, to regression test transports with
+// realistic traffic.
+//
+// A trace is a capture file in the format written by the -capture flag, as
+// described in the modes package: the application side capture of a client
+// session can be replayed as it is.  Records received from the application
+// are sent from the client to the server, and records sent to the
+// application are sent from the server to the client, each at its recorded
+// time after the first record.
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/transparent_tcp"
+	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
+)
+
+// Config configures the dispatcher pair that traces are replayed through.
+type Config struct {
+	// Transport is the name of the transport to use.
+	Transport string
+
+	// ClientOptions are the client transport options.  If empty, the
+	// arguments that the server announces for its clients are used.
+	ClientOptions string
+
+	// ServerOptions are the server transport options.
+	ServerOptions string
+
+	// StateDir is the state directory of the server.
+	StateDir string
+
+	// Speed scales the time between the records of a trace: 2 replays
+	// twice as fast as recorded, and 0 replays as fast as possible.
+	Speed float64
+
+	// Timeout bounds the replay of each trace.
+	Timeout time.Duration
+}
+
+// Harness is a client and server dispatcher pair in transparent-TCP mode,
+// listening on loopback.  The server forwards its connections to a listener
+// of the harness that plays the server side of the traces.
+type Harness struct {
+	config     Config
+	clientAddr string
+	app        *net.TCPListener
+	server     net.Listener
+	client     net.Listener
+}
+
+// Start launches the dispatcher pair for config.  The shadow server rejects
+// the replayed connections of a client in the same process, since they share
+// the salt filter that protects servers from replays, unless the filter is
+// disabled by setting SHADOWSOCKS_SF_CAPACITY to -1, as Main does.
+func Start(config Config) (*Harness, error) {
+	harness := &Harness{config: config}
+	if err := harness.start(); err != nil {
+		_ = harness.Close()
+		return nil, err
+	}
+
+	return harness, nil
+}
+
+func (harness *Harness) start() error {
+	config := harness.config
+	app, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return err
+	}
+	harness.app = app
+
+	serverAddr, err := freeAddr()
+	if err != nil {
+		return err
+	}
+	info := pt.ServerInfo{
+		Bindaddrs: []pt.Bindaddr{{MethodName: config.Transport, Addr: serverAddr}},
+		OrAddr:    app.Addr().(*net.TCPAddr),
+	}
+	listen, err := pt_extras.ArgsToListener(config.Transport, config.StateDir, config.ServerOptions)
+	if err != nil {
+		return err
+	}
+	handler, err := modes.WrapServerHandler(config.Transport, serverAddr.String(), config.ServerOptions, true, transparent_tcp.ServerHandler)
+	if err != nil {
+		return err
+	}
+	if harness.server = listen(serverAddr.String()); harness.server == nil {
+		return fmt.Errorf("could not launch the %s server", config.Transport)
+	}
+	go modes.ServerAcceptLoop(config.Transport, harness.server, &info, handler)
+
+	clientOptions := config.ClientOptions
+	if clientOptions == "" {
+		args, argsErr := pt_extras.ListenerArgs(config.Transport, config.StateDir)
+		if argsErr != nil {
+			return argsErr
+		}
+		if len(args) > 0 {
+			encoded, _ := json.Marshal(args)
+			clientOptions = string(encoded)
+		}
+	}
+	limits, err := modes.ClientRateLimits(clientOptions)
+	if err != nil {
+		return err
+	}
+
+	if harness.client, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		return err
+	}
+	harness.clientAddr = harness.client.Addr().String()
+	go func() {
+		_ = modes.ServeClientTCP(harness.client, serverAddr.String(), config.Transport, clientOptions, nil, limits, transparent_tcp.ClientHandler)
+	}()
+
+	return nil
+}
+
+// Close stops the dispatcher pair by closing its listeners.
+func (harness *Harness) Close() error {
+	if harness.client != nil {
+		_ = harness.client.Close()
+	}
+	if harness.server != nil {
+		_ = harness.server.Close()
+	}
+	if harness.app != nil {
+		return harness.app.Close()
+	}
+
+	return nil
+}
+
+// freeAddr returns a loopback address that is not in use.
+func freeAddr() (*net.TCPAddr, error) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+
+	return ln.Addr().(*net.TCPAddr), nil
+}
+
+// Result is the outcome of replaying a trace.
+type Result struct {
+	// Trace is the name of the trace.
+	Trace string
+
+	// Upstream and Downstream are the numbers of bytes in the trace from
+	// the client to the server and from the server to the client.
+	Upstream   int64
+	Downstream int64
+
+	// Err is why the trace was not delivered byte for byte, or nil.
+	Err error
+
+	// Latencies are how long each record took to be delivered in full.
+	Latencies []time.Duration
+
+	// Duration is the time from the first record being sent to the last
+	// being delivered.
+	Duration time.Duration
+}
+
+// MeanLatency returns the mean time that records took to be delivered.
+func (result Result) MeanLatency() time.Duration {
+	if len(result.Latencies) == 0 {
+		return 0
+	}
+
+	var total time.Duration
+	for _, latency := range result.Latencies {
+		total += latency
+	}
+
+	return total / time.Duration(len(result.Latencies))
+}
+
+// MaxLatency returns the longest time that a record took to be delivered.
+func (result Result) MaxLatency() time.Duration {
+	var max time.Duration
+	for _, latency := range result.Latencies {
+		if latency > max {
+			max = latency
+		}
+	}
+
+	return max
+}
+
+// Throughput returns the bytes delivered per second in both directions.
+func (result Result) Throughput() float64 {
+	if result.Duration <= 0 {
+		return 0
+	}
+
+	return float64(result.Upstream+result.Downstream) / result.Duration.Seconds()
+}
+
+func (result Result) String() string {
+	if result.Err != nil {
+		return fmt.Sprintf("%s: FAILED: %s", result.Trace, result.Err)
+	}
+
+	return fmt.Sprintf("%s: ok, %d bytes up and %d bytes down in %s, latency mean %s max %s, throughput %.0f bytes/s",
+		result.Trace, result.Upstream, result.Downstream, result.Duration.Round(time.Microsecond),
+		result.MeanLatency().Round(time.Microsecond), result.MaxLatency().Round(time.Microsecond), result.Throughput())
+}
+
+// ReadTrace reads the records of the trace file at path.
+func ReadTrace(path string) ([]modes.CaptureRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return modes.ReadCapture(f)
+}
+
+// Replay sends the records of a trace through the dispatcher pair, and
+// checks that they are delivered byte for byte.  Traces must be replayed one
+// at a time.
+func (harness *Harness) Replay(name string, records []modes.CaptureRecord) Result {
+	result := Result{Trace: name}
+	if len(records) == 0 {
+		result.Err = errors.New("the trace has no records")
+		return result
+	}
+
+	var upstream, downstream []modes.CaptureRecord
+	var expectedUp, expectedDown []byte
+	for _, record := range records {
+		if record.Direction == modes.CaptureReceived {
+			upstream = append(upstream, record)
+			expectedUp = append(expectedUp, record.Data...)
+		} else {
+			downstream = append(downstream, record)
+			expectedDown = append(expectedDown, record.Data...)
+		}
+	}
+	result.Upstream = int64(len(expectedUp))
+	result.Downstream = int64(len(expectedDown))
+
+	start := time.Now()
+	deadline := start.Add(harness.config.Timeout)
+	_ = harness.app.SetDeadline(deadline)
+
+	client, err := net.Dial("tcp", harness.clientAddr)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer client.Close()
+	_ = client.SetDeadline(deadline)
+
+	var tracker latencyTracker
+	var upTracker, downTracker chunkTracker
+	errs := make(chan error, 4)
+	go func() {
+		errs <- harness.send(client, upstream, records[0].Time, start, &upTracker)
+	}()
+	go func() {
+		errs <- receive(client, expectedDown, "downstream", &downTracker, &tracker)
+	}()
+	go func() {
+		server, acceptErr := harness.app.Accept()
+		if acceptErr != nil {
+			errs <- fmt.Errorf("the server did not connect: %s", acceptErr)
+			errs <- nil
+			return
+		}
+		defer server.Close()
+		_ = server.SetDeadline(deadline)
+
+		serverErrs := make(chan error, 1)
+		go func() {
+			serverErrs <- harness.send(server, downstream, records[0].Time, start, &downTracker)
+		}()
+		errs <- receive(server, expectedUp, "upstream", &upTracker, &tracker)
+		errs <- <-serverErrs
+	}()
+
+	for i := 0; i < 4; i++ {
+		if err = <-errs; err != nil && result.Err == nil {
+			result.Err = err
+			// Unblock the other directions.
+			_ = client.Close()
+		}
+	}
+
+	result.Latencies = tracker.latencies
+	result.Duration = tracker.last.Sub(start)
+	return result
+}
+
+// send writes the records to conn, each at its time after first.
+func (harness *Harness) send(conn net.Conn, records []modes.CaptureRecord, first time.Time, start time.Time, chunks *chunkTracker) error {
+	for _, record := range records {
+		if harness.config.Speed > 0 {
+			offset := time.Duration(float64(record.Time.Sub(first)) / harness.config.Speed)
+			time.Sleep(time.Until(start.Add(offset)))
+		}
+
+		chunks.sent(int64(len(record.Data)))
+		if _, err := conn.Write(record.Data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// receive reads the expected data from conn, and records when each chunk
+// was delivered in full.
+func receive(conn net.Conn, expected []byte, direction string, chunks *chunkTracker, tracker *latencyTracker) error {
+	buf := make([]byte, 32*1024)
+	total := 0
+	for total < len(expected) {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if total+n > len(expected) {
+				return fmt.Errorf("received more %s data than the trace has", direction)
+			}
+			if !bytes.Equal(buf[:n], expected[total:total+n]) {
+				offset := total
+				for buf[offset-total] == expected[offset] {
+					offset++
+				}
+				return fmt.Errorf("the %s data differs from the trace at byte %d", direction, offset)
+			}
+			total += n
+			tracker.add(chunks.delivered(int64(total)))
+		}
+		if err != nil {
+			return fmt.Errorf("received %d of %d bytes %s: %s", total, len(expected), direction, err)
+		}
+	}
+
+	return nil
+}
+
+// chunkTracker records when the chunks of one direction were sent, to find
+// how long each took to be delivered.
+type chunkTracker struct {
+	lock   sync.Mutex
+	ends   []int64
+	sentAt []time.Time
+	next   int
+}
+
+// sent records that a chunk of size bytes is being sent.
+func (chunks *chunkTracker) sent(size int64) {
+	chunks.lock.Lock()
+	defer chunks.lock.Unlock()
+
+	end := size
+	if len(chunks.ends) > 0 {
+		end += chunks.ends[len(chunks.ends)-1]
+	}
+	chunks.ends = append(chunks.ends, end)
+	chunks.sentAt = append(chunks.sentAt, time.Now())
+}
+
+// delivered returns the latencies of the chunks that have been delivered in
+// full, now that total bytes have been received.
+func (chunks *chunkTracker) delivered(total int64) []time.Duration {
+	chunks.lock.Lock()
+	defer chunks.lock.Unlock()
+
+	now := time.Now()
+	var latencies []time.Duration
+	for chunks.next < len(chunks.ends) && chunks.ends[chunks.next] <= total {
+		latencies = append(latencies, now.Sub(chunks.sentAt[chunks.next]))
+		chunks.next++
+	}
+
+	return latencies
+}
+
+// latencyTracker collects the latencies of both directions.
+type latencyTracker struct {
+	lock      sync.Mutex
+	latencies []time.Duration
+	last      time.Time
+}
+
+func (tracker *latencyTracker) add(latencies []time.Duration) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	tracker.latencies = append(tracker.latencies, latencies...)
+	tracker.last = time.Now()
+}
+
+// Main runs the replay subcommand with its command line arguments, and
+// returns the exit status.
+func Main(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	transport := flags.String("transport", "obfs2", "Specify the transport to replay the traces through")
+	clientOptions := flags.String("clientOptions", "", "Specify the client transport options (by default, the arguments that the server announces)")
+	serverOptions := flags.String("serverOptions", "", "Specify the server transport options")
+	statePath := flags.String("state", "", "Specify the state directory of the server (by default, a temporary directory)")
+	speed := flags.Float64("speed", 1, "Specify how much faster than recorded to replay the traces (0 replays as fast as possible)")
+	timeout := flags.Duration("timeout", time.Minute, "Specify how long each trace may take to replay")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(flags.Output(), "Usage:\n\t%s replay [flags] trace...\n\nFlags:\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	stateDir := *statePath
+	if stateDir == "" {
+		dir, err := ioutil.TempDir("", "replay")
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "could not create a state directory: %s\n", err)
+			return 1
+		}
+		defer os.RemoveAll(dir)
+		stateDir = dir
+	}
+
+	// The IPC messages of the dispatchers are not needed.
+	pt.Stdout = ioutil.Discard
+
+	// Disable the shadow salt filter for the replay, as described for Start.
+	savedCapacity, hadCapacity := os.LookupEnv("SHADOWSOCKS_SF_CAPACITY")
+	_ = os.Setenv("SHADOWSOCKS_SF_CAPACITY", "-1")
+	defer func() {
+		if hadCapacity {
+			_ = os.Setenv("SHADOWSOCKS_SF_CAPACITY", savedCapacity)
+		} else {
+			_ = os.Unsetenv("SHADOWSOCKS_SF_CAPACITY")
+		}
+	}()
+
+	harness, err := Start(Config{
+		Transport:     *transport,
+		ClientOptions: *clientOptions,
+		ServerOptions: *serverOptions,
+		StateDir:      stateDir,
+		Speed:         *speed,
+		Timeout:       *timeout,
+	})
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "could not start the dispatchers: %s\n", err)
+		return 1
+	}
+	defer harness.Close()
+
+	status := 0
+	for _, trace := range flags.Args() {
+		result := Result{Trace: trace}
+		records, readErr := ReadTrace(trace)
+		if readErr != nil {
+			result.Err = readErr
+		} else {
+			result = harness.Replay(trace, records)
+		}
+		fmt.Println(result)
+		if result.Err != nil {
+			status = 1
+		}
+	}
+
+	return status
+}
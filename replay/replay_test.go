@@ -0,0 +1,128 @@
+package replay
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
+	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
+)
+
+// testTrace returns a request and response exchange, with a response larger
+// than one transport frame.
+func testTrace() []modes.CaptureRecord {
+	start := time.Now()
+	response := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+
+	return []modes.CaptureRecord{
+		{Direction: modes.CaptureReceived, Time: start, Data: []byte("GET / HTTP/1.1\r\n\r\n")},
+		{Direction: modes.CaptureSent, Time: start.Add(10 * time.Millisecond), Data: response[:1000]},
+		{Direction: modes.CaptureSent, Time: start.Add(20 * time.Millisecond), Data: response[1000:]},
+		{Direction: modes.CaptureReceived, Time: start.Add(30 * time.Millisecond), Data: []byte("bye")},
+	}
+}
+
+// writeTestTrace writes records to a trace file in dir.
+func writeTestTrace(t *testing.T, dir string, records []modes.CaptureRecord) string {
+	tracePath := path.Join(dir, "trace.dcap")
+	f, err := os.Create(tracePath)
+	if err != nil {
+		t.Fatal("could not create the trace:", err)
+	}
+	defer f.Close()
+
+	if err = modes.WriteCapture(f, records); err != nil {
+		t.Fatal("WriteCapture failed:", err)
+	}
+
+	return tracePath
+}
+
+// TestReplay tests that a trace is delivered byte for byte through each of
+// the transports, and that closing the harness stops its dispatchers.
+func TestReplay(t *testing.T) {
+	stdout := pt.Stdout
+	pt.Stdout = ioutil.Discard
+	defer func() { pt.Stdout = stdout }()
+	t.Setenv("SHADOWSOCKS_SF_CAPACITY", "-1")
+
+	for _, config := range []Config{
+		{Transport: "obfs2"},
+		{Transport: "obfs4"},
+		{Transport: "shadow",
+			ClientOptions: `{"password": "1234", "cipherName": "AES-128-GCM"}`,
+			ServerOptions: `{"shadow": {"password": "1234", "cipherName": "AES-128-GCM"}}`},
+	} {
+		config := config
+		t.Run(config.Transport, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "replaytest")
+			if err != nil {
+				t.Fatal("could not create a directory:", err)
+			}
+			defer os.RemoveAll(dir)
+
+			records, err := ReadTrace(writeTestTrace(t, dir, testTrace()))
+			if err != nil {
+				t.Fatal("ReadTrace failed:", err)
+			}
+
+			config.StateDir = dir
+			config.Timeout = 30 * time.Second
+			harness, err := Start(config)
+			if err != nil {
+				t.Fatal("Start failed:", err)
+			}
+
+			result := harness.Replay("trace", records)
+			if result.Err != nil {
+				t.Fatal("the trace was not replayed:", result)
+			}
+			if result.Upstream != 21 || result.Downstream != 65536 {
+				t.Errorf("expected 21 bytes up and 65536 down, got %d and %d", result.Upstream, result.Downstream)
+			}
+			if len(result.Latencies) != len(records) {
+				t.Errorf("expected %d latencies, got %d", len(records), len(result.Latencies))
+			}
+
+			if err = harness.Close(); err != nil {
+				t.Error("Close failed:", err)
+			}
+			if conn, dialErr := net.Dial("tcp", harness.clientAddr); dialErr == nil {
+				conn.Close()
+				t.Error("the client still accepts connections after Close")
+			}
+		})
+	}
+}
+
+// TestReplayEmpty tests that a trace without records is reported as failed.
+func TestReplayEmpty(t *testing.T) {
+	harness := &Harness{}
+	if result := harness.Replay("empty", nil); result.Err == nil {
+		t.Error("an empty trace was reported as delivered")
+	}
+}
+
+// TestReceiveMismatch tests that data differing from the trace is reported
+// with the offset of the first differing byte.
+func TestReceiveMismatch(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		_, _ = client.Write([]byte("abcxef"))
+		_ = client.Close()
+	}()
+
+	var chunks chunkTracker
+	var tracker latencyTracker
+	chunks.sent(6)
+	err := receive(server, []byte("abcdef"), "upstream", &chunks, &tracker)
+	if err == nil || err.Error() != "the upstream data differs from the trace at byte 3" {
+		t.Error("unexpected error:", err)
+	}
+}
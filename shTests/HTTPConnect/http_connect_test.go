@@ -0,0 +1,76 @@
+package HTTPConnect
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/testutil"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/http_connect"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/shTests/harness"
+)
+
+// TestHTTPConnect tests that data sent through an HTTP CONNECT client is
+// relayed byte for byte to the server's ORPort and back, over each transport.
+func TestHTTPConnect(t *testing.T) {
+	for _, name := range harness.Names {
+		t.Run(name, func(t *testing.T) {
+			pair := harness.NewPair(t, name)
+			echo := testutil.StartTCPEcho(t)
+			pair.StartServer(t, http_connect.ServerSetup, echo.Addr())
+
+			clientAddr := harness.FreeTCPAddr(t).String()
+			if !http_connect.ClientSetup(clientAddr, "", nil, []string{pair.Transport}, pair.ClientOptions(t), false) {
+				t.Fatal("the client failed to launch")
+			}
+
+			conn, err := net.Dial("tcp", clientAddr)
+			if err != nil {
+				t.Fatal("could not connect to the client:", err)
+			}
+			defer conn.Close()
+
+			if err = connect(conn, pair.Target()); err != nil {
+				t.Fatal("CONNECT failed:", err)
+			}
+			pair.EchoTCP(t, conn)
+		})
+	}
+}
+
+// connect sends an HTTP CONNECT request for target, and reads the response.
+func connect(conn net.Conn, target string) error {
+	_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target); err != nil {
+		return err
+	}
+	// The response is read a byte at a time, so that none of the relayed
+	// data is buffered.
+	resp, err := http.ReadResponse(bufio.NewReaderSize(oneByteReader{conn}, 16), nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// oneByteReader reads at most one byte at a time.
+type oneByteReader struct {
+	conn net.Conn
+}
+
+func (reader oneByteReader) Read(b []byte) (int, error) {
+	if len(b) > 1 {
+		b = b[:1]
+	}
+
+	return reader.conn.Read(b)
+}
@@ -0,0 +1,20 @@
+package LinuxTransparent
+
+import "testing"
+
+// tproxySkip is why the Linux transparent modes are not tested in process.
+// They take connections and packets redirected to them by iptables TPROXY
+// rules, which need CAP_NET_ADMIN and change the routing of the whole host.
+const tproxySkip = "the Linux transparent modes need iptables TPROXY rules, which need CAP_NET_ADMIN"
+
+// TestLinuxTransparentTCP records that the Linux transparent TCP mode is not
+// covered by the end-to-end tests.
+func TestLinuxTransparentTCP(t *testing.T) {
+	t.Skip(tproxySkip)
+}
+
+// TestLinuxTransparentUDP records that the Linux transparent UDP mode is not
+// covered by the end-to-end tests.
+func TestLinuxTransparentUDP(t *testing.T) {
+	t.Skip(tproxySkip)
+}
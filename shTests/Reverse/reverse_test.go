@@ -0,0 +1,49 @@
+package Reverse
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/testutil"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/reverse"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/shTests/harness"
+	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
+)
+
+// TestReverse tests that data sent to a service listener of a reverse
+// server is relayed byte for byte to the service behind the client and back,
+// over each transport.
+func TestReverse(t *testing.T) {
+	for _, name := range harness.Names {
+		t.Run(name, func(t *testing.T) {
+			pair := harness.NewPair(t, name)
+			echo := testutil.StartTCPEcho(t)
+			publicAddr := harness.FreeTCPAddr(t)
+			pair.StartServer(t, func(info pt.ServerInfo, stateDir string, options string) bool {
+				return reverse.ServerSetup(info, stateDir, options, map[string]string{"echo": publicAddr.String()})
+			}, echo.Addr())
+
+			services := map[string]string{"echo": echo.Addr().String()}
+			if !reverse.ClientSetup(pair.Target(), nil, []string{pair.Transport}, pair.ClientOptions(t), services) {
+				t.Fatal("the client failed to launch")
+			}
+
+			// The client may take a moment to register the service.
+			var conn net.Conn
+			var err error
+			for i := 0; i < 50; i++ {
+				if conn, err = net.Dial("tcp", publicAddr.String()); err == nil {
+					break
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+			if err != nil {
+				t.Fatal("could not connect to the service listener:", err)
+			}
+			defer conn.Close()
+
+			pair.EchoTCP(t, conn)
+		})
+	}
+}
@@ -1,221 +1,82 @@
 package SocksTCP
 
 import (
-	"encoding/binary"
-	"errors"
 	"fmt"
-	socks "github.com/OperatorFoundation/shapeshifter-dispatcher/common/socks5"
-	"io/ioutil"
+	"io"
 	"net"
 	"testing"
 	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/testutil"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/pt_socks5"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/shTests/harness"
 )
 
 const (
-	version                = 0x05
+	version = 0x05
 )
 
-func TestSocksTCPDust(t *testing.T) {
-	negotiateError := negotiateSocks("../../ConfigFiles/dustClient.json")
-	if negotiateError != nil {
-		t.Fail()
-	}
-}
-
-func TestSocksTCPMeek(t *testing.T) {
-	negotiateError := negotiateSocks("../../ConfigFiles/meek.json")
-	if negotiateError != nil {
-		t.Fail()
-	}
-}
-
-func TestSocksTCPObfs2(t *testing.T) {
-	negotiateError := negotiateSocks("../../ConfigFiles/obfs2.json")
-	if negotiateError != nil {
-		t.Fail()
-	}
-}
-
-func TestSocksTCPObfs4(t *testing.T) {
-	negotiateError := negotiateSocks("../../ConfigFiles/obfs4.json")
-	if negotiateError != nil {
-		t.Fail()
+// TestSocksTCP tests that data sent through a SOCKS5 client is relayed byte
+// for byte to the server's ORPort and back, over each transport.
+func TestSocksTCP(t *testing.T) {
+	for _, name := range harness.Names {
+		t.Run(name, func(t *testing.T) {
+			pair := harness.NewPair(t, name)
+			echo := testutil.StartTCPEcho(t)
+			pair.StartServer(t, pt_socks5.ServerSetup, echo.Addr())
+
+			clientAddr := harness.FreeTCPAddr(t).String()
+			if !pt_socks5.ClientSetup(clientAddr, nil, []string{pair.Transport}, pair.ClientOptions(t)) {
+				t.Fatal("the client failed to launch")
+			}
+
+			conn, err := net.Dial("tcp", clientAddr)
+			if err != nil {
+				t.Fatal("could not connect to the client:", err)
+			}
+			defer conn.Close()
+
+			if err = negotiateSocks(conn, pair.Target()); err != nil {
+				t.Fatal("SOCKS negotiation failed:", err)
+			}
+			pair.EchoTCP(t, conn)
+		})
 	}
 }
 
-func TestSocksTCPOptimizerFirst(t *testing.T) {
-	negotiateError := negotiateSocks("../../ConfigFiles/OptimizerFirst.json")
-	if negotiateError != nil {
-		t.Fail()
-	}
-}
-
-func TestSocksTCPOptimizerMinimizeDialDuration(t *testing.T) {
-	negotiateError := negotiateSocks("../../ConfigFiles/OptimizerMinimizeDialDuration.json")
-	if negotiateError != nil {
-		t.Fail()
-	}
-}
-
-func TestSocksTCPOptimizerRandom(t *testing.T) {
-	negotiateError := negotiateSocks("../../ConfigFiles/OptimizerRandom.json")
-	if negotiateError != nil {
-		t.Fail()
-	}
-}
+// negotiateSocks performs a SOCKS5 CONNECT to an IPv4 target without
+// authentication.
+func negotiateSocks(conn net.Conn, target string) error {
+	_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer conn.SetDeadline(time.Time{})
 
-func TestSocksTCPOptimizerRotate(t *testing.T) {
-	negotiateError := negotiateSocks("../../ConfigFiles/OptimizerRotate.json")
-	if negotiateError != nil {
-		t.Fail()
-	}
-}
-
-func TestSocksTCPOptimizerTrack(t *testing.T) {
-	negotiateError := negotiateSocks("../../ConfigFiles/OptimizerTrack.json")
-	if negotiateError != nil {
-		t.Fail()
-	}
-}
-
-func TestSocksTCPReplicant(t *testing.T) {
-	negotiateError := negotiateSocks("../../ConfigFiles/ReplicantClientConfigV2.json")
-	if negotiateError != nil {
-		t.Fail()
-	}
-}
-
-func TestSocksTCPShadow(t *testing.T) {
-	negotiateError := negotiateSocks("../../ConfigFiles/shadowClientChaCha.json")
-	if negotiateError != nil {
-		t.Fail()
-	}
-}
-
-func negotiateSocks(jsonFile string) error {
-	dialConn, dialError := net.Dial("tcp", "127.0.0.1:1443")
-	if dialError != nil {
-		return dialError
-	}
-
-	println("sleeping")
-	time.Sleep(1 * time.Second)
-	println("done with nap")
-
-	var err error
-	var method byte
-
-	// VER = 05, NMETHODS = 01, METHODS = [09]
-	//Method 9 is the json parameter block authentication
-	_, writeError := dialConn.Write([]byte{0x05, 0x01, 0x09})
-	if writeError != nil {
-		return writeError
-	}
-
-	if method, err = NegotiateAuth(dialConn); err != nil {
+	if _, err := conn.Write([]byte{version, 0x01, 0x00}); err != nil {
 		return err
 	}
-
-	if method != socks.AuthJsonParameterBlock {
-		return errors.New("negotiateAuth(jsonParameterBlock) unexpected method")
-	}
-	jsonData, jsonErr := ioutil.ReadFile(jsonFile)
-	if jsonErr != nil {
-		return jsonErr
+	methodReply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, methodReply); err != nil {
+		return err
 	}
-	jsonDataLength := len(jsonData)
-	jsonLengthBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(jsonLengthBytes, uint32(jsonDataLength))
-
-	_, byteLengthWriteError := dialConn.Write(jsonLengthBytes)
-	if byteLengthWriteError != nil {
-		return byteLengthWriteError
+	if methodReply[0] != version || methodReply[1] != 0x00 {
+		return fmt.Errorf("unexpected method reply %v", methodReply)
 	}
 
-	_, byteWriteError := dialConn.Write(jsonData)
-	if byteWriteError != nil {
-		return byteWriteError
+	addr, err := net.ResolveTCPAddr("tcp", target)
+	if err != nil {
+		return err
 	}
-
-	//version: 0x05
-	//CMD: connect: 0x01
-	//RSV: reserved: 0x00
-	//ATYP: IPV4: 0x01
-	//IPV4 address: 127.0.0.1 : 0x7F, 0x00, 0x00, 0x01
-	//Port: 2222: 0x08, 0xAE
-	request := []byte{0x05, 0x01, 0x00, 0x01, 0x7F, 0x00, 0x00, 0x01, 0x08, 0xAE}
-	writeCount, writeReqErr := dialConn.Write(request)
-	println(writeCount)
-	if writeReqErr != nil {
-		return writeReqErr
+	request := append([]byte{version, 0x01, 0x00, 0x01}, addr.IP.To4()...)
+	request = append(request, byte(addr.Port>>8), byte(addr.Port))
+	if _, err = conn.Write(request); err != nil {
+		return err
 	}
-
 	reply := make([]byte, 10)
-	if dialConn == nil {
-		println("dialConn is nil")
-		return dialError
-	}
-	readCount, readError := dialConn.Read(reply)
-	if readCount <1 {
-		println("did not receive reply from server")
-	}
-	println(readCount, "is the number of bytes being read")
-	if readError != nil {
-		return readError
-	}
-
-	if reply[0] != 0x05 {
-		return errors.New("incorrect socks version")
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
 	}
-
 	if reply[1] != 0x00 {
-		println(reply[1])
-		return errors.New("non-successful reply")
-	}
-
-	if reply[3] != 0x01 {
-		return errors.New("expected IPV4 address")
-	}
-
-	_, writeErr := dialConn.Write([]byte("data"))
-	if writeErr != nil {
-		return writeErr
-	}
-
-	return nil
-}
-
-func NegotiateAuth(req net.Conn) (byte, error) {
-	// The client sends a version identifier/selection message.
-	//	uint8_t ver (0x05)
-	//  uint8_t nmethods (>= 1).
-	//  uint8_t methods[nmethods]
-
-	var err error
-	if err = readByteVerify(req, "version", version); err != nil {
-		return 0, err
+		return fmt.Errorf("SOCKS reply %d", reply[1])
 	}
 
-	// Read the number of methods, and the methods.
-	var methods = make([]byte, 1)
-	if _, err = req.Read(methods); err != nil {
-		return 0, err
-	}
-	method := methods[0]
-	println("this is the socks authentication variable:", method)
-
-	return method, nil
-}
-
-func readByteVerify(req net.Conn, descr string, expected byte) error {
-	var b = make([]byte, 1)
-	_, err := req.Read(b)
-	if err != nil {
-		return err
-	}
-	val := b[0]
-	if val != expected {
-		return fmt.Errorf("message field '%s' was 0x%02x (expected 0x%02x)", descr, val, expected)
-	}
 	return nil
 }
@@ -1,49 +1,62 @@
 package StunUDP
 
 import (
-	"github.com/willscott/goturn"
-	"net"
+	"encoding/binary"
 	"testing"
-	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/stun_udp"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/shTests/harness"
+	"github.com/willscott/goturn"
 )
 
+// TestStunUDP tests that STUN messages sent to a STUN client are relayed
+// byte for byte to the server's ORPort and back, over each transport.
 func TestStunUDP(t *testing.T) {
-	dialConn, dialError := net.Dial("udp", "127.0.0.1:1443")
-	if dialError != nil {
-		t.Fail()
-		return
-	}
+	for _, name := range harness.Names {
+		t.Run(name, func(t *testing.T) {
+			pair := harness.NewPair(t, name)
+			echo := harness.StartUDPEcho(t)
+			pair.StartServer(t, stun_udp.ServerSetup, echo)
 
-	time.Sleep(1*time.Second)
-	message, reqError := goturn.NewBindingRequest()
-	if reqError != nil {
-		t.Fail()
-		return
-	}
-	data, serialErr := message.Serialize()
-	if serialErr != nil {
-		t.Fail()
-		return
-	}
-	_, writeErr1 := dialConn.Write(data)
-	if writeErr1 != nil {
-		t.Fail()
-		return
-	}
+			clientAddr := harness.FreeUDPAddr(t)
+			if !stun_udp.ClientSetup(clientAddr.String(), pair.Target(), nil, []string{pair.Transport}, pair.ClientOptions(t)) {
+				t.Fatal("the client failed to launch")
+			}
 
-	time.Sleep(1*time.Second)
+			probe, err := goturn.NewBindingRequest()
+			if err != nil {
+				t.Fatal("could not create a binding request:", err)
+			}
+			probeBytes, err := probe.Serialize()
+			if err != nil {
+				t.Fatal("could not serialize the binding request:", err)
+			}
 
-	_, writeErr2 := dialConn.Write(data)
-	if writeErr2 != nil {
-		t.Fail()
-		return
+			var messages [][]byte
+			for _, size := range []int{0, 4, 100, 1000} {
+				messages = append(messages, stunMessage(t, size))
+			}
+			harness.EchoUDP(t, clientAddr, probeBytes, messages)
+		})
 	}
+}
 
-	time.Sleep(1*time.Second)
-
-	_, writeErr3 := dialConn.Write(data)
-	if writeErr3 != nil {
-		t.Fail()
-		return
+// stunMessage returns a binding request with a random transaction ID and a
+// SOFTWARE attribute of size random bytes, which must be a multiple of 4.
+func stunMessage(t *testing.T, size int) []byte {
+	message := make([]byte, 20, 24+size)
+	binary.BigEndian.PutUint16(message[0:], 0x0001)
+	binary.BigEndian.PutUint32(message[4:], 0x2112A442)
+	copy(message[8:], harness.Payload(t, 12))
+	if size == 0 {
+		return message
 	}
-}
\ No newline at end of file
+
+	binary.BigEndian.PutUint16(message[2:], uint16(4+size))
+	attribute := make([]byte, 4)
+	binary.BigEndian.PutUint16(attribute[0:], 0x8022)
+	binary.BigEndian.PutUint16(attribute[2:], uint16(size))
+	message = append(message, attribute...)
+
+	return append(message, harness.Payload(t, size)...)
+}
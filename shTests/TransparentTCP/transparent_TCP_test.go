@@ -3,24 +3,33 @@ package TransparentTCP
 import (
 	"net"
 	"testing"
-	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/testutil"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/transparent_tcp"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/shTests/harness"
 )
 
+// TestTransparentTCP tests that data sent to a transparent TCP client is
+// relayed byte for byte to the server's ORPort and back, over each transport.
 func TestTransparentTCP(t *testing.T) {
-	dialConn, dialError := net.Dial("tcp", "127.0.0.1:1443")
-	if dialError != nil {
-		t.Fail()
-		return
-	}
+	for _, name := range harness.Names {
+		t.Run(name, func(t *testing.T) {
+			pair := harness.NewPair(t, name)
+			echo := testutil.StartTCPEcho(t)
+			pair.StartServer(t, transparent_tcp.ServerSetup, echo.Addr())
 
-	time.Sleep(1*time.Second)
+			clientAddr := harness.FreeTCPAddr(t).String()
+			if !transparent_tcp.ClientSetup(clientAddr, pair.Target(), nil, []string{pair.Transport}, pair.ClientOptions(t)) {
+				t.Fatal("the client failed to launch")
+			}
 
-	_, writeErr := dialConn.Write([]byte("data"))
-	if writeErr != nil {
-		t.Fail()
-		return
-	}
+			conn, err := net.Dial("tcp", clientAddr)
+			if err != nil {
+				t.Fatal("could not connect to the client:", err)
+			}
+			defer conn.Close()
 
-	time.Sleep(1*time.Second)
-
-}
\ No newline at end of file
+			pair.EchoTCP(t, conn)
+		})
+	}
+}
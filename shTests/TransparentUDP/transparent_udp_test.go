@@ -1,39 +1,31 @@
 package TransparentUDP
 
 import (
-	"net"
 	"testing"
-	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/transparent_udp"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/shTests/harness"
 )
 
+// TestTransparentUDP tests that packets sent to a transparent UDP client are
+// relayed byte for byte to the server's ORPort and back, over each transport.
 func TestTransparentUDP(t *testing.T) {
-	dialConn, dialError := net.Dial("udp", "127.0.0.1:1443")
-	if dialError != nil {
-		t.Fail()
-		return
-	}
-
-	time.Sleep(1*time.Second)
-
-	_, writeErr1 := dialConn.Write([]byte("data1"))
-	if writeErr1 != nil {
-		t.Fail()
-		return
-	}
-
-	time.Sleep(1*time.Second)
-
-	_, writeErr2 := dialConn.Write([]byte("data2"))
-	if writeErr2 != nil {
-		t.Fail()
-		return
-	}
-
-	time.Sleep(1*time.Second)
-
-	_, writeErr3 := dialConn.Write([]byte("data1"))
-	if writeErr3 != nil {
-		t.Fail()
-		return
+	for _, name := range harness.Names {
+		t.Run(name, func(t *testing.T) {
+			pair := harness.NewPair(t, name)
+			echo := harness.StartUDPEcho(t)
+			pair.StartServer(t, transparent_udp.ServerSetup, echo)
+
+			clientAddr := harness.FreeUDPAddr(t)
+			if !transparent_udp.ClientSetup(clientAddr.String(), pair.Target(), nil, []string{pair.Transport}, pair.ClientOptions(t)) {
+				t.Fatal("the client failed to launch")
+			}
+
+			var packets [][]byte
+			for _, size := range []int{1, 100, 512, 1024} {
+				packets = append(packets, harness.Payload(t, size))
+			}
+			harness.EchoUDP(t, clientAddr, []byte("probe"), packets)
+		})
 	}
-}
\ No newline at end of file
+}
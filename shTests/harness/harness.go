@@ -0,0 +1,472 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+// Package harness runs client and server dispatchers in process on loopback,
+// so that the end-to-end tests of each mode can relay traffic through every
+// transport without any external processes or fixed ports.
+package harness
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"path"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
+)
+
+// Names are the transports that each mode is tested with.  The Optimizer
+// is tested with each of its strategies, choosing between obfs2, obfs4,
+// shadow and Replicant servers.
+var Names = []string{
+	"obfs2", "obfs4", "shadow", "Replicant", "Dust", "meeklite",
+	"OptimizerFirst", "OptimizerRandom", "OptimizerRotate", "OptimizerTrack", "OptimizerMinimizeDialDuration",
+}
+
+// strategies are the Optimizer strategies of the Optimizer names.
+var strategies = map[string]string{
+	"OptimizerFirst":                "first",
+	"OptimizerRandom":               "random",
+	"OptimizerRotate":               "rotate",
+	"OptimizerTrack":                "track",
+	"OptimizerMinimizeDialDuration": "minimizeDialDuration",
+}
+
+// optimizerTransports are the transports that the Optimizer chooses between.
+var optimizerTransports = []string{"obfs2", "obfs4", "shadow", "Replicant"}
+
+// shadowCipher is the cipher of the shadow servers.
+const shadowCipher = "CHACHA20-IETF-POLY1305"
+
+// timeout bounds each exchange of test traffic.
+const timeout = 30 * time.Second
+
+// ipcOutput receives the IPC messages of the dispatchers while a pair is in
+// use.  StartServer captures them by switching its writer, since goroutines
+// of earlier dispatchers may still write to pt.Stdout.
+var ipcOutput = &switchWriter{w: ioutil.Discard}
+
+// switchWriter writes to w, which may be switched while it is written to.
+type switchWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func (sw *switchWriter) Write(p []byte) (int, error) {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+
+	return sw.w.Write(p)
+}
+
+// swap switches the writer to w, and returns the previous writer.
+func (sw *switchWriter) swap(w io.Writer) io.Writer {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+
+	previous := sw.w
+	sw.w = w
+	return previous
+}
+
+// Pair is a client and server dispatcher pair for a transport.  The server
+// is given a fresh state directory, so that transports with keys generate
+// new ones, and each server transport listens on a free loopback port.
+type Pair struct {
+	// Transport is the name of the client transport.
+	Transport string
+
+	// StateDir is the state directory of the server.
+	StateDir string
+
+	strategy string
+	servers  []pt.Bindaddr
+	password string
+}
+
+// NewPair returns a pair for one of the Names, and skips the test if the
+// transport has no server that can run in process.
+func NewPair(t *testing.T, name string) *Pair {
+	switch name {
+	case "Dust":
+		t.Skip("the dispatcher has no Dust server")
+	case "meeklite":
+		t.Skip("the meek server needs a certificate from an ACME server")
+	}
+
+	// The shadow client and server share the salt filter that protects
+	// servers from replayed connections, so the server would take the salt
+	// of each client connection in this process for a replay.
+	t.Setenv("SHADOWSOCKS_SF_CAPACITY", "-1")
+
+	// The IPC messages of the dispatchers are not needed, except by
+	// StartServer.
+	stdout := pt.Stdout
+	pt.Stdout = ipcOutput
+	t.Cleanup(func() { pt.Stdout = stdout })
+
+	pair := &Pair{Transport: name, StateDir: t.TempDir(), password: hex.EncodeToString(Payload(t, 16))}
+	names := []string{name}
+	if strategy, ok := strategies[name]; ok {
+		pair.Transport = "Optimizer"
+		pair.strategy = strategy
+		names = optimizerTransports
+	}
+
+	// The ports are all held until each server has one, so that no two
+	// servers are given the same port.
+	for _, server := range names {
+		ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal("could not find a free port:", err)
+		}
+		defer ln.Close()
+		pair.servers = append(pair.servers, pt.Bindaddr{MethodName: server, Addr: ln.Addr().(*net.TCPAddr)})
+	}
+
+	return pair
+}
+
+// ServerInfo returns the server information of the pair, for a server that
+// forwards to orAddr.
+func (pair *Pair) ServerInfo(t *testing.T, orAddr net.Addr) pt.ServerInfo {
+	or, err := net.ResolveTCPAddr("tcp", orAddr.String())
+	if err != nil {
+		t.Fatal("could not resolve the ORPort address:", err)
+	}
+
+	return pt.ServerInfo{Bindaddrs: pair.servers, OrAddr: or}
+}
+
+// ServerOptions returns the options of the server transports.
+func (pair *Pair) ServerOptions(t *testing.T) string {
+	options := make(map[string]interface{})
+	for _, server := range pair.servers {
+		switch server.MethodName {
+		case "shadow":
+			options["shadow"] = map[string]interface{}{"password": pair.password, "cipherName": shadowCipher}
+		case "Replicant":
+			var config map[string]interface{}
+			readConfig(t, "ReplicantServerConfigV2.json", &config)
+			options["Replicant"] = config["Replicant"]
+		}
+	}
+
+	encoded, err := json.Marshal(options)
+	if err != nil {
+		t.Fatal("could not encode the server options:", err)
+	}
+
+	return string(encoded)
+}
+
+// StartServer launches the server of the pair with setup, forwarding to
+// orAddr, and checks that each of its transports is listening.
+func (pair *Pair) StartServer(t *testing.T, setup func(info pt.ServerInfo, stateDir string, options string) bool, orAddr net.Addr) {
+	// The server announces each listener that it could not open with an
+	// SMETHOD-ERROR line.
+	var ipc bytes.Buffer
+	previous := ipcOutput.swap(&ipc)
+	launched := setup(pair.ServerInfo(t, orAddr), pair.StateDir, pair.ServerOptions(t))
+	ipcOutput.swap(previous)
+
+	if !launched || bytes.Contains(ipc.Bytes(), []byte("SMETHOD-ERROR")) {
+		t.Fatalf("the server failed to launch:\n%s", ipc.String())
+	}
+}
+
+// Target returns the address of the server that the client connects to.
+// The Optimizer connects to the servers in its options instead.
+func (pair *Pair) Target() string {
+	return pair.servers[0].Addr.String()
+}
+
+// ClientOptions returns the options of the client transport.  It must be
+// called after the server has been started, since the obfs4 server only
+// generates its keys when it launches.
+func (pair *Pair) ClientOptions(t *testing.T) string {
+	var options interface{}
+	if pair.strategy == "" {
+		options = pair.clientConfig(t, pair.Transport)
+	} else {
+		var transports []interface{}
+		for _, server := range pair.servers {
+			transports = append(transports, map[string]interface{}{
+				"address": server.Addr.String(),
+				"name":    server.MethodName,
+				"config":  pair.clientConfig(t, server.MethodName),
+			})
+		}
+		options = map[string]interface{}{"transports": transports, "strategy": pair.strategy}
+	}
+
+	encoded, err := json.Marshal(options)
+	if err != nil {
+		t.Fatal("could not encode the client options:", err)
+	}
+
+	return string(encoded)
+}
+
+// clientConfig returns the client configuration of a transport.
+func (pair *Pair) clientConfig(t *testing.T, name string) map[string]interface{} {
+	config := make(map[string]interface{})
+	switch name {
+	case "obfs4":
+		args, err := pt_extras.ListenerArgs(name, pair.StateDir)
+		if err != nil {
+			t.Fatal("could not read the obfs4 client arguments:", err)
+		}
+		config = args
+	case "shadow":
+		config["password"] = pair.password
+		config["cipherName"] = shadowCipher
+	case "Replicant":
+		readConfig(t, "ReplicantClientConfigV2.json", &config)
+	}
+
+	return config
+}
+
+// readConfig decodes a file of the ConfigFiles directory.
+func readConfig(t *testing.T, name string, config interface{}) {
+	// The directory is found from this file, so that the tests of every
+	// package can use it.
+	_, file, _, _ := runtime.Caller(0)
+	configBytes, err := ioutil.ReadFile(path.Join(path.Dir(file), "..", "..", "ConfigFiles", name))
+	if err != nil {
+		t.Fatal("could not read the config file:", err)
+	}
+	if err = json.Unmarshal(configBytes, config); err != nil {
+		t.Fatalf("could not parse %s: %s", name, err)
+	}
+}
+
+// FreeTCPAddr returns a loopback TCP address that is not in use.
+func FreeTCPAddr(t *testing.T) *net.TCPAddr {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("could not find a free port:", err)
+	}
+	defer ln.Close()
+
+	return ln.Addr().(*net.TCPAddr)
+}
+
+// FreeUDPAddr returns a loopback UDP address that is not in use.
+func FreeUDPAddr(t *testing.T) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("could not find a free port:", err)
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Payload returns size random bytes.
+func Payload(t *testing.T, size int) []byte {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal("could not generate a payload:", err)
+	}
+
+	return data
+}
+
+// StartUDPEcho starts a UDP server on loopback for a server to forward
+// packets to, which sends each packet back to where it came from, and stops
+// it when the test ends.
+func StartUDPEcho(t *testing.T) net.Addr {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("could not start the UDP server:", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	return conn.LocalAddr()
+}
+
+// messageSizes are the sizes of the messages that EchoTCP exchanges, from
+// one byte to several transport frames.
+var messageSizes = []int{1, 100, 1500, 16 * 1024, 64 * 1024}
+
+// streamSize is the size of the payload that EchoTCP streams.
+const streamSize = 1024 * 1024
+
+// EchoTCP exchanges messages of increasing size over conn, which must lead
+// to an echo server, and checks that each comes back byte for byte.  It then
+// streams a large payload while reading back its echo, in a subtest that is
+// skipped if the transport cannot read and write a connection at the same
+// time.
+func (pair *Pair) EchoTCP(t *testing.T, conn net.Conn) {
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	for _, size := range messageSizes {
+		message := Payload(t, size)
+		if _, err := conn.Write(message); err != nil {
+			t.Fatalf("could not send a message of %d bytes: %s", size, err)
+		}
+		echo := make([]byte, size)
+		if n, err := io.ReadFull(conn, echo); err != nil {
+			t.Fatalf("received %d of %d bytes: %s", n, size, err)
+		}
+		checkEqual(t, "message", message, echo)
+	}
+
+	t.Run("stream", func(t *testing.T) {
+		if !pair.fullDuplex() {
+			t.Skip("Replicant connections stall when they are read and written at the same time")
+		}
+		pair.streamTCP(t, conn)
+	})
+}
+
+// streamTCP streams a large payload over conn, which must lead to an echo
+// server, and checks that it comes back byte for byte.
+func (pair *Pair) streamTCP(t *testing.T, conn net.Conn) {
+	// The payload is written while the echo is read, so that neither side
+	// blocks on full buffers.
+	payload := Payload(t, streamSize)
+	writeErr := make(chan error, 1)
+	go func() {
+		for sent := 0; sent < len(payload); {
+			end := sent + 16*1024
+			if end > len(payload) {
+				end = len(payload)
+			}
+			if _, err := conn.Write(payload[sent:end]); err != nil {
+				writeErr <- err
+				return
+			}
+			sent = end
+		}
+		writeErr <- nil
+	}()
+
+	echo := make([]byte, len(payload))
+	n, err := io.ReadFull(conn, echo)
+	if err != nil {
+		t.Fatalf("received %d of %d streamed bytes: %s", n, len(payload), err)
+	}
+	if err = <-writeErr; err != nil {
+		t.Fatal("could not stream the payload:", err)
+	}
+	checkEqual(t, "stream", payload, echo)
+}
+
+// fullDuplex reports whether the connections of each of the transports can
+// be read and written at the same time.  Replicant connections stall when
+// they are.
+func (pair *Pair) fullDuplex() bool {
+	for _, server := range pair.servers {
+		if server.MethodName == "Replicant" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// EchoUDP sends packets to a UDP client listening on clientAddr, whose
+// server forwards them to a server started by StartUDPEcho, and checks that
+// each of them comes back intact.  The client drops packets while it
+// connects to the server, so probe is sent until its echo is received before
+// the packets are sent.
+func EchoUDP(t *testing.T, clientAddr *net.UDPAddr, probe []byte, packets [][]byte) {
+	conn, err := net.DialUDP("udp", nil, clientAddr)
+	if err != nil {
+		t.Fatal("could not connect to the client:", err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 64*1024)
+	received := false
+	for deadline := time.Now().Add(timeout); !received && time.Now().Before(deadline); {
+		if _, err = conn.Write(probe); err != nil {
+			t.Fatal("could not send the probe:", err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, readErr := conn.Read(buf)
+		if readErr == nil {
+			checkEqual(t, "probe", probe, buf[:n])
+			received = true
+		}
+	}
+	if !received {
+		t.Fatal("no probe came back")
+	}
+
+	// Later copies of the probe may still be on their way.
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if _, err = conn.Read(buf); err != nil {
+			break
+		}
+	}
+
+	for i, packet := range packets {
+		if _, err = conn.Write(packet); err != nil {
+			t.Fatalf("could not send packet %d: %s", i, err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+		n, readErr := conn.Read(buf)
+		if readErr != nil {
+			t.Fatalf("packet %d did not come back: %s", i, readErr)
+		}
+		checkEqual(t, "packet", packet, buf[:n])
+	}
+}
+
+// checkEqual fails the test if received is not the same as sent.
+func checkEqual(t *testing.T, what string, sent []byte, received []byte) {
+	if bytes.Equal(sent, received) {
+		return
+	}
+
+	offset := 0
+	for offset < len(sent) && offset < len(received) && sent[offset] == received[offset] {
+		offset++
+	}
+	t.Fatalf("the %s of %d bytes was received as %d bytes, differing at byte %d", what, len(sent), len(received), offset)
+}
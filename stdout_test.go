@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/testutil"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/http_connect"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/pt_socks5"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/stun_udp"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/transparent_tcp"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/transparent_udp"
+	pt "github.com/OperatorFoundation/shapeshifter-ipc/v2"
+)
+
+// ipcKeywords are the keywords of the lines that the Pluggable Transport
+// protocol allows on stdout.
+var ipcKeywords = map[string]bool{
+	"VERSION": true, "VERSION-ERROR": true, "ENV-ERROR": true,
+	"CMETHOD": true, "CMETHOD-ERROR": true, "CMETHODS": true,
+	"SMETHOD": true, "SMETHOD-ERROR": true, "SMETHODS": true,
+	"PROXY": true, "PROXY-ERROR": true, "LOG": true, "STATUS": true,
+}
+
+// keyValueLine matches LOG and STATUS lines, whose arguments are KEY=value
+// pairs with values that are quoted if they contain special characters.
+var keyValueLine = regexp.MustCompile(`^(LOG|STATUS)( [A-Z0-9_-]+=("([^"\\]|\\.)*"|[^ "\\]*))+$`)
+
+// checkIPCOutput reports each line of output that is not a valid line of the
+// Pluggable Transport protocol.
+func checkIPCOutput(t *testing.T, mode string, output string) {
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) == 0 || !ipcKeywords[fields[0]] {
+			t.Errorf("%s mode wrote a line that is not part of the protocol: %q", mode, line)
+			continue
+		}
+		if (fields[0] == "LOG" || fields[0] == "STATUS") && !keyValueLine.MatchString(line) {
+			t.Errorf("%s mode wrote a malformed %s line: %q", mode, fields[0], line)
+		}
+	}
+}
+
+// captureStdout runs run with stdout and the IPC output redirected, and
+// returns what was written to them.
+func captureStdout(t *testing.T, run func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal("could not create a pipe:", err)
+	}
+
+	output := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		output <- string(data)
+	}()
+
+	stdout, ipcStdout := os.Stdout, pt.Stdout
+	os.Stdout, pt.Stdout = w, w
+	run()
+	os.Stdout, pt.Stdout = stdout, ipcStdout
+	_ = w.Close()
+
+	return <-output
+}
+
+// freeAddr returns a local address that is not in use.
+func freeAddr(t *testing.T, network string) string {
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal("could not find a free port:", err)
+		}
+		defer conn.Close()
+		return conn.LocalAddr().String()
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("could not find a free port:", err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// serverInfo returns the server information for an obfs2 server on
+// bindaddr that forwards to orAddr.
+func serverInfo(t *testing.T, bindaddr string, orAddr string) pt.ServerInfo {
+	bind, err := net.ResolveTCPAddr("tcp", bindaddr)
+	if err != nil {
+		t.Fatal("could not resolve the bind address:", err)
+	}
+	or, err := net.ResolveTCPAddr("tcp", orAddr)
+	if err != nil {
+		t.Fatal("could not resolve the ORPort address:", err)
+	}
+
+	return pt.ServerInfo{Bindaddrs: []pt.Bindaddr{{MethodName: "obfs2", Addr: bind}}, OrAddr: or}
+}
+
+// echoOver writes a message to conn and checks that it is echoed back.
+func echoOver(conn net.Conn) error {
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	message := []byte("hello over obfs2")
+	if _, err := conn.Write(message); err != nil {
+		return err
+	}
+	echo := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, echo); err != nil {
+		return err
+	}
+	if string(echo) != string(message) {
+		return fmt.Errorf("unexpected echo %q", echo)
+	}
+
+	return nil
+}
+
+// socksConnect performs a SOCKS5 CONNECT to an IPv4 target without
+// authentication.
+func socksConnect(conn net.Conn, target string) error {
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		return err
+	}
+	methodReply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, methodReply); err != nil {
+		return err
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", target)
+	if err != nil {
+		return err
+	}
+	request := append([]byte{0x05, 0x01, 0x00, 0x01}, addr.IP.To4()...)
+	request = append(request, byte(addr.Port>>8), byte(addr.Port))
+	if _, err = conn.Write(request); err != nil {
+		return err
+	}
+	reply := make([]byte, 10)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return fmt.Errorf("SOCKS reply %d", reply[1])
+	}
+
+	return nil
+}
+
+// httpConnectRequest sends an HTTP CONNECT request for target.
+func httpConnectRequest(conn net.Conn, target string) error {
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// stunBindingRequest returns a STUN binding request without attributes.
+func stunBindingRequest() []byte {
+	request := make([]byte, 20)
+	binary.BigEndian.PutUint16(request[0:], 0x0001)
+	binary.BigEndian.PutUint32(request[4:], 0x2112A442)
+	copy(request[8:], "dispatcher12")
+
+	return request
+}
+
+// sendUDPUntilReceived sends packets to the client listener until the UDP
+// server behind the transport server receives one.
+func sendUDPUntilReceived(listenAddr string, or net.PacketConn, packet []byte) error {
+	conn, err := net.Dial("udp", listenAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 1024)
+	for i := 0; i < 50; i++ {
+		if _, err = conn.Write(packet); err != nil {
+			return err
+		}
+		_ = or.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if _, _, err = or.ReadFrom(buf); err == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no packet was received: %s", err)
+}
+
+// TestStdoutIsIPCOnly tests that each mode writes only Pluggable Transport
+// protocol lines to stdout while setting up and relaying a connection, with
+// all log messages sent over IPC.
+func TestStdoutIsIPCOnly(t *testing.T) {
+	_ = log.Init(false, "", log.LevelDebug)
+	defer func() { _ = log.Init(false, "", log.LevelNone) }()
+
+	stateDir, err := ioutil.TempDir("", "stdouttest")
+	if err != nil {
+		t.Fatal("could not create the state directory:", err)
+	}
+	defer os.RemoveAll(stateDir)
+
+	echo := testutil.StartTCPEcho(t)
+	defer echo.Close()
+
+	tcpModes := []struct {
+		name    string
+		server  func(info pt.ServerInfo) bool
+		client  func(listenAddr string, serverAddr string) bool
+		connect func(conn net.Conn, serverAddr string) error
+	}{
+		{"socks5", func(info pt.ServerInfo) bool { return pt_socks5.ServerSetup(info, stateDir, "") },
+			func(listenAddr string, serverAddr string) bool {
+				return pt_socks5.ClientSetup(listenAddr, nil, []string{"obfs2"}, "")
+			}, socksConnect},
+		{"transparent-TCP", func(info pt.ServerInfo) bool { return transparent_tcp.ServerSetup(info, stateDir, "") },
+			func(listenAddr string, serverAddr string) bool {
+				return transparent_tcp.ClientSetup(listenAddr, serverAddr, nil, []string{"obfs2"}, "")
+			}, func(net.Conn, string) error { return nil }},
+		{"http-connect", func(info pt.ServerInfo) bool { return http_connect.ServerSetup(info, stateDir, "") },
+			func(listenAddr string, serverAddr string) bool {
+				return http_connect.ClientSetup(listenAddr, "", nil, []string{"obfs2"}, "", false)
+			}, httpConnectRequest},
+	}
+	for _, mode := range tcpModes {
+		output := captureStdout(t, func() {
+			serverAddr := freeAddr(t, "tcp")
+			if !mode.server(serverInfo(t, serverAddr, echo.Addr().String())) {
+				t.Errorf("%s server failed to launch", mode.name)
+				return
+			}
+			listenAddr := freeAddr(t, "tcp")
+			if !mode.client(listenAddr, serverAddr) {
+				t.Errorf("%s client failed to launch", mode.name)
+				return
+			}
+
+			conn, dialErr := net.Dial("tcp", listenAddr)
+			if dialErr != nil {
+				t.Errorf("could not connect to the %s client: %s", mode.name, dialErr)
+				return
+			}
+			defer conn.Close()
+			if err := mode.connect(conn, serverAddr); err != nil {
+				t.Errorf("%s request failed: %s", mode.name, err)
+				return
+			}
+			if err := echoOver(conn); err != nil {
+				t.Errorf("%s relay failed: %s", mode.name, err)
+			}
+		})
+		checkIPCOutput(t, mode.name, output)
+	}
+
+	udpModes := []struct {
+		name   string
+		server func(info pt.ServerInfo) bool
+		client func(listenAddr string, serverAddr string) bool
+		packet []byte
+	}{
+		{"transparent-UDP", func(info pt.ServerInfo) bool { return transparent_udp.ServerSetup(info, stateDir, "") },
+			func(listenAddr string, serverAddr string) bool {
+				return transparent_udp.ClientSetup(listenAddr, serverAddr, nil, []string{"obfs2"}, "")
+			}, []byte("hello over obfs2")},
+		{"STUN", func(info pt.ServerInfo) bool { return stun_udp.ServerSetup(info, stateDir, "") },
+			func(listenAddr string, serverAddr string) bool {
+				return stun_udp.ClientSetup(listenAddr, serverAddr, nil, []string{"obfs2"}, "")
+			}, stunBindingRequest()},
+	}
+	for _, mode := range udpModes {
+		output := captureStdout(t, func() {
+			or, listenErr := net.ListenPacket("udp", "127.0.0.1:0")
+			if listenErr != nil {
+				t.Errorf("could not start the %s ORPort: %s", mode.name, listenErr)
+				return
+			}
+			defer or.Close()
+
+			serverAddr := freeAddr(t, "tcp")
+			if !mode.server(serverInfo(t, serverAddr, or.LocalAddr().String())) {
+				t.Errorf("%s server failed to launch", mode.name)
+				return
+			}
+			listenAddr := freeAddr(t, "udp")
+			if !mode.client(listenAddr, serverAddr) {
+				t.Errorf("%s client failed to launch", mode.name)
+				return
+			}
+
+			if err := sendUDPUntilReceived(listenAddr, or, mode.packet); err != nil {
+				t.Errorf("%s relay failed: %s", mode.name, err)
+			}
+		})
+		checkIPCOutput(t, mode.name, output)
+	}
+}
@@ -41,7 +41,9 @@ import (
 	"github.com/OperatorFoundation/shapeshifter-transports/transports/obfs2/v2"
 	"github.com/OperatorFoundation/shapeshifter-transports/transports/obfs4/v2"
 	"github.com/OperatorFoundation/shapeshifter-transports/transports/shadow/v2"
+	shadowsocks "github.com/shadowsocks/go-shadowsocks2/core"
 	"golang.org/x/net/proxy"
+	"net"
 )
 
 // Transports returns the list of registered transport protocols.
@@ -73,14 +75,42 @@ func ParseArgsObfs4(args string, target string, dialer proxy.Dialer) (*obfs4.Opt
 	return &transport, nil
 }
 
-func ParseArgsShadow(args string, target string) (*shadow.Transport, error) {
+// ShadowTransport is a shadow client transport that connects to the server
+// using the provided dialer, so that an upstream proxy can be used.
+type ShadowTransport struct {
+	Cipher  shadowsocks.Cipher
+	Address string
+	Dialer  proxy.Dialer
+}
+
+// Dial creates outgoing transport connection
+func (transport *ShadowTransport) Dial() (net.Conn, error) {
+	conn, err := transport.Dialer.Dial("tcp", transport.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	return transport.Cipher.StreamConn(conn), nil
+}
+
+func ParseArgsShadow(args string, target string, dialer proxy.Dialer) (*ShadowTransport, error) {
 	var config shadow.Config
 	bytes := []byte(args)
 	jsonError := json.Unmarshal(bytes, &config)
 	if jsonError != nil {
 		return nil, errors.New("shadow options json decoding error")
 	}
-	transport := shadow.NewTransport(config.Password, config.CipherName, target)
+
+	cipher, cipherError := shadowsocks.PickCipher(config.CipherName, nil, config.Password)
+	if cipherError != nil {
+		return nil, errors.New("shadow cipher could not be created")
+	}
+
+	transport := ShadowTransport{
+		Cipher:  cipher,
+		Address: target,
+		Dialer:  dialer,
+	}
 
 	return &transport, nil
 }
@@ -254,7 +284,7 @@ func ParseArgsOptimizer(jsonConfig string, dialer proxy.Dialer) (*Optimizer.Clie
 	}
 	transports, parseErr = parseTransports(config.Transports, dialer)
 	if parseErr != nil {
-		println("this is the returned error from parseTransports:", parseErr)
+		log.Errorf("could not parse the transports of the optimizer config: %s", parseErr)
 		return nil, errors.New("could not parse transports")
 	}
 
@@ -347,7 +377,7 @@ func parsedTransport(otc map[string]interface{}, dialer proxy.Dialer) (Optimizer
 	jsonConfigString := string(jsonConfigBytes)
 	switch PartialConfig.Name {
 	case "shadow":
-		shadowTransport, parseErr := ParseArgsShadow(jsonConfigString, PartialConfig.Address)
+		shadowTransport, parseErr := ParseArgsShadow(jsonConfigString, PartialConfig.Address, dialer)
 		if parseErr != nil {
 			return nil, errors.New("could not parse shadow Args")
 		}